@@ -49,9 +49,10 @@ func (p *Program) String() string {
 
 // Statements
 type LetStatement struct {
-	Token token.Token // the token.LET token
-	Name  *Identifier
-	Value Expression
+	Token    token.Token // the token.LET token
+	Name     *Identifier
+	Value    Expression
+	Exported bool // the statement is preceded by export
 }
 
 func (ls *LetStatement) statementNode()       {}
@@ -59,6 +60,9 @@ func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
+	if ls.Exported {
+		out.WriteString("export ")
+	}
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
 	out.WriteString(" = ")
@@ -222,6 +226,9 @@ type FunctionLiteral struct {
 	Parameters []*Identifier
 	Body       *BlockStatement
 	Name       string
+
+	// IsGenerator is set by the parser when the body yields
+	IsGenerator bool
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -344,3 +351,29 @@ func (hl *HashLiteral) String() string {
 
 	return out.String()
 }
+
+type YieldExpression struct {
+	Token token.Token // the 'yield' token
+	Value Expression  // nil when nothing is yielded
+}
+
+func (ye *YieldExpression) expressionNode()      {}
+func (ye *YieldExpression) TokenLiteral() string { return ye.Token.Literal }
+func (ye *YieldExpression) String() string {
+	if ye.Value == nil {
+		return ye.TokenLiteral()
+	}
+
+	return ye.TokenLiteral() + " " + ye.Value.String()
+}
+
+type ImportExpression struct {
+	Token token.Token // the 'import' token
+	Path  string
+}
+
+func (ie *ImportExpression) expressionNode()      {}
+func (ie *ImportExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *ImportExpression) String() string {
+	return ie.TokenLiteral() + " \"" + ie.Path + "\""
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"monkey/ast"
 	"monkey/compiler"
 	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/regvm"
 	"monkey/vm"
+	"runtime"
 	"time"
 )
 
-var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+var engine = flag.String("engine", "vm", "use 'vm', 'reg' or 'eval'")
+var optimizationLevel = flag.Int("O", 1, "optimization level for the vm, 0, 1 or 2")
+var compare = flag.Bool("compare", false, "run the vm with the plain instruction set and with superinstructions")
 
 var input = `
 let fibonacci = fn(x) {
@@ -36,39 +41,77 @@ func main() {
 
 	var duration time.Duration
 	var result object.Object
+	var before, after runtime.MemStats
 
 	l := lexer.New(input)
 	p := parser.New(l)
 	program := p.ParseProgram()
 
-	if *engine == "vm" {
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Printf("compiler error: %s", err)
-		}
-
-		machine := vm.New(comp.Bytecode())
+	if *compare {
+		plainResult, plainDuration := runVM(program, compiler.O1)
+		fusedResult, fusedDuration := runVM(program, compiler.O2)
 
-		start := time.Now()
-		err = machine.Run()
-		if err != nil {
-			fmt.Printf("vm error: %s", err)
-		}
+		fmt.Printf("plain instructions: result = %s, duration=%s\n", plainResult.Inspect(), plainDuration)
+		fmt.Printf("superinstructions:  result = %s, duration=%s\n", fusedResult.Inspect(), fusedDuration)
+		fmt.Printf("speed-up: %.2fx\n", float64(plainDuration)/float64(fusedDuration))
+		return
+	}
 
-		duration = time.Since(start)
-		result = machine.LastPoppedStackElem()
+	runtime.ReadMemStats(&before)
+	if *engine == "vm" {
+		result, duration = runVM(program, compiler.OptimizationLevel(*optimizationLevel))
+	} else if *engine == "reg" {
+		result, duration = runRegisterVM(program)
 	} else {
 		env := object.NewEnvironment()
 		start := time.Now()
 		result = evaluator.Eval(program, env)
 		duration = time.Since(start)
 	}
+	runtime.ReadMemStats(&after)
 
 	fmt.Printf(
-		"engine=%s, resutl = %s, duration=%s\n",
+		"engine=%s, result = %s, duration=%s, allocations=%d\n",
 		*engine,
 		result.Inspect(),
 		duration,
+		after.Mallocs-before.Mallocs,
 	)
 }
+
+func runVM(program *ast.Program, level compiler.OptimizationLevel) (object.Object, time.Duration) {
+	comp := compiler.New()
+	comp.SetOptimizationLevel(level)
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Printf("compiler error: %s", err)
+	}
+
+	machine := vm.New(comp.Bytecode())
+
+	start := time.Now()
+	err = machine.Run()
+	if err != nil {
+		fmt.Printf("vm error: %s", err)
+	}
+
+	return machine.LastPoppedStackElem(), time.Since(start)
+}
+
+func runRegisterVM(program *ast.Program) (object.Object, time.Duration) {
+	comp := regvm.NewCompiler()
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Printf("compiler error: %s", err)
+	}
+
+	machine := regvm.New(comp.Bytecode())
+
+	start := time.Now()
+	err = machine.Run()
+	if err != nil {
+		fmt.Printf("vm error: %s", err)
+	}
+
+	return machine.LastValue(), time.Since(start)
+}
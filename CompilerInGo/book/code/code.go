@@ -40,6 +40,22 @@ const (
 	OpClosure
 	OpGetFree
 	OpCurrentClosure
+	OpJumpTruthy
+
+	// Superinstructions fusing common sequences, only emitted by the optimizer
+	OpGetLocalAddConst
+	OpGetLocalSubConst
+	OpGetLocalGetLocal
+	OpJumpNotEqual
+	OpJumpNotGreaterThan
+
+	// OpWide prefixes another instruction whose operands are twice as wide
+	OpWide
+
+	OpTailCall
+	OpYield
+	OpImport
+	OpModule
 )
 
 type Defintion struct {
@@ -78,6 +94,20 @@ var definitions = map[Opcode]*Defintion{
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpJumpTruthy:     {"OpJumpTruthy", []int{2}},
+
+	OpGetLocalAddConst:   {"OpGetLocalAddConst", []int{1, 2}},
+	OpGetLocalSubConst:   {"OpGetLocalSubConst", []int{1, 2}},
+	OpGetLocalGetLocal:   {"OpGetLocalGetLocal", []int{1, 1}},
+	OpJumpNotEqual:       {"OpJumpNotEqual", []int{2}},
+	OpJumpNotGreaterThan: {"OpJumpNotGreaterThan", []int{2}},
+
+	OpWide: {"OpWide", []int{}},
+
+	OpTailCall: {"OpTailCall", []int{1}},
+	OpYield:    {"OpYield", []int{}},
+	OpImport:   {"OpImport", []int{2}},
+	OpModule:   {"OpModule", []int{2}},
 }
 
 func Lookup(op byte) (*Defintion, error) {
@@ -89,12 +119,87 @@ func Lookup(op byte) (*Defintion, error) {
 	return def, nil
 }
 
+// Make encodes an instruction whose operands are known to fit their widths,
+// as in tests, and panics if one does not. The compiler uses MakeInstruction,
+// which returns an error instead.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
 
+	return mustEncode(op, def, operands)
+}
+
+// MakeWide encodes the instruction behind an OpWide prefix.
+func MakeWide(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	return append([]byte{byte(OpWide)}, mustEncode(op, WideDefinition(def), operands)...)
+}
+
+// MakeInstruction encodes an instruction, behind an OpWide prefix when an
+// operand does not fit its width. Operands too large even for that, like the
+// index of a local in a function with more than 65535 of them, are an error.
+func MakeInstruction(op Opcode, operands ...int) ([]byte, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	if Fits(op, operands...) {
+		return encode(op, def, operands)
+	}
+
+	instruction, err := encode(op, WideDefinition(def), operands)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(OpWide)}, instruction...), nil
+}
+
+// Fits reports whether Make can encode the operands without the OpWide prefix.
+func Fits(op Opcode, operands ...int) bool {
+	def, ok := definitions[op]
+	if !ok {
+		return true
+	}
+
+	for i, o := range operands {
+		if !fitsWidth(o, def.OperandWidths[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WideDefinition describes the operands of op when it follows OpWide.
+func WideDefinition(def *Defintion) *Defintion {
+	widths := make([]int, len(def.OperandWidths))
+	for i, w := range def.OperandWidths {
+		widths[i] = w * 2
+	}
+
+	return &Defintion{Name: def.Name, OperandWidths: widths}
+}
+
+func fitsWidth(operand int, width int) bool {
+	return operand >= 0 && uint64(operand) < 1<<(8*uint(width))
+}
+
+func mustEncode(op Opcode, def *Defintion, operands []int) []byte {
+	instruction, err := encode(op, def, operands)
+	if err != nil {
+		panic(err.Error())
+	}
+	return instruction
+}
+
+func encode(op Opcode, def *Defintion, operands []int) ([]byte, error) {
 	instructionLen := 1
 	for _, w := range def.OperandWidths {
 		instructionLen += w
@@ -106,16 +211,22 @@ func Make(op Opcode, operands ...int) []byte {
 
 	for i, o := range operands {
 		width := def.OperandWidths[i]
+		if !fitsWidth(o, width) {
+			return nil, fmt.Errorf("operand %d of %s does not fit in %d bytes", o, def.Name, width)
+		}
+
 		switch width {
 		case 1:
 			instruction[offset] = byte(o)
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
 
-	return instruction
+	return instruction, nil
 }
 
 func (ins Instructions) String() string {
@@ -130,6 +241,20 @@ func (ins Instructions) String() string {
 			continue
 		}
 
+		if Opcode(ins[i]) == OpWide {
+			wide, err := Lookup(ins[i+1])
+			if err != nil {
+				fmt.Fprintf(&out, "ERROR: %s\n", err)
+				return out.String()
+			}
+
+			operands, read := ReadOperands(WideDefinition(wide), ins[i+2:])
+			fmt.Fprintf(&out, "%04d OpWide %s\n", i, ins.fmtInstruction(wide, operands))
+
+			i += 2 + read
+			continue
+		}
+
 		operands, read := ReadOperands(def, ins[i+1:])
 
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
@@ -169,6 +294,8 @@ func ReadOperands(def *Defintion, ins Instructions) ([]int, int) {
 			operands[i] = int(ReadUint8(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		}
 		offset += width
 	}
@@ -180,6 +307,10 @@ func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint8(ins Instructions) uint8 {
 	return byte(ins[0])
 }
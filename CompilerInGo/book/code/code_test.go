@@ -1,6 +1,7 @@
 package code
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -87,3 +88,109 @@ func TestReadOperands(t *testing.T) {
 	}
 
 }
+
+func TestMakeWide(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpJump, []int{65536}, []byte{byte(OpWide), byte(OpJump), 0, 1, 0, 0}},
+		{OpClosure, []int{70000, 300}, []byte{byte(OpWide), byte(OpClosure), 0, 1, 17, 112, 1, 44}},
+	}
+
+	for _, tt := range tests {
+		if Fits(tt.op, tt.operands...) {
+			t.Errorf("expected operands %v not to fit %d", tt.operands, tt.op)
+		}
+
+		instruction := MakeWide(tt.op, tt.operands...)
+		if len(instruction) != len(tt.expected) {
+			t.Fatalf("instruction has wrong length, wanted %d got %d", len(tt.expected), len(instruction))
+		}
+
+		for i, b := range tt.expected {
+			if instruction[i] != b {
+				t.Errorf("wrong byte in instruction at position %d. Wanted %d, got %d", i, b, instruction[i])
+			}
+		}
+	}
+}
+
+func TestMakePanicsOnOperandOverflow(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{OpGetLocal, []int{256}, "operand 256 of OpGetLocal does not fit in 1 bytes"},
+		{OpJump, []int{65536}, "operand 65536 of OpJump does not fit in 2 bytes"},
+		{OpCall, []int{-1}, "operand -1 of OpCall does not fit in 1 bytes"},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				r := recover()
+				if r != tt.expected {
+					t.Errorf("expected panic %q, got %v", tt.expected, r)
+				}
+			}()
+
+			Make(tt.op, tt.operands...)
+		}()
+	}
+}
+
+func TestMakeInstruction(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+		err      string
+	}{
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}, ""},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}, ""},
+		{OpGetLocal, []int{65536}, nil, "operand 65536 of OpGetLocal does not fit in 2 bytes"},
+		{OpCall, []int{-1}, nil, "operand -1 of OpCall does not fit in 2 bytes"},
+	}
+
+	for _, tt := range tests {
+		instruction, err := MakeInstruction(tt.op, tt.operands...)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(instruction, tt.expected) {
+			t.Errorf("wrong instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+	}
+}
+
+func TestWideInstructionsString(t *testing.T) {
+	instructions := []Instructions{
+		MakeWide(OpGetLocal, 300),
+		Make(OpAdd),
+		MakeWide(OpClosure, 70000, 256),
+	}
+
+	expected := `0000 OpWide OpGetLocal 300
+0004 OpAdd
+0005 OpWide OpClosure 70000 256
+`
+
+	concatted := Instructions{}
+	for _, ins := range instructions {
+		concatted = append(concatted, ins...)
+	}
+
+	if concatted.String() != expected {
+		t.Errorf("instructions wrongly formatted,\nWant: %q\nGot: %q", expected, concatted.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/module"
 	"monkey/object"
 	"sort"
 )
@@ -12,6 +13,11 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	// farJumps holds jump targets that did not fit the jump's operand,
+	// keyed by the position of the jump
+	farJumps map[int]int
+	// module is set for the top level of an imported module
+	module bool
 }
 
 type Compiler struct {
@@ -19,6 +25,22 @@ type Compiler struct {
 	symbolTable *SymbolTable
 	scopes      []CompilationScope
 	scopeIndex  int
+
+	optimizationLevel OptimizationLevel
+	tailCalls         map[*ast.CallExpression]bool
+
+	file    string // the file being compiled, empty if it is not from one
+	modules *modules
+
+	err error // the first instruction that could not be encoded
+}
+
+// modules are the modules a program imports, each compiled once into a
+// function that runs the module and gives the module object.
+type modules struct {
+	loader   object.ModuleLoader
+	compiled map[string]int // the constant index of each module's function by path
+	loading  []string       // the modules being compiled, outermost first
 }
 
 type Bytecode struct {
@@ -48,6 +70,11 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		tailCalls:   map[*ast.CallExpression]bool{},
+		modules: &modules{
+			loader:   module.NewResolver(),
+			compiled: map[string]int{},
+		},
 	}
 }
 
@@ -58,31 +85,62 @@ func NewWithState(st *SymbolTable, constants []object.Object) *Compiler {
 	return compiler
 }
 
+func (c *Compiler) SetOptimizationLevel(level OptimizationLevel) {
+	c.optimizationLevel = level
+}
+
+// SetModuleLoader sets how imported modules are found, a module.Resolver
+// without search paths by default.
+func (c *Compiler) SetModuleLoader(loader object.ModuleLoader) {
+	c.modules.loader = loader
+}
+
+// SetFile sets the path of the file being compiled, which imports are
+// relative to.
+func (c *Compiler) SetFile(path string) {
+	c.file = path
+}
+
+// Compile compiles node into the compiler's bytecode. Programs the bytecode
+// cannot hold, like a function with more locals than an operand can index,
+// are an error.
 func (c *Compiler) Compile(node ast.Node) error {
+	if err := c.compile(node); err != nil {
+		return err
+	}
+	return c.err
+}
+
+func (c *Compiler) compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
-			err := c.Compile(s)
+			err := c.compile(s)
 			if err != nil {
 				return err
 			}
 		}
 
 	case *ast.ExpressionStatement:
-		err := c.Compile(node.Expression)
+		err := c.compile(node.Expression)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 
 	case *ast.InfixExpression:
+		if c.optimizationLevel >= O1 {
+			if folded := foldConstants(node); folded != ast.Expression(node) {
+				return c.compile(folded)
+			}
+		}
 
 		if node.Operator == "<" { // Swap operator as use greater than
-			err := c.Compile(node.Right)
+			err := c.compile(node.Right)
 			if err != nil {
 				return err
 			}
-			err = c.Compile(node.Left)
+			err = c.compile(node.Left)
 			if err != nil {
 				return err
 			}
@@ -91,12 +149,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return nil
 		}
 
-		err := c.Compile(node.Left)
+		err := c.compile(node.Left)
 		if err != nil {
 			return err
 		}
 
-		err = c.Compile(node.Right)
+		err = c.compile(node.Right)
 		if err != nil {
 			return err
 		}
@@ -121,7 +179,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.PrefixExpression:
-		err := c.Compile(node.Right)
+		if c.optimizationLevel >= O1 {
+			if folded := foldConstants(node); folded != ast.Expression(node) {
+				return c.compile(folded)
+			}
+		}
+
+		err := c.compile(node.Right)
 		if err != nil {
 			return err
 		}
@@ -135,13 +199,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.IfExpression:
-		err := c.Compile(node.Condition)
+		condition := node.Condition
+		if c.optimizationLevel >= O1 {
+			condition = simplifyCondition(condition)
+			if truthy, ok := constantTruthiness(condition); ok {
+				return c.compileKnownBranch(node, truthy)
+			}
+		}
+
+		err := c.compile(condition)
 		if err != nil {
 			return err
 		}
 		//Bogus value to fix later (see replace operand later)
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
-		err = c.Compile(node.Consequence)
+		err = c.compile(node.Consequence)
 		if err != nil {
 			return err
 		}
@@ -159,7 +231,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err := c.Compile(node.Alternative)
+			err := c.compile(node.Alternative)
 			if err != nil {
 				return err
 			}
@@ -173,7 +245,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
-			err := c.Compile(s)
+			err := c.compile(s)
 			if err != nil {
 				return err
 			}
@@ -195,7 +267,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.LetStatement:
 		symbol := c.symbolTable.Define(node.Name.Value)
-		err := c.Compile(node.Value)
+		err := c.compile(node.Value)
 		if err != nil {
 			return err
 		}
@@ -216,7 +288,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.ArrayLiteral:
 		for _, item := range node.Elements {
-			err := c.Compile(item)
+			err := c.compile(item)
 			if err != nil {
 				return err
 			}
@@ -235,12 +307,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		})
 
 		for _, k := range keys {
-			err := c.Compile(k)
+			err := c.compile(k)
 			if err != nil {
 				return err
 			}
 
-			err = c.Compile(node.Pairs[k])
+			err = c.compile(node.Pairs[k])
 			if err != nil {
 				return err
 			}
@@ -249,11 +321,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpHash, len(node.Pairs)*2)
 
 	case *ast.IndexExpression:
-		err := c.Compile(node.Left)
+		err := c.compile(node.Left)
 		if err != nil {
 			return err
 		}
-		err = c.Compile(node.Index)
+		err = c.compile(node.Index)
 		if err != nil {
 			return err
 		}
@@ -270,7 +342,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.symbolTable.Define(p.Value)
 		}
 
-		err := c.Compile(node.Body)
+		c.markTailCalls(node.Body)
+
+		err := c.compile(node.Body)
 		if err != nil {
 			return err
 		}
@@ -286,6 +360,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
 		instructions := c.leaveScope()
+		if c.optimizationLevel >= O1 {
+			instructions = optimizeInstructions(instructions, c.optimizationLevel)
+		}
 
 		for _, s := range freeSymbols {
 			c.loadSymbol(s)
@@ -295,32 +372,158 @@ func (c *Compiler) Compile(node ast.Node) error {
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			IsGenerator:   node.IsGenerator,
 		}
 
 		fnIndex := c.AddConstant(&compiledFn)
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
 
 	case *ast.ReturnStatement:
-		err := c.Compile(node.ReturnValue)
+		if c.scopes[c.scopeIndex].module {
+			return fmt.Errorf("return outside of a function in module %s", c.file)
+		}
+		if c.scopeIndex > 0 {
+			c.markTailExpression(node.ReturnValue)
+		}
+
+		err := c.compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpReturnValue)
 
+	case *ast.YieldExpression:
+		if node.Value == nil {
+			c.emit(code.OpNull)
+		} else {
+			err := c.compile(node.Value)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpYield)
+
+	case *ast.ImportExpression:
+		fnIndex, err := c.compileModule(node.Path)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpImport, fnIndex)
+
 	case *ast.CallExpression:
-		err := c.Compile(node.Function)
+		err := c.compile(node.Function)
 		if err != nil {
 			return err
 		}
 
 		for _, arg := range node.Arguments {
-			err := c.Compile(arg)
+			err := c.compile(arg)
 			if err != nil {
 				return err
 			}
 		}
 
-		c.emit(code.OpCall, len(node.Arguments))
+		if c.tailCalls[node] {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+	}
+
+	return nil
+}
+
+// compileModule compiles the module name refers to, unless it already has
+// been, and returns the constant index of the function running it. The
+// function runs the module's statements with the module's own globals and
+// ends with OpModule, which makes the module object from the exports.
+func (c *Compiler) compileModule(name string) (int, error) {
+	path, err := c.modules.loader.Resolve(name, c.file)
+	if err != nil {
+		return 0, err
+	}
+	if fnIndex, ok := c.modules.compiled[path]; ok {
+		return fnIndex, nil
+	}
+	if err := object.ImportCycle(c.modules.loading, path); err != nil {
+		return 0, err
+	}
+
+	program, err := c.modules.loader.Load(path)
+	if err != nil {
+		return 0, err
+	}
+
+	c.modules.loading = append(c.modules.loading, path)
+	file, symbolTable := c.file, c.symbolTable
+	c.file = path
+	c.symbolTable = NewModuleSymbolTable(symbolTable)
+	c.scopes = append(c.scopes, CompilationScope{instructions: code.Instructions{}, module: true})
+	c.scopeIndex++
+
+	defer func() {
+		c.modules.loading = c.modules.loading[:len(c.modules.loading)-1]
+		c.file, c.symbolTable = file, symbolTable
+		c.scopes = c.scopes[:len(c.scopes)-1]
+		c.scopeIndex--
+	}()
+
+	var exports []string
+	for _, s := range program.Statements {
+		err := c.compile(s)
+		if err != nil {
+			return 0, err
+		}
+
+		if let, ok := s.(*ast.LetStatement); ok && let.Exported {
+			exports = append(exports, let.Name.Value)
+		}
+	}
+
+	for _, name := range exports {
+		symbol, _ := c.symbolTable.Resolve(name)
+		c.emit(code.OpConstant, c.AddConstant(&object.String{Value: name}))
+		c.loadSymbol(symbol)
+	}
+	c.emit(code.OpModule, len(exports)*2)
+	c.emit(code.OpReturnValue)
+
+	instructions := c.finishedInstructions()
+	if c.optimizationLevel >= O1 {
+		instructions = optimizeInstructions(instructions, c.optimizationLevel)
+	}
+
+	fnIndex := c.AddConstant(&object.CompiledFunction{Instructions: instructions, Name: path})
+	c.modules.compiled[path] = fnIndex
+	return fnIndex, nil
+}
+
+// compileKnownBranch compiles only the branch of an if expression that a
+// constant condition would select, leaving its value on the stack.
+func (c *Compiler) compileKnownBranch(node *ast.IfExpression, condition bool) error {
+	branch := node.Consequence
+	if !condition {
+		branch = node.Alternative
+	}
+
+	if branch == nil {
+		c.emit(code.OpNull)
+		return nil
+	}
+
+	start := len(c.currentInstructions())
+	err := c.compile(branch)
+	if err != nil {
+		return err
+	}
+
+	if len(c.currentInstructions()) > start && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	}
+
+	if len(c.currentInstructions()) == start {
+		c.emit(code.OpNull)
 	}
 
 	return nil
@@ -355,7 +558,7 @@ func (c *Compiler) enterScope() {
 }
 
 func (c *Compiler) leaveScope() code.Instructions {
-	instructions := c.currentInstructions()
+	instructions := c.finishedInstructions()
 
 	c.symbolTable = c.symbolTable.Outer
 
@@ -370,7 +573,15 @@ func (c *Compiler) AddConstant(obj object.Object) int {
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins, err := code.MakeInstruction(op, operands...)
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		// keep the positions of what follows right until Compile reports it
+		ins = code.Make(op, make([]int, len(operands))...)
+	}
+
 	pos := c.addInstruction(ins)
 	c.setLastIntruction(op, pos)
 	return pos
@@ -407,6 +618,17 @@ func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
 
+// finishedInstructions returns the current scope's instructions with any
+// jumps beyond the reach of a two byte operand widened.
+func (c *Compiler) finishedInstructions() code.Instructions {
+	scope := c.scopes[c.scopeIndex]
+	if len(scope.farJumps) == 0 {
+		return scope.instructions
+	}
+
+	return widenJumps(scope.instructions, scope.farJumps)
+}
+
 func (c *Compiler) addInstruction(ins code.Instructions) int {
 	posNewInstruction := len(c.currentInstructions())
 	updatedInstructions := append(c.currentInstructions(), ins...)
@@ -418,6 +640,15 @@ func (c *Compiler) addInstruction(ins code.Instructions) int {
 
 func (c *Compiler) replaceOperand(pos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[pos])
+	if !code.Fits(op, operand) {
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = map[int]int{}
+		}
+		scope.farJumps[pos] = operand
+		return
+	}
+
 	newInstruction := code.Make(op, operand)
 	c.replaceInstruction(pos, newInstruction)
 }
@@ -439,7 +670,7 @@ func (c *Compiler) replaceLastPopWithReturn() {
 
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: c.finishedInstructions(),
 		Constants:    c.constants,
 	}
 }
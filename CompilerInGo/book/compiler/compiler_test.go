@@ -7,6 +7,7 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -912,19 +913,611 @@ func TestRecursiveFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2",
+			expectedConstants: []interface{}{3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "(2 + 3) * 4 - -1",
+			expectedConstants: []interface{}{21},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 < 2",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!(true == false)",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 / 0",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O1)
+}
+
+func TestAlgebraicSimplification(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// x might not be an integer, x * 1 is
+			input:             "let x = 5; x * 1 + 0",
+			expectedConstants: []interface{}{5, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 5; 1 * (x - 2) - 0",
+			expectedConstants: []interface{}{5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSub),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// "a" + 0 is a type error
+			input:             `"a" + 0`,
+			expectedConstants: []interface{}{"a", 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 5; !!(x > 1)",
+			expectedConstants: []interface{}{5, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// !!x is not x when x is an integer
+			input:             "let x = 5; !!x",
+			expectedConstants: []interface{}{5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpBang),
+				code.Make(code.OpBang),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O1)
+}
+
+func TestDeadBranchElimination(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 } else { 20 }; 3333",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (1 > 2) { 10 }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = true; if (!!x) { 10 }",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 16),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 17),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O1)
+}
+
+func TestPeepholeOptimizer(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(){ return 1; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(){ if (false) { 1 }; 2 }",
+			expectedConstants: []interface{}{
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(x){ if (!x) { 1 } else { 2 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpTruthy, 11),
+					// 0005
+					code.Make(code.OpConstant, 0),
+					// 0008
+					code.Make(code.OpJump, 14),
+					// 0011
+					code.Make(code.OpConstant, 1),
+					// 0014
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(x){ if (x) { if (x) { 1 } else { 2 } } else { 3 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 22),
+					// 0005
+					code.Make(code.OpGetLocal, 0),
+					// 0007
+					code.Make(code.OpJumpNotTruthy, 16),
+					// 0010
+					code.Make(code.OpConstant, 0),
+					// 0013 threaded straight past the outer jump
+					code.Make(code.OpJump, 25),
+					// 0016
+					code.Make(code.OpConstant, 1),
+					// 0019
+					code.Make(code.OpJump, 25),
+					// 0022
+					code.Make(code.OpConstant, 2),
+					// 0025
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O1)
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(x){ if (x == 0) { return 0 }; x - 1 }",
+			expectedConstants: []interface{}{
+				0,
+				0,
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpConstant, 0),
+					// 0005
+					code.Make(code.OpJumpNotEqual, 12),
+					// 0008
+					code.Make(code.OpConstant, 1),
+					// 0011
+					code.Make(code.OpReturnValue),
+					// 0012
+					code.Make(code.OpGetLocalSubConst, 0, 2),
+					// 0016
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a, b){ if (a > 1) { a + b } else { a + 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpConstant, 0),
+					// 0005
+					code.Make(code.OpJumpNotGreaterThan, 15),
+					// 0008
+					code.Make(code.OpGetLocalGetLocal, 0, 1),
+					// 0011
+					code.Make(code.OpAdd),
+					// 0012
+					code.Make(code.OpJump, 19),
+					// 0015
+					code.Make(code.OpGetLocalAddConst, 0, 1),
+					// 0019
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O2)
+}
+
 func parse(s string) *ast.Program {
 	l := lexer.New(s)
 	p := parser.New(l)
 	return p.ParseProgram()
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "let f = fn(a) { if (a) { f(a) } else { 1 + f(a) } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 13),
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: "fn() { return len([]); 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltIn, 0),
+					code.Make(code.OpArray, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "len([])",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltIn, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithLevel(t, tests, O1)
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { let x = yield 1; yield }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpYield),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpNull),
+					code.Make(code.OpYield),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	comp := New()
+	err := comp.Compile(parse("fn() { yield 1; fn() { 2 } }"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := comp.Bytecode().Constants
+	if fn := constants[len(constants)-1].(*object.CompiledFunction); !fn.IsGenerator {
+		t.Errorf("function with yield is not a generator")
+	}
+	if fn := constants[2].(*object.CompiledFunction); fn.IsGenerator {
+		t.Errorf("function nested in a generator is a generator")
+	}
+}
+
+// mapLoader loads modules from source held in memory, by name.
+type mapLoader map[string]string
+
+func (l mapLoader) Resolve(name, importer string) (string, error) {
+	if _, ok := l[name]; !ok {
+		return "", fmt.Errorf("module %q not found", name)
+	}
+	return name, nil
+}
+
+func (l mapLoader) Load(path string) (*ast.Program, error) {
+	return parse(l[path]), nil
+}
+
+func TestImports(t *testing.T) {
+	loader := mapLoader{
+		"m":    `let y = 2; export let x = y;`,
+		"a":    `import "b"`,
+		"b":    `import "a"`,
+		"ret":  `return 1`,
+		"self": `import "self"`,
+	}
+
+	comp := New()
+	comp.SetModuleLoader(loader)
+	err := comp.Compile(parse(`let a = 1; let m = import "m"; import "m"; m.x; let b = 3;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	err = testInstructions(t, []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpImport, 3),
+		code.Make(code.OpSetGlobal, 1),
+		code.Make(code.OpImport, 3),
+		code.Make(code.OpPop),
+		code.Make(code.OpGetGlobal, 1),
+		code.Make(code.OpConstant, 4),
+		code.Make(code.OpIndex),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 5),
+		code.Make(code.OpSetGlobal, 4),
+	}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	// the module's globals come after those the program had defined
+	err = testConstants(t, []interface{}{
+		1,
+		2,
+		"x",
+		[]code.Instructions{
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpSetGlobal, 2),
+			code.Make(code.OpGetGlobal, 2),
+			code.Make(code.OpSetGlobal, 3),
+			code.Make(code.OpConstant, 2),
+			code.Make(code.OpGetGlobal, 3),
+			code.Make(code.OpModule, 2),
+			code.Make(code.OpReturnValue),
+		},
+		"x",
+		3,
+	}, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "a"`, "import cycle: a -> b -> a"},
+		{`import "self"`, "import cycle: self -> self"},
+		{`import "ret"`, "return outside of a function in module ret"},
+		{`import "none"`, `module "none" not found`},
+		{`let m = import "m"; y`, "unable to resolve symbol y"},
+	}
+
+	for _, tt := range tests {
+		comp := New()
+		comp.SetModuleLoader(loader)
+		err := comp.Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected compiler error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	params := make([]string, 257)
+	for i := range params {
+		params[i] = letterIdentifier(i)
+	}
+
+	tests := []compilerTestCase{
+		{
+			input: fmt.Sprintf("fn(%s) { %s }", strings.Join(params, ", "), params[256]),
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.MakeWide(code.OpGetLocal, 256),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestOperandsTooLargeToEncode(t *testing.T) {
+	params := make([]string, 65537)
+	for i := range params {
+		params[i] = letterIdentifier(i)
+	}
+	input := fmt.Sprintf("fn(%s) { %s }", strings.Join(params, ", "), params[65536])
+
+	err := New().Compile(parse(input))
+	expected := "operand 65536 of OpGetLocal does not fit in 2 bytes"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected compiler error %q, got %v", expected, err)
+	}
+}
+
+// letterIdentifier names the i-th of many generated identifiers, identifiers
+// may not contain digits.
+func letterIdentifier(i int) string {
+	name := ""
+	for {
+		name = string(rune('a'+i%26)) + name
+		i = i/26 - 1
+		if i < 0 {
+			return "v" + name
+		}
+	}
+}
+
+func TestFarJumpsAreWidened(t *testing.T) {
+	n := 32768
+	input := "if (true) { " + strings.Repeat("true; ", n) + "}"
+
+	expected := []code.Instructions{
+		code.Make(code.OpTrue),
+		code.MakeWide(code.OpJumpNotTruthy, 12+2*n),
+	}
+	for i := 0; i < n-1; i++ {
+		expected = append(expected, code.Make(code.OpTrue), code.Make(code.OpPop))
+	}
+	expected = append(expected,
+		code.Make(code.OpTrue),
+		code.MakeWide(code.OpJump, 13+2*n),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+	)
+
+	runCompilerTests(t, []compilerTestCase{
+		{input: input, expectedConstants: []interface{}{}, expectedInstructions: expected},
+	})
+}
+
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
+	runCompilerTestsWithLevel(t, tests, O0)
+}
+
+func runCompilerTestsWithLevel(t *testing.T, tests []compilerTestCase, level OptimizationLevel) {
+	t.Helper()
 
 	for _, tt := range tests {
 		program := parse(tt.input)
 
 		compiler := New()
+		compiler.SetOptimizationLevel(level)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("Compiler error: %s", err)
@@ -0,0 +1,227 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/token"
+	"strconv"
+)
+
+type OptimizationLevel int
+
+const (
+	O0 OptimizationLevel = iota // emit bytecode exactly as written
+	O1                          // fold constants, prune dead branches, make tail calls and run the peephole pass
+	O2                          // everything in O1 plus superinstructions
+)
+
+// foldConstants returns an equivalent expression with constant sub-expressions
+// evaluated at compile time. The original node is returned untouched when
+// nothing could be simplified so callers can detect a fixed point.
+func foldConstants(exp ast.Expression) ast.Expression {
+	switch exp := exp.(type) {
+	case *ast.PrefixExpression:
+		right := foldConstants(exp.Right)
+		if folded := foldPrefix(exp.Operator, right); folded != nil {
+			return folded
+		}
+
+		if right != exp.Right {
+			return &ast.PrefixExpression{Token: exp.Token, Operator: exp.Operator, Right: right}
+		}
+
+	case *ast.InfixExpression:
+		left := foldConstants(exp.Left)
+		right := foldConstants(exp.Right)
+		if folded := foldInfix(exp.Operator, left, right); folded != nil {
+			return folded
+		}
+
+		if left != exp.Left || right != exp.Right {
+			return &ast.InfixExpression{Token: exp.Token, Operator: exp.Operator, Left: left, Right: right}
+		}
+	}
+
+	return exp
+}
+
+func foldPrefix(operator string, right ast.Expression) ast.Expression {
+	switch operator {
+	case "-":
+		if i, ok := right.(*ast.IntegerLiteral); ok {
+			return newIntegerLiteral(-i.Value)
+		}
+
+	case "!":
+		if truthy, ok := constantTruthiness(right); ok {
+			return newBooleanLiteral(!truthy)
+		}
+
+		// !!x is only the same value as x when x is already a boolean
+		if inner, ok := right.(*ast.PrefixExpression); ok && inner.Operator == "!" && isBooleanExpression(inner.Right) {
+			return inner.Right
+		}
+	}
+
+	return nil
+}
+
+func foldInfix(operator string, left, right ast.Expression) ast.Expression {
+	leftInt, leftIsInt := left.(*ast.IntegerLiteral)
+	rightInt, rightIsInt := right.(*ast.IntegerLiteral)
+
+	if leftIsInt && rightIsInt {
+		return foldIntegerInfix(operator, leftInt.Value, rightInt.Value)
+	}
+
+	leftStr, leftIsStr := left.(*ast.StringLiteral)
+	rightStr, rightIsStr := right.(*ast.StringLiteral)
+
+	// String equality is identity based at runtime so only concatenation is safe to fold
+	if leftIsStr && rightIsStr && operator == "+" {
+		return newStringLiteral(leftStr.Value + rightStr.Value)
+	}
+
+	leftBool, leftIsBool := left.(*ast.Boolean)
+	rightBool, rightIsBool := right.(*ast.Boolean)
+
+	if leftIsBool && rightIsBool {
+		switch operator {
+		case "==":
+			return newBooleanLiteral(leftBool.Value == rightBool.Value)
+		case "!=":
+			return newBooleanLiteral(leftBool.Value != rightBool.Value)
+		}
+	}
+
+	// Algebraic identities, which only hold when the other operand is an
+	// integer: "a" + 0 and true * 1 are type errors
+	switch {
+	case operator == "*" && rightIsInt && rightInt.Value == 1 && isIntegerExpression(left):
+		return left
+	case operator == "*" && leftIsInt && leftInt.Value == 1 && isIntegerExpression(right):
+		return right
+	case (operator == "+" || operator == "-") && rightIsInt && rightInt.Value == 0 && isIntegerExpression(left):
+		return left
+	case operator == "+" && leftIsInt && leftInt.Value == 0 && isIntegerExpression(right):
+		return right
+	}
+
+	return nil
+}
+
+// isIntegerExpression reports whether exp is known at compile time to give an
+// integer when it gives a value at all. Negation, -, * and / only work on
+// integers, so they either give one or fail before their result is used.
+func isIntegerExpression(exp ast.Expression) bool {
+	switch exp := exp.(type) {
+	case *ast.IntegerLiteral:
+		return true
+	case *ast.PrefixExpression:
+		return exp.Operator == "-"
+	case *ast.InfixExpression:
+		switch exp.Operator {
+		case "-", "*", "/":
+			return true
+		case "+":
+			return isIntegerExpression(exp.Left) && isIntegerExpression(exp.Right)
+		}
+	}
+
+	return false
+}
+
+func foldIntegerInfix(operator string, left, right int64) ast.Expression {
+	switch operator {
+	case "+":
+		return newIntegerLiteral(left + right)
+	case "-":
+		return newIntegerLiteral(left - right)
+	case "*":
+		return newIntegerLiteral(left * right)
+	case "/":
+		// leave division by zero for the runtime to report as an error
+		if right == 0 {
+			return nil
+		}
+		return newIntegerLiteral(left / right)
+	case "<":
+		return newBooleanLiteral(left < right)
+	case ">":
+		return newBooleanLiteral(left > right)
+	case "==":
+		return newBooleanLiteral(left == right)
+	case "!=":
+		return newBooleanLiteral(left != right)
+	}
+
+	return nil
+}
+
+// simplifyCondition folds a condition and drops double negation, which only
+// changes the value and not the truthiness of the expression.
+func simplifyCondition(exp ast.Expression) ast.Expression {
+	exp = foldConstants(exp)
+
+	for {
+		outer, ok := exp.(*ast.PrefixExpression)
+		if !ok || outer.Operator != "!" {
+			return exp
+		}
+
+		inner, ok := outer.Right.(*ast.PrefixExpression)
+		if !ok || inner.Operator != "!" {
+			return exp
+		}
+
+		exp = inner.Right
+	}
+}
+
+func constantTruthiness(exp ast.Expression) (bool, bool) {
+	switch exp := exp.(type) {
+	case *ast.Boolean:
+		return exp.Value, true
+	case *ast.IntegerLiteral, *ast.StringLiteral:
+		return true, true
+	}
+
+	return false, false
+}
+
+func isBooleanExpression(exp ast.Expression) bool {
+	switch exp := exp.(type) {
+	case *ast.Boolean:
+		return true
+	case *ast.PrefixExpression:
+		return exp.Operator == "!"
+	case *ast.InfixExpression:
+		switch exp.Operator {
+		case "<", ">", "==", "!=":
+			return true
+		}
+	}
+
+	return false
+}
+
+func newIntegerLiteral(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{
+		Token: token.Token{Type: token.INT, Literal: strconv.FormatInt(value, 10)},
+		Value: value,
+	}
+}
+
+func newStringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{
+		Token: token.Token{Type: token.STRING, Literal: value},
+		Value: value,
+	}
+}
+
+func newBooleanLiteral(value bool) *ast.Boolean {
+	if value {
+		return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true"}, Value: true}
+	}
+
+	return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "false"}, Value: false}
+}
@@ -0,0 +1,338 @@
+package compiler
+
+import (
+	"math"
+	"monkey/code"
+)
+
+type decodedInstruction struct {
+	op       code.Opcode
+	operands []int
+	position int // offset in the instructions the peephole pass started from
+	removed  bool
+}
+
+// optimizeInstructions runs peephole rewrites over a finished function body
+// until nothing else changes, then re-encodes it with all jumps relocated.
+func optimizeInstructions(ins code.Instructions, level OptimizationLevel) code.Instructions {
+	for {
+		decoded := decodeInstructions(ins)
+
+		changed := threadJumps(decoded)
+		changed = removeUnreachable(decoded) || changed
+		changed = removeNullPops(decoded) || changed
+		changed = invertBangJumps(decoded) || changed
+		changed = removeJumpsToNext(decoded) || changed
+
+		if level >= O2 {
+			changed = fuseSuperinstructions(decoded) || changed
+		}
+
+		if !changed {
+			return ins
+		}
+
+		ins = encodeInstructions(decoded, len(ins))
+	}
+}
+
+func decodeInstructions(ins code.Instructions) []*decodedInstruction {
+	decoded := []*decodedInstruction{}
+
+	for i := 0; i < len(ins); {
+		position := i
+		if code.Opcode(ins[i]) == code.OpWide {
+			i++
+		}
+
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			panic(err)
+		}
+		if i != position {
+			def = code.WideDefinition(def)
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		decoded = append(decoded, &decodedInstruction{op: code.Opcode(ins[i]), operands: operands, position: position})
+
+		i += 1 + read
+	}
+
+	return decoded
+}
+
+// encodeInstructions lays out the surviving instructions and rewrites jump
+// operands. A jump to a removed instruction lands on the next one that survived.
+// Jumps are all made wide when the input is too long for two byte targets,
+// otherwise the output is no longer than the input so every target fits.
+func encodeInstructions(decoded []*decodedInstruction, length int) code.Instructions {
+	out := code.Instructions{}
+	newPositions := make(map[int]int, len(decoded)+1)
+	wideJumps := length > math.MaxUint16
+
+	for _, ins := range decoded {
+		newPositions[ins.position] = len(out)
+		if !ins.removed {
+			out = append(out, encodeInstruction(ins.op, ins.operands, wideJumps && isJump(ins.op))...)
+		}
+	}
+	newPositions[length] = len(out)
+
+	for _, ins := range decoded {
+		if ins.removed || !isJump(ins.op) {
+			continue
+		}
+
+		target := newPositions[ins.operands[0]]
+		pos := newPositions[ins.position]
+		copy(out[pos:], encodeInstruction(ins.op, []int{target}, wideJumps))
+	}
+
+	return out
+}
+
+func encodeInstruction(op code.Opcode, operands []int, wide bool) []byte {
+	if wide || !code.Fits(op, operands...) {
+		return code.MakeWide(op, operands...)
+	}
+
+	return code.Make(op, operands...)
+}
+
+// widenJumps re-encodes instructions whose jump targets did not fit a two
+// byte operand, farJumps maps the position of such a jump to its target.
+func widenJumps(ins code.Instructions, farJumps map[int]int) code.Instructions {
+	decoded := decodeInstructions(ins)
+	for _, d := range decoded {
+		if target, ok := farJumps[d.position]; ok {
+			d.operands[0] = target
+		}
+	}
+
+	return encodeInstructions(decoded, len(ins))
+}
+
+func isJump(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpTruthy, code.OpJumpNotEqual, code.OpJumpNotGreaterThan:
+		return true
+	}
+	return false
+}
+
+func jumpTargets(decoded []*decodedInstruction) map[int]bool {
+	targets := map[int]bool{}
+	for _, ins := range decoded {
+		if !ins.removed && isJump(ins.op) {
+			targets[ins.operands[0]] = true
+		}
+	}
+	return targets
+}
+
+func instructionAt(decoded []*decodedInstruction, position int) *decodedInstruction {
+	for _, ins := range decoded {
+		if ins.position == position {
+			return ins
+		}
+	}
+	return nil
+}
+
+// threadJumps points any jump that lands on an unconditional jump straight at
+// the final destination.
+func threadJumps(decoded []*decodedInstruction) bool {
+	changed := false
+
+	for _, ins := range decoded {
+		if !isJump(ins.op) {
+			continue
+		}
+
+		for hops := 0; hops < len(decoded); hops++ {
+			target := instructionAt(decoded, ins.operands[0])
+			if target == nil || target == ins || target.op != code.OpJump {
+				break
+			}
+			if target.operands[0] == ins.operands[0] {
+				break
+			}
+
+			ins.operands[0] = target.operands[0]
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeUnreachable drops anything after a return or unconditional jump until
+// the next instruction something jumps to.
+func removeUnreachable(decoded []*decodedInstruction) bool {
+	targets := jumpTargets(decoded)
+	changed := false
+	unreachable := false
+
+	for _, ins := range decoded {
+		if targets[ins.position] {
+			unreachable = false
+		}
+
+		if unreachable {
+			ins.removed = true
+			changed = true
+			continue
+		}
+
+		switch ins.op {
+		case code.OpReturnValue, code.OpReturn, code.OpJump:
+			unreachable = true
+		}
+	}
+
+	return changed
+}
+
+func removeNullPops(decoded []*decodedInstruction) bool {
+	targets := jumpTargets(decoded)
+	changed := false
+
+	for i := 0; i+1 < len(decoded); i++ {
+		null, pop := decoded[i], decoded[i+1]
+		if null.removed || pop.removed || null.op != code.OpNull || pop.op != code.OpPop || targets[pop.position] {
+			continue
+		}
+
+		null.removed = true
+		pop.removed = true
+		changed = true
+	}
+
+	return changed
+}
+
+// invertBangJumps turns OpBang followed by a conditional jump into the
+// opposite conditional jump.
+func invertBangJumps(decoded []*decodedInstruction) bool {
+	targets := jumpTargets(decoded)
+	changed := false
+
+	for i := 0; i+1 < len(decoded); i++ {
+		bang, jump := decoded[i], decoded[i+1]
+		if bang.removed || jump.removed || bang.op != code.OpBang || targets[jump.position] {
+			continue
+		}
+
+		switch jump.op {
+		case code.OpJumpNotTruthy:
+			bang.op = code.OpJumpTruthy
+		case code.OpJumpTruthy:
+			bang.op = code.OpJumpNotTruthy
+		default:
+			continue
+		}
+
+		bang.operands = jump.operands
+		jump.removed = true
+		changed = true
+	}
+
+	return changed
+}
+
+func removeJumpsToNext(decoded []*decodedInstruction) bool {
+	changed := false
+
+	for i, ins := range decoded {
+		if ins.removed || ins.op != code.OpJump {
+			continue
+		}
+
+		next := -1
+		for _, following := range decoded[i+1:] {
+			if !following.removed {
+				next = following.position
+				break
+			}
+		}
+
+		if next == ins.operands[0] {
+			ins.removed = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// fuseSuperinstructions replaces hot instruction sequences with a single
+// fused opcode so the vm spends less time in dispatch. Only the first
+// instruction of a sequence may be a jump target.
+func fuseSuperinstructions(decoded []*decodedInstruction) bool {
+	targets := jumpTargets(decoded)
+	changed := false
+
+	live := []*decodedInstruction{}
+	for _, ins := range decoded {
+		if !ins.removed {
+			live = append(live, ins)
+		}
+	}
+
+	fusable := func(seq []*decodedInstruction) bool {
+		for _, ins := range seq[1:] {
+			if targets[ins.position] || ins.removed {
+				return false
+			}
+		}
+		return !seq[0].removed
+	}
+
+	for i := 0; i < len(live); i++ {
+		first := live[i]
+
+		if i+2 < len(live) && first.op == code.OpGetLocal && live[i+1].op == code.OpConstant && fusable(live[i:i+3]) {
+			var fused code.Opcode
+			switch live[i+2].op {
+			case code.OpAdd:
+				fused = code.OpGetLocalAddConst
+			case code.OpSub:
+				fused = code.OpGetLocalSubConst
+			}
+
+			operands := []int{first.operands[0], live[i+1].operands[0]}
+			if fused != 0 && code.Fits(fused, operands...) {
+				first.op = fused
+				first.operands = operands
+				live[i+1].removed = true
+				live[i+2].removed = true
+				changed = true
+				continue
+			}
+		}
+
+		if i+1 < len(live) && fusable(live[i:i+2]) {
+			second := live[i+1]
+
+			switch {
+			case first.op == code.OpGetLocal && second.op == code.OpGetLocal && code.Fits(code.OpGetLocalGetLocal, first.operands[0], second.operands[0]):
+				first.op = code.OpGetLocalGetLocal
+				first.operands = []int{first.operands[0], second.operands[0]}
+			case first.op == code.OpEqual && second.op == code.OpJumpNotTruthy:
+				first.op = code.OpJumpNotEqual
+				first.operands = second.operands
+			case first.op == code.OpGreaterThan && second.op == code.OpJumpNotTruthy:
+				first.op = code.OpJumpNotGreaterThan
+				first.operands = second.operands
+			default:
+				continue
+			}
+
+			second.removed = true
+			changed = true
+		}
+	}
+
+	return changed
+}
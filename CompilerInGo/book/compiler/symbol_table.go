@@ -22,6 +22,10 @@ type SymbolTable struct {
 	store          map[string]Symbol
 	numDefinitions int
 
+	// globals counts the globals of a program and of the modules it imports,
+	// which have tables of their own but share one global store
+	globals *int
+
 	FreeSymbols []Symbol
 }
 
@@ -33,6 +37,10 @@ func NewSymbolTable() *SymbolTable {
 
 func (st *SymbolTable) Define(name string) Symbol {
 	symbol := Symbol{Name: name, Index: st.numDefinitions}
+	if st.globals != nil {
+		symbol.Index = *st.globals
+		*st.globals++
+	}
 	if st.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
@@ -91,3 +99,26 @@ func NewEnclosedSymbolTable(symTable *SymbolTable) *SymbolTable {
 	s.Outer = symTable
 	return s
 }
+
+// NewModuleSymbolTable makes the global table of a module imported by the
+// program symbolTable belongs to. The module sees the builtins but none of the
+// program's globals, its own globals get indexes after the program's.
+func NewModuleSymbolTable(symbolTable *SymbolTable) *SymbolTable {
+	root := symbolTable
+	for root.Outer != nil {
+		root = root.Outer
+	}
+	if root.globals == nil {
+		numGlobals := root.numDefinitions
+		root.globals = &numGlobals
+	}
+
+	s := NewSymbolTable()
+	s.globals = root.globals
+	for name, symbol := range root.store {
+		if symbol.Scope == BuiltInScope {
+			s.store[name] = symbol
+		}
+	}
+	return s
+}
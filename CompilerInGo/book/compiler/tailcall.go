@@ -0,0 +1,32 @@
+package compiler
+
+import "monkey/ast"
+
+// markTailCalls records the calls whose value a function body returns
+// directly, so they can reuse the caller's frame. Calls under return
+// statements are marked as the return statement is compiled. Like the other
+// optimizations, tail calls are only made above O0.
+func (c *Compiler) markTailCalls(body *ast.BlockStatement) {
+	if body == nil || len(body.Statements) == 0 {
+		return
+	}
+
+	last, ok := body.Statements[len(body.Statements)-1].(*ast.ExpressionStatement)
+	if ok {
+		c.markTailExpression(last.Expression)
+	}
+}
+
+func (c *Compiler) markTailExpression(expression ast.Expression) {
+	if c.optimizationLevel < O1 {
+		return
+	}
+
+	switch expression := expression.(type) {
+	case *ast.CallExpression:
+		c.tailCalls[expression] = true
+	case *ast.IfExpression:
+		c.markTailCalls(expression.Consequence)
+		c.markTailCalls(expression.Alternative)
+	}
+}
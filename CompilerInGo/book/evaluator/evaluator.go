@@ -1,9 +1,13 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"monkey/ast"
+	"monkey/module"
 	"monkey/object"
+	"sort"
 )
 
 var (
@@ -12,16 +16,45 @@ var (
 	FALSE = &object.Boolean{Value: false}
 )
 
-var builtins = map[string]*object.Builtin{
-	"len":   object.GetBuiltInByName("len"),
-	"puts":  object.GetBuiltInByName("puts"),
-	"first": object.GetBuiltInByName("first"),
-	"last":  object.GetBuiltInByName("last"),
-	"rest":  object.GetBuiltInByName("rest"),
-	"push":  object.GetBuiltInByName("push"),
+// DefaultMaxCallDepth bounds how deeply Monkey functions may recurse in runs
+// that do not set Execution.MaxCallDepth, calls in tail position do not count
+// towards it.
+const DefaultMaxCallDepth = 10000
+
+var builtins = func() map[string]object.Object {
+	byName := make(map[string]object.Object, len(object.BuiltIns))
+	for _, def := range object.BuiltIns {
+		byName[def.Name] = def.Builtin
+	}
+	return byName
+}()
+
+// EvalContext evaluates node like Eval, but stops with object.ErrCancelled
+// once ctx is done, or with object.ErrBudgetExhausted after budget evaluation
+// steps when budget is positive. The result is then the error object the
+// evaluation unwound with.
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, budget int) (object.Object, error) {
+	return EvalExecution(node, env, &object.Execution{Context: ctx, Budget: budget})
+}
+
+// EvalExecution evaluates node like EvalContext, with the context and the
+// limits of the run taken from execution, like its MaxCallDepth.
+func EvalExecution(node ast.Node, env *object.Environment, execution *object.Execution) (object.Object, error) {
+	previous := env.Execution()
+	env.SetExecution(execution)
+	defer env.SetExecution(previous)
+
+	result := Eval(node, env)
+	return result, execution.Err
 }
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if execution := env.Execution(); execution != nil {
+		if err := execution.Step(); err != nil {
+			return newError("%s", err)
+		}
+	}
+
 	switch node := node.(type) {
 
 	// Statements
@@ -87,7 +120,19 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{
+			Parameters:  params,
+			Env:         env,
+			Body:        body,
+			Name:        node.Name,
+			IsGenerator: node.IsGenerator,
+		}
+
+	case *ast.YieldExpression:
+		return evalYieldExpression(node, env)
+
+	case *ast.ImportExpression:
+		return evalImportExpression(node, env)
 
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
@@ -100,7 +145,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		return applyFunction(function, args, env)
 
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
@@ -129,6 +174,24 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 }
 
 func evalProgram(program *ast.Program, env *object.Environment) object.Object {
+	// tasks the program spawns end with it
+	ctx := context.Background()
+	if execution := env.Execution(); execution != nil && execution.Context != nil {
+		ctx = execution.Context
+	}
+	group := object.NewTaskGroup(ctx)
+	defer group.Done()
+
+	previous := env.TaskGroup()
+	env.SetTaskGroup(group)
+	defer env.SetTaskGroup(previous)
+
+	// so are the modules it imports, unless the host keeps them
+	if env.Imports() == nil {
+		env.SetImports(object.NewImports(module.NewResolver()))
+		defer env.SetImports(nil)
+	}
+
 	var result object.Object
 
 	for _, statement := range program.Statements {
@@ -242,6 +305,9 @@ func evalIntegerInfixExpression(
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
@@ -301,7 +367,20 @@ func evalIdentifier(
 		return builtin
 	}
 
-	return newError("identifier not found: " + node.Value)
+	return newError("identifier not found: %s", node.Value)
+}
+
+// nativeObject replaces nulls and booleans made outside the evaluator, by
+// builtins and host objects, with the evaluator's own so they compare equal.
+func nativeObject(obj object.Object) object.Object {
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return NULL
+	case *object.Boolean:
+		return nativeBoolToBooleanObject(obj.Value)
+	default:
+		return obj
+	}
 }
 
 func isTruthy(obj object.Object) bool {
@@ -345,30 +424,207 @@ func evalExpressions(
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
+// applyFunction trampolines: a call the function body ends with comes back
+// as an object.TailCall and is made here, so it neither grows the Go stack
+// nor counts towards the maximum call depth.
+func applyFunction(fn object.Object, args []object.Object, caller *object.Environment) object.Object {
+	if maxDepth := maxCallDepth(caller); caller.CallDepth() >= maxDepth {
+		return newError("maximum call depth of %d exceeded", maxDepth)
+	}
 
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+	for {
+		switch function := fn.(type) {
 
-	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
-			return result
+		case *object.Function:
+			if function.IsGenerator {
+				return newGenerator(function, args, caller)
+			}
+
+			extendedEnv := extendFunctionEnv(function, args, caller)
+			evaluated := evalTailBlock(function.Body, extendedEnv, true)
+
+			tailCall, ok := evaluated.(*object.TailCall)
+			if !ok {
+				return unwrapReturnValue(evaluated)
+			}
+			fn, args = tailCall.Function, tailCall.Arguments
+
+		case *object.Builtin:
+			// calls made by the builtin are nested in it, which matters when
+			// it was tail called and caller is further out
+			env := caller
+			if function.Callback != nil {
+				env = object.NewCallEnvironment(caller, caller)
+			}
+
+			return nativeObject(function.Call(environmentCaller{env}, args...))
+
+		default:
+			return newError("not a function: %s", fn.Type())
+		}
+	}
+}
+
+// CallFunction calls fn with args as a call expression evaluated in env would,
+// a resulting error object is returned as an error.
+func CallFunction(fn object.Object, env *object.Environment, args ...object.Object) (object.Object, error) {
+	result := applyFunction(fn, args, env)
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errors.New(errObj.Message)
+	}
+
+	return result, nil
+}
+
+// environmentCaller lets builtins call functions from the environment they
+// were called in.
+type environmentCaller struct {
+	env *object.Environment
+}
+
+func (c environmentCaller) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	return CallFunction(fn, c.env, args...)
+}
+
+func (c environmentCaller) Streams() *object.Streams {
+	return c.env.Config().Streams
+}
+
+func (c environmentCaller) Sandbox() *object.Sandbox {
+	return c.env.Config().Sandbox
+}
+
+func (c environmentCaller) Clock() object.Clock {
+	return c.env.Config().Clock
+}
+
+func (c environmentCaller) Random() *object.Random {
+	return c.env.Config().Random
+}
+
+func (c environmentCaller) Context() context.Context {
+	if execution := c.env.Execution(); execution != nil && execution.Context != nil {
+		return execution.Context
+	}
+	return context.Background()
+}
+
+func (c environmentCaller) TaskGroup() *object.TaskGroup {
+	if c.env.TaskGroup() == nil {
+		c.env.SetTaskGroup(object.NewTaskGroup(context.Background()))
+	}
+	return c.env.TaskGroup()
+}
+
+// Spawn calls fn on another goroutine, the returned channel receives the
+// result. The task has an execution of its own that ends with the program
+// and draws on the step budget of the run.
+func (c environmentCaller) Spawn(fn object.Object, args ...object.Object) (*object.Channel, error) {
+	switch fn.(type) {
+	case *object.Function, *object.Builtin:
+	default:
+		return nil, fmt.Errorf("cannot spawn %s", fn.Type())
+	}
+
+	group := c.TaskGroup()
+
+	env := object.NewRunEnvironment(c.env)
+	env.SetTaskGroup(group)
+	if parent := c.env.Execution(); parent != nil {
+		env.SetExecution(parent.Task(group.Context()))
+	} else {
+		env.SetExecution(&object.Execution{Context: group.Context()})
+	}
+
+	return group.Go(func() object.Object {
+		return nativeObject(applyFunction(fn, args, env))
+	}), nil
+}
+
+func maxCallDepth(env *object.Environment) int {
+	if execution := env.Execution(); execution != nil && execution.MaxCallDepth > 0 {
+		return execution.MaxCallDepth
+	}
+	return DefaultMaxCallDepth
+}
+
+// evalTailBlock evaluates a function body or one of the if branches in it.
+// Calls made by return statements, and the call a tail block ends with, are
+// handed back as an object.TailCall instead of being made.
+func evalTailBlock(
+	block *ast.BlockStatement,
+	env *object.Environment,
+	tail bool,
+) object.Object {
+	var result object.Object
+
+	for i, statement := range block.Statements {
+		switch statement := statement.(type) {
+		case *ast.ReturnStatement:
+			result = evalTailExpression(statement.ReturnValue, env, true)
+			if result != nil && result.Type() != object.TAIL_CALL_OBJ && result.Type() != object.ERROR_OBJ {
+				result = &object.ReturnValue{Value: result}
+			}
+		case *ast.ExpressionStatement:
+			result = evalTailExpression(statement.Expression, env, tail && i == len(block.Statements)-1)
+		default:
+			result = Eval(statement, env)
+		}
+
+		if result != nil {
+			rt := result.Type()
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.TAIL_CALL_OBJ {
+				return result
+			}
+		}
+	}
+
+	return result
+}
+
+func evalTailExpression(node ast.Expression, env *object.Environment, tail bool) object.Object {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		if !tail {
+			return Eval(node, env)
+		}
+
+		function := Eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+
+		return &object.TailCall{Function: function, Arguments: args}
+
+	case *ast.IfExpression:
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+
+		if isTruthy(condition) {
+			return evalTailBlock(node.Consequence, env, tail)
+		} else if node.Alternative != nil {
+			return evalTailBlock(node.Alternative, env, tail)
 		}
 		return NULL
 
 	default:
-		return newError("not a function: %s", fn.Type())
+		return Eval(node, env)
 	}
 }
 
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
+	caller *object.Environment,
 ) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+	env := object.NewCallEnvironment(fn.Env, caller)
 
 	for paramIdx, param := range fn.Parameters {
 		env.Set(param.Value, args[paramIdx])
@@ -391,6 +647,24 @@ func evalIndexExpression(left, index object.Object) object.Object {
 		return evalArrayIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.HOST_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.(*object.HostObject).Get(index.(*object.String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return nativeObject(value)
+	case left.Type() == object.MODULE_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.(*object.Module).Get(index.(*object.String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return value
+	case left.Type() == object.REGEX_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.(*object.Regex).Get(index.(*object.String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return value
 	default:
 		return newError("index operator not supported: %s", left.Type())
 	}
@@ -412,9 +686,17 @@ func evalHashLiteral(
 	node *ast.HashLiteral,
 	env *object.Environment,
 ) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
+	// in the order the compiler puts the pairs in, so both engines agree
+	keyNodes := make([]ast.Expression, 0, len(node.Pairs))
+	for keyNode := range node.Pairs {
+		keyNodes = append(keyNodes, keyNode)
+	}
+	sort.Slice(keyNodes, func(i, j int) bool {
+		return keyNodes[i].String() < keyNodes[j].String()
+	})
 
-	for keyNode, valueNode := range node.Pairs {
+	hash := object.NewHash(len(node.Pairs))
+	for _, keyNode := range keyNodes {
 		key := Eval(keyNode, env)
 		if isError(key) {
 			return key
@@ -425,16 +707,15 @@ func evalHashLiteral(
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
+		value := Eval(node.Pairs[keyNode], env)
 		if isError(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashKey, value)
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func evalHashIndexExpression(hash, index object.Object) object.Object {
@@ -1,10 +1,20 @@
 package evaluator
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"monkey/lexer"
+	"monkey/module"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -193,6 +203,10 @@ func TestErrorHandling(t *testing.T) {
 			`"Hello" - "World"`,
 			"unknown operator: STRING - STRING",
 		},
+		{
+			"10 / (5 - 5)",
+			"division by zero",
+		},
 		{
 			"if (10 > 1) { true + false; }",
 			"unknown operator: BOOLEAN + BOOLEAN",
@@ -368,7 +382,6 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
-		{`puts("hello", "world!")`, nil},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, nil},
 		{`first(1)`, "argument to `first` must be an ARRAY, got INTEGER"},
@@ -627,3 +640,761 @@ func testNullObject(t *testing.T, obj object.Object) bool {
 	}
 	return true
 }
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(200000, 0)", 20000100000},
+		{"let loop = fn(n) { if (n == 0) { return 0; } return loop(n - 1); }; loop(200000)", 0},
+		{"let loop = fn(n) { if (n > 0) { return loop(n - 1); } 7 }; loop(100000)", 7},
+		{
+			`
+			let isEven = fn(n, isOdd) { if (n == 0) { 1 } else { isOdd(n - 1, isEven) } };
+			let isOdd = fn(n, isEven) { if (n == 0) { 0 } else { isEven(n - 1, isOdd) } };
+			isEven(100001, isOdd)
+			`,
+			0,
+		},
+		{"let f = fn(a) { if (a > 1) { len([1, a]) } else { first([a]) } }; f(2) + f(1)", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		maxDepth int
+		expected interface{}
+	}{
+		{"let depth = fn(n) { if (n == 0) { 0 } else { 1 + depth(n - 1) } }; depth(5000)", 0, 5000},
+		{"let depth = fn(n) { if (n == 0) { 0 } else { 1 + depth(n - 1) } }; depth(50)", 50, "maximum call depth of 50 exceeded"},
+		{"let depth = fn(n) { if (n == 0) { 0 } else { 1 + depth(n - 1) } }; depth(49)", 50, 49},
+		{"let f = fn(n) { 1 + f(n + 1) }; f(0)", 0, "maximum call depth of 10000 exceeded"},
+		{"let f = fn(n) { map([n], fn(x) { 1 + f(x + 1) }) }; f(0)", 50, "maximum call depth of 50 exceeded"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated, _ := EvalExecution(program, object.NewEnvironment(), &object.Execution{MaxCallDepth: tt.maxDepth})
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelTimeout()
+
+	tests := []struct {
+		input       string
+		ctx         context.Context
+		budget      int
+		expected    interface{}
+		expectedErr error
+	}{
+		{"let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100, 0)", context.Background(), 0, 5050, nil},
+		{"let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100, 0)", context.Background(), 100000, 5050, nil},
+		{"let f = fn() { f() }; f()", context.Background(), 10000, "budget exhausted", object.ErrBudgetExhausted},
+		{"let f = fn() { 1 + f() }; f()", context.Background(), 1000, "budget exhausted", object.ErrBudgetExhausted},
+		{"1 + 2", cancelled, 0, "execution cancelled", object.ErrCancelled},
+		{"let f = fn() { f() }; f()", timeout, 0, "execution cancelled", object.ErrCancelled},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		env := object.NewEnvironment()
+
+		evaluated, err := EvalContext(tt.ctx, program, env, tt.budget)
+		if err != tt.expectedErr {
+			t.Errorf("%q: expected error %v, got %v", tt.input, tt.expectedErr, err)
+		}
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok || errObj.Message != expected {
+				t.Errorf("%q: expected error object %q, got=%T(%+v)", tt.input, expected, evaluated, evaluated)
+			}
+		}
+
+		if env.Execution() != nil {
+			t.Errorf("%q: execution left on the environment", tt.input)
+		}
+	}
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"map([1, 2, 3], fn(x) { x * 2 })", []int{2, 4, 6}},
+		{"filter([1, 2, 3, 4], fn(x) { x > 2 })", []int{3, 4}},
+		{"reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })", 10},
+		{"sort_by([3, 1, 2], fn(x) { x })", []int{1, 2, 3}},
+		{"sort_by([1, 2, 3, 4], fn(x) { 0 - x })", []int{4, 3, 2, 1}},
+		{"each([1, 2], fn(x) { x })", nil},
+		{"map([[1], [2, 3]], len)", []int{1, 2}},
+		{"let offset = 10; map([1, 2], fn(x) { x + offset })", []int{11, 12}},
+		{"map([1, 2], fn(x) { reduce([x, x], 0, fn(a, b) { a + b }) })", []int{2, 4}},
+		{"map(1, fn(x) { x })", "argument to `map` must be an ARRAY or GENERATOR, got INTEGER"},
+		{"map([1, 2], fn(x) { x + true })", "type mismatch: INTEGER + BOOLEAN"},
+		{"let f = fn(n) { map([n], f) }; f(1)", "maximum call depth of 10000 exceeded"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Errorf("obj not Array. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if len(array.Elements) != len(expected) {
+				t.Errorf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+				continue
+			}
+			for i, expectedElem := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedElem))
+			}
+		}
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	env := object.NewEnvironment()
+	Eval(parser.New(lexer.New("let add = fn(x, y) { x + y };")).ParseProgram(), env)
+
+	add, _ := env.Get("add")
+	result, err := CallFunction(add, env, &object.Integer{Value: 2}, &object.Integer{Value: 3})
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	testIntegerObject(t, result, 5)
+
+	_, err = CallFunction(add, env, &object.Integer{Value: 2}, TRUE)
+	if err == nil || err.Error() != "type mismatch: INTEGER + BOOLEAN" {
+		t.Errorf("expected type mismatch error, got %v", err)
+	}
+}
+
+type testHost struct {
+	Name    string
+	Enabled bool
+	Ports   []int
+}
+
+func (h testHost) Describe(prefix string) string { return prefix + h.Name }
+
+func TestHostObjects(t *testing.T) {
+	app, err := object.NewHostObject(&testHost{Name: "app", Ports: []int{80, 443}}, false)
+	if err != nil {
+		t.Fatalf("host object error: %s", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`len(app.Ports)`, 2},
+		{`app["Ports"][1]`, 443},
+		{`if (app.Enabled) { 1 } else { 2 }`, 2},
+		{`app.Enabled == false`, true},
+		{`app.Describe("name: ")`, "name: app"},
+		{`host.set(app, "Name", "other"); app.Name`, "other"},
+		{`app.Missing`, "host object evaluator.testHost has no field or method Missing"},
+	}
+
+	for _, tt := range tests {
+		env := object.NewEnvironment()
+		env.Set("app", app)
+		evaluated := Eval(parser.New(lexer.New(tt.input)).ParseProgram(), env)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			switch obj := evaluated.(type) {
+			case *object.String:
+				if obj.Value != expected {
+					t.Errorf("wrong string. want=%q, got=%q", expected, obj.Value)
+				}
+			case *object.Error:
+				if obj.Message != expected {
+					t.Errorf("wrong error message. want=%q, got=%q", expected, obj.Message)
+				}
+			default:
+				t.Errorf("unexpected result %T (%+v)", evaluated, evaluated)
+			}
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	tests := []struct {
+		input          string
+		stdin          string
+		expectedOutput string
+		expected       interface{}
+	}{
+		{`puts("hello", "world!")`, "", "hello\nworld!\n", nil},
+		{`let name = gets(); puts("hi " + name); len(name)`, "monkey\n", "hi monkey\n", 6},
+		{`len(read_line() + read_line() + gets())`, "a\r\nb\nc", "", 3},
+		{`gets()`, "", "", nil},
+		{`let f = fn(x) { puts(x) }; map([1, 2], f); 0`, "", "1\n2\n", 0},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		env := object.NewEnvironment()
+		env.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(tt.stdin), &out)})
+		evaluated := Eval(parser.New(lexer.New(tt.input)).ParseProgram(), env)
+
+		if out.String() != tt.expectedOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expectedOutput, out.String())
+		}
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestConcurrentEval(t *testing.T) {
+	program := parser.New(lexer.New(`
+		let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+		puts(fib(10));
+		reduce(map([1, 2, 3], fn(x) { x * 2 }), 0, fn(a, b) { a + b })
+	`)).ParseProgram()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var out bytes.Buffer
+			env := object.NewEnvironment()
+			env.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(""), &out)})
+			result, ok := Eval(program, env).(*object.Integer)
+			if !ok || result.Value != 12 || out.String() != "55\n" {
+				t.Errorf("wrong result %v with output %q", result, out.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSpawnAndChannels(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let ch = channel(); spawn(fn() { send(ch, 42) }); recv(ch)", 42},
+		{"recv(spawn(fn(a, b) { a + b }, 1, 2))", 3},
+		{"let x = 5; let f = fn() { x * 2 }; recv(spawn(f))", 10},
+		{"let ch = channel(1); send(ch, 1); channels.close(ch); recv(ch); recv(ch)", nil},
+		{`
+			let results = channel();
+			let worker = fn(n) { send(results, n * n) };
+			each([1, 2, 3, 4], fn(n) { spawn(worker, n) });
+			reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + recv(results) })
+			`, 30},
+		{"let a = channel(); spawn(fn() { send(a, 3) }); select([channel(), a])", []int{1, 3}},
+		{"let loop = fn() { loop() }; spawn(loop); 1", 1},
+		{"let ch = channel(); spawn(fn() { recv(ch) }); recv(ch)", "deadlock: all tasks are blocked on channels"},
+		{"recv(spawn(fn() { 1 + true }))", "type mismatch: INTEGER + BOOLEAN"},
+		{"spawn(1)", "cannot spawn INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok || len(array.Elements) != len(expected) {
+				t.Errorf("wrong array for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			for i, expectedElem := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedElem))
+			}
+		}
+	}
+}
+
+func TestSpawnedTasksShareTheBudget(t *testing.T) {
+	program := parser.New(lexer.New("let loop = fn() { loop() }; recv(spawn(loop))")).ParseProgram()
+	execution := &object.Execution{Budget: 100000}
+
+	evaluated, err := EvalExecution(program, object.NewEnvironment(), execution)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok || errObj.Message != "budget exhausted" {
+		t.Errorf("expected the task to run out of the budget, got=%T (%+v)", evaluated, evaluated)
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let count = fn() { yield 1; yield 2; }; let gen = count(); generators.next(gen) + generators.next(gen)", 3},
+		{"let count = fn() { yield 1; yield 2; }; let gen = count(); generators.next(gen); generators.next(gen); generators.next(gen); generators.next(gen)", nil},
+		{"let gen = fn() { yield 1; 3 }(); generators.next(gen); generators.next(gen)", 3},
+		{"let gen = fn(a, b) { yield a + b; }(1, 2); generators.next(gen)", 3},
+		{"let gen = fn() { let x = yield 1; x }(); generators.next(gen); generators.next(gen)", nil},
+		{"let gen = fn() { yield }(); generators.next(gen)", nil},
+		{`
+			let range = fn(from, to) { if (from < to) { yield from; generators.delegate(range(from + 1, to)) } };
+			map(range(0, 5), fn(x) { x * x })
+			`, []int{0, 1, 4, 9, 16}},
+		{`
+			let naturals = fn(n) { yield n; generators.delegate(naturals(n + 1)) };
+			let gen = naturals(1);
+			let skip = fn(n) { if (n > 0) { generators.next(gen); skip(n - 1) } };
+			skip(5000);
+			generators.next(gen)
+			`, 5001},
+		{"let nums = fn() { yield 1; yield 2; yield 3 }; filter(nums(), fn(x) { x > 1 })", []int{2, 3}},
+		{"let nums = fn() { yield 1; yield 2; yield 3 }; reduce(nums(), 0, fn(acc, x) { acc + x })", 6},
+		{"let nums = fn() { yield 3; yield 1; yield 2 }; sort_by(nums(), fn(x) { x })", []int{1, 2, 3}},
+		{"let gen = fn() { yield 1 + true }(); generators.next(gen)", "type mismatch: INTEGER + BOOLEAN"},
+		{"let gen = fn() { yield generators.next(gen) }(); generators.next(gen)", "generator is already running"},
+		{"generators.next(1)", "argument to `generators.next` must be a GENERATOR, got INTEGER"},
+		{"let inner = fn() { yield 1 }; let outer = fn() { yield 0; inner() }(); generators.next(outer); generators.next(generators.next(outer))", 1},
+		{"let inner = fn() { yield 1 }; let outer = fn() { yield 0; generators.delegate(inner()) }(); generators.next(outer); generators.next(outer)", 1},
+		{"generators.delegate(1)", "argument to `generators.delegate` must be a GENERATOR, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok || len(array.Elements) != len(expected) {
+				t.Errorf("wrong array for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			for i, expectedElem := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedElem))
+			}
+		}
+	}
+}
+
+func TestSuspendedGeneratorsEndWithTheProgram(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		testEval("let gen = fn() { yield 1; yield 2 }(); generators.next(gen)")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if runtime.NumGoroutine() > before {
+		t.Errorf("generators were left running. goroutines before=%d, after=%d", before, runtime.NumGoroutine())
+	}
+}
+
+func TestCoroutines(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let co = coroutine(fn(x) { let y = yield x + 1; y * 2 }); resume(co, 1)", 2},
+		{"let co = coroutine(fn(x) { let y = yield x + 1; y * 2 }); resume(co, 1); resume(co, 10)", 20},
+		{"let co = coroutine(fn() { yield 1 }); resume(co); resume(co)", nil},
+		{"let co = coroutine(fn() { yield 1 }); resume(co); resume(co); resume(co)", "cannot resume dead coroutine"},
+		{"let co = coroutine(fn(a, b) { a + b }); resume(co, 1, 2)", 3},
+		{`
+			let counter = fn(n) { let step = yield n; generators.delegate(counter(n + step)) };
+			let co = coroutine(counter);
+			resume(co, 0); resume(co, 5); resume(co, 5)
+			`, 10},
+		{"let co = coroutine(fn() { yield resume(co) }); resume(co)", "cannot resume running coroutine"},
+		{
+			`
+			let check = fn(x) { if (x > 1) { x + true } else { x } };
+			let co = coroutine(fn() { let x = yield 1; yield check(x) });
+			resume(co);
+			resume(co, 2)
+			`,
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{"coroutine(1)", "argument to `coroutine` must be a function, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+
+	statuses := []struct {
+		input    string
+		expected string
+	}{
+		{"let co = coroutine(fn() { yield 1 }); status(co)", "suspended"},
+		{"let co = coroutine(fn() { yield status(co) }); resume(co)", "running"},
+		{"let co = coroutine(fn() { 1 }); resume(co); status(co)", "dead"},
+	}
+
+	for _, tt := range statuses {
+		str, ok := testEval(tt.input).(*object.String)
+		if !ok || str.Value != tt.expected {
+			t.Errorf("wrong status for %q. got=%v", tt.input, str)
+		}
+	}
+}
+
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(source), 0o644)
+		}
+		if err != nil {
+			t.Fatalf("writing module %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+func TestModules(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"lib/counter.monkey": `puts("loading counter"); let step = 1; export let inc = fn(x) { x + step }; export let name = "counter";`,
+		"lib/twice.monkey":   `let counter = import "./counter"; export let twice = fn(x) { counter.inc(counter.inc(x)) };`,
+		"a.monkey":           `let b = import "b"; export let x = 1;`,
+		"b.monkey":           `let a = import "a"; export let y = 2;`,
+		"broken.monkey":      `return 1;`,
+		"vendor/util.monkey": `export let answer = 42;`,
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		input          string
+		expected       string
+		expectedOutput string
+	}{
+		{
+			`let c = import "lib/counter"; let t = import "lib/twice"; let step = 10; [c.inc(1), t.twice(1), c.name, step]`,
+			"[2, 3, counter, 10]",
+			"loading counter\n",
+		},
+		{`let m = fn() { import "lib/counter" }; m() == m()`, "true", "loading counter\n"},
+		{`(import "util").answer`, "42", ""},
+		{`let u = import "./vendor/util.monkey"; u.answer`, "42", ""},
+		{
+			`import "a"`,
+			fmt.Sprintf("ERROR: import cycle: %s -> %s -> %s", path("a.monkey"), path("b.monkey"), path("a.monkey")),
+			"",
+		},
+		{`import "broken"`, "ERROR: return outside of a function in module " + path("broken.monkey"), ""},
+		{`import "missing"`, `ERROR: module "missing" not found`, ""},
+		{
+			`let c = import "lib/counter"; c.missing`,
+			"ERROR: module " + path("lib/counter.monkey") + " has no export missing",
+			"loading counter\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		env := object.NewEnvironment()
+		env.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(""), &out)})
+		env.SetImports(object.NewImports(module.NewResolver(path("vendor"))))
+		env.SetFile(path("main.monkey"))
+
+		result := Eval(parser.New(lexer.New(tt.input)).ParseProgram(), env)
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, result.Inspect())
+		}
+		if out.String() != tt.expectedOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expectedOutput, out.String())
+		}
+	}
+}
+
+func TestStandardLibrary(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`math.abs(-3)`, "3"},
+		{`math.abs(3)`, "3"},
+		{`math.min(3, -1, 2)`, "-1"},
+		{`math.max(3, -1, 2)`, "3"},
+		{`math.pow(2, 10)`, "1024"},
+		{`math.pow(-3, 3)`, "-27"},
+		{`math.pow(5, 0)`, "1"},
+		{`math.pow(2, -1)`, "ERROR: negative exponent to `math.pow`: -1"},
+		{`math.pow(2, 64)`, "ERROR: integer overflow in `math.pow`"},
+		{`math.min()`, "ERROR: wrong number of arguments. got=0, want at least 1"},
+		{`math.max(1, "2")`, "ERROR: argument 1 to `math.max` must be an INTEGER, got STRING"},
+		{`math.abs("x")`, "ERROR: argument to `math.abs` must be an INTEGER, got STRING"},
+		{`strings.split("a,b,,c", ",")`, "[a, b, , c]"},
+		{`len(strings.split("abc", ""))`, "3"},
+		{`strings.join(["a", "b", "c"], "-")`, "a-b-c"},
+		{`strings.join([], "-")`, ""},
+		{`strings.join(["a", 1], "-")`, "ERROR: element 1 of the array passed to `strings.join` must be a STRING, got INTEGER"},
+		{`strings.trim("  hi  ")`, "hi"},
+		{`strings.replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`strings.contains("monkey", "key")`, "true"},
+		{`strings.contains("monkey", "ape")`, "false"},
+		{`strings.upper("Monkey")`, "MONKEY"},
+		{`strings.lower("Monkey")`, "monkey"},
+		{`strings.index_of("monkey", "key")`, "3"},
+		{`strings.index_of("monkey", "ape")`, "-1"},
+		{`strings.split("a")`, "ERROR: wrong number of arguments. got=1, want=2"},
+		{`strings.upper(1)`, "ERROR: argument to `strings.upper` must be a STRING, got INTEGER"},
+		{`arrays.slice([1, 2, 3, 4], 1, 3)`, "[2, 3]"},
+		{`arrays.slice([1, 2, 3, 4], 2)`, "[3, 4]"},
+		{`arrays.slice([1, 2, 3, 4], -2)`, "[3, 4]"},
+		{`arrays.slice([1, 2, 3, 4], 3, 1)`, "[]"},
+		{`arrays.slice([1, 2], 0, 10)`, "[1, 2]"},
+		{`arrays.slice([1, 2], "0")`, "ERROR: argument 1 to `arrays.slice` must be an INTEGER, got STRING"},
+		{`arrays.concat([1], [], [2, 3])`, "[1, 2, 3]"},
+		{`arrays.concat([1], 2)`, "ERROR: argument 1 to `arrays.concat` must be an ARRAY, got INTEGER"},
+		{`let a = [1, 2, 3]; [arrays.reverse(a), a]`, "[[3, 2, 1], [1, 2, 3]]"},
+		{`arrays.contains([1, "two", [3]], "two")`, "true"},
+		{`arrays.contains([1, "two", [3]], [3])`, "true"},
+		{`arrays.contains([1, 2], 3)`, "false"},
+		{`arrays.contains(1, 1)`, "ERROR: argument to `arrays.contains` must be an ARRAY, got INTEGER"},
+		{`hashes.keys({"b": 1, "a": 2, 3: 3, true: 4})`, "[3, a, b, true]"},
+		{`hashes.values({"b": 1, "a": 2})`, "[2, 1]"},
+		{`hashes.has({"a": 1}, "a")`, "true"},
+		{`hashes.has({"a": 1}, "b")`, "false"},
+		{`hashes.has({"a": 1}, [1])`, "ERROR: unusable as hash key: ARRAY"},
+		{`let h = {"a": 1, "b": 2}; [hashes.keys(hashes.delete(h, "a")), hashes.keys(h)]`, "[[b], [a, b]]"},
+		{`let h = hashes.merge({"a": 1, "b": 2}, {"b": 3}, {}); [hashes.keys(h), hashes.values(h)]`, "[[a, b], [1, 3]]"},
+		{`hashes.merge({}, [])`, "ERROR: argument 1 to `hashes.merge` must be a HASH, got ARRAY"},
+		{`hashes.keys([])`, "ERROR: argument to `hashes.keys` must be a HASH, got ARRAY"},
+		{`let strings = 1; strings`, "1"},
+		{`math.missing`, "ERROR: module math has no export missing"},
+	}
+
+	for _, tt := range tests {
+		if got := testEval(tt.input).Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let v = json_parse(json_stringify({"b": [1, 2], "a": if (false) { 1 }})); [v["b"][1], v["a"], hashes.keys(v)]`, "[2, null, [a, b]]"},
+		{`json_stringify(json_parse("[1.5, -2, {}, [true]]"))`, `[1.5,-2,{},[true]]`},
+		{`json_stringify({"id": 1, "tags": ["x"]}, 1)`, "{\n \"id\": 1,\n \"tags\": [\n  \"x\"\n ]\n}"},
+		{`json_parse("[1,")`, "ERROR: invalid JSON at line 1, column 4: unexpected end of input"},
+		{`json_stringify({"f": fn() { 1 }})`, "ERROR: cannot serialize FUNCTION at $.f as JSON"},
+	}
+
+	for _, tt := range tests {
+		if got := testEval(tt.input).Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	sandbox, err := object.NewSandbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`write_file("a.txt", "one"); append_file("a.txt", " two"); read_file("a.txt")`, "one two"},
+		{`let f = fn() { [exists("a.txt"), exists("b.txt"), list_dir()] }; f()`, "[true, false, [a.txt]]"},
+		{`files.remove("a.txt"); list_dir(".")`, "[]"},
+		{`read_file("../a.txt")`, "ERROR: path ../a.txt is outside of the sandbox"},
+		{`files.remove("a.txt")`, "ERROR: unable to remove a.txt: no such file or directory"},
+	}
+
+	for _, tt := range tests {
+		env := object.NewEnvironment()
+		env.SetConfig(object.Config{Sandbox: sandbox})
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+
+		if got := Eval(program, env).Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	expected := "ERROR: `list_dir` is not allowed, file access is disabled"
+	if got := testEval(`list_dir()`).Inspect(); got != expected {
+		t.Errorf("wrong result without a sandbox. want=%q, got=%q", expected, got)
+	}
+}
+
+func TestRegex(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`regex("a+").match("baab")`, "true"},
+		{`let re = regex("[0-9]+"); [re.match("abc"), re.find("a12b345"), re.find("abc")]`, "[false, 12, null]"},
+		{`regex("[0-9]+").find_all("a1b22c333")`, "[1, 22, 333]"},
+		{`regex("[0-9]+").find_all("a1b22c333", 2)`, "[1, 22]"},
+		{`regex("(?P<key>[a-z]+)=([0-9]+)").replace("a=1, b=2", "${2}:${key}")`, "1:a, 2:b"},
+		{`regex(" *, *").split("a , b,c")`, "[a, b, c]"},
+		{`regex("(?P<user>[a-z]+)@([a-z]+)(!)?").captures("mail: bob@example")`, "{0: bob@example, 1: bob, 2: example, 3: null, user: bob}"},
+		{`let all = regex("([a-z])([0-9])").captures_all("a1 b2"); [all[0][1], all[1][2]]`, "[a, 2]"},
+		{`regex("x").captures("abc")`, "null"},
+		{`[regex("a+"), regex("a+").pattern]`, "[/a+/, a+]"},
+		{`regex("(a")`, "ERROR: invalid pattern for `regex`: missing closing ): `(a`"},
+		{`regex("a").split(1)`, "ERROR: argument to `regex.split` must be a STRING, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		if got := testEval(tt.input).Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestTimeAndRandom(t *testing.T) {
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`now()`, "1709208000000"},
+		{`let t = now(); sleep(1500); now() - t`, "1500"},
+		{`format_time(now())`, "2024-02-29T12:00:00Z"},
+		{`format_time(0, "2006-01-02 15:04")`, "1970-01-01 00:00"},
+		{`parse_time("2024-02-29T12:00:00Z") == now()`, "true"},
+		{`parse_time("2024-02-29", "2006-01-02")`, "1709164800000"},
+		{`parse_time("soon")`, "ERROR: unable to parse time soon: parsing time \"soon\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"soon\" as \"2006\""},
+		{`sleep(-1)`, "ERROR: argument to `sleep` must not be negative, got -1"},
+		{`let r = random_int(1, 6); [r > 0, r < 7]`, "[true, true]"},
+		{`random_int(2, 1)`, "ERROR: empty range for `random_int`: 2 > 1"},
+		{`let s = shuffle([1, 2, 3, 4]); [len(s), arrays.contains(s, 1), arrays.contains(s, 4)]`, "[4, true, true]"},
+		{`shuffle(1)`, "ERROR: argument to `shuffle` must be an ARRAY, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		env := object.NewEnvironment()
+		env.SetConfig(object.Config{Clock: object.NewFixedClock(start)})
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+
+		if got := Eval(program, env).Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	input := `let f = fn() { random_int(1, 1000) }; [f(), f(), shuffle([1, 2, 3, 4, 5, 6])]`
+	results := make([]string, 2)
+	for i := range results {
+		env := object.NewEnvironment()
+		env.SetConfig(object.Config{Random: object.NewRandom(7)})
+		results[i] = Eval(parser.New(lexer.New(input)).ParseProgram(), env).Inspect()
+	}
+	if results[0] != results[1] {
+		t.Errorf("same seed gave different results: %s and %s", results[0], results[1])
+	}
+}
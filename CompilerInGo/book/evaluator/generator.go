@@ -0,0 +1,106 @@
+package evaluator
+
+import (
+	"errors"
+	"monkey/ast"
+	"monkey/object"
+)
+
+// generator evaluates the body of a generator function on a goroutine of its
+// own, which takes turns with whoever resumes it so only one of them runs at a
+// time. Like spawned tasks, a suspended generator ends with the program that
+// called the generator function.
+type generator struct {
+	fn  *object.Function
+	env *object.Environment
+
+	started bool
+	resumed chan object.Object   // the values Resume sends
+	results chan generatorResult // what the body yields, then what it returns
+}
+
+type generatorResult struct {
+	value object.Object
+	done  bool
+}
+
+func newGenerator(fn *object.Function, args []object.Object, caller *object.Environment) object.Object {
+	g := &generator{
+		fn:      fn,
+		env:     extendFunctionEnv(fn, args, caller),
+		resumed: make(chan object.Object),
+		results: make(chan generatorResult, 1),
+	}
+	g.env.SetGenerator(g)
+
+	return object.NewGenerator(fn.Name, g)
+}
+
+func (g *generator) Resume(caller object.Caller, sent object.Object) (object.Object, bool, error) {
+	if !g.started {
+		g.started = true
+		go g.run()
+	} else {
+		select {
+		case g.resumed <- sent:
+		case result := <-g.results:
+			// the body was stopped while suspended
+			return result.unwrap()
+		}
+	}
+
+	result := <-g.results
+	return result.unwrap()
+}
+
+func (g *generator) run() {
+	result := unwrapReturnValue(Eval(g.fn.Body, g.env))
+	g.results <- generatorResult{value: nativeObject(result), done: true}
+}
+
+// yield hands value to the resuming goroutine and waits to be resumed again.
+func (g *generator) yield(value object.Object) (object.Object, error) {
+	g.results <- generatorResult{value: value}
+
+	var stopped <-chan struct{}
+	if group := g.env.TaskGroup(); group != nil {
+		stopped = group.Context().Done()
+	}
+
+	select {
+	case sent := <-g.resumed:
+		return sent, nil
+	case <-stopped:
+		return nil, object.ErrCancelled
+	}
+}
+
+func (r generatorResult) unwrap() (object.Object, bool, error) {
+	if errObj, ok := r.value.(*object.Error); ok {
+		return nil, true, errors.New(errObj.Message)
+	}
+
+	return r.value, r.done, nil
+}
+
+func evalYieldExpression(node *ast.YieldExpression, env *object.Environment) object.Object {
+	value := object.Object(NULL)
+	if node.Value != nil {
+		value = Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+	}
+
+	g, ok := env.Generator().(*generator)
+	if !ok {
+		return newError("yield outside of a generator")
+	}
+
+	sent, err := g.yield(value)
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	return nativeObject(sent)
+}
@@ -0,0 +1,58 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"monkey/ast"
+	"monkey/module"
+	"monkey/object"
+)
+
+// evalImportExpression gives the module node names, evaluating it the first
+// time the run imports it.
+func evalImportExpression(node *ast.ImportExpression, env *object.Environment) object.Object {
+	imports := env.Imports()
+	if imports == nil {
+		imports = object.NewImports(module.NewResolver())
+		env.SetImports(imports)
+	}
+
+	path, err := imports.Loader.Resolve(node.Path, env.File())
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	m, err := imports.Import(path, func(program *ast.Program) (*object.Module, error) {
+		return evalModule(path, program, env)
+	})
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	return m
+}
+
+// evalModule evaluates a module's statements in an environment of its own,
+// as part of the run of the program importing it.
+func evalModule(path string, program *ast.Program, importer *object.Environment) (*object.Module, error) {
+	env := object.NewRunEnvironment(importer)
+	env.SetFile(path)
+
+	exports := map[string]object.Object{}
+	for _, statement := range program.Statements {
+		if _, ok := statement.(*ast.ReturnStatement); ok {
+			return nil, fmt.Errorf("return outside of a function in module %s", path)
+		}
+
+		result := Eval(statement, env)
+		if errObj, ok := result.(*object.Error); ok {
+			return nil, errors.New(errObj.Message)
+		}
+
+		if let, ok := statement.(*ast.LetStatement); ok && let.Exported {
+			exports[let.Name.Value], _ = env.Get(let.Name.Value)
+		}
+	}
+
+	return &object.Module{Name: path, Exports: exports}, nil
+}
@@ -1 +1,3 @@
 module monkey
+
+go 1.25
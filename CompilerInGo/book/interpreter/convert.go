@@ -0,0 +1,16 @@
+package interpreter
+
+import "monkey/object"
+
+// ToObject converts Go values to Monkey objects with object.FromGo, structs
+// become host objects scripts can read and call methods on.
+func ToObject(value interface{}) (object.Object, error) {
+	return object.FromGo(value)
+}
+
+// FromObject converts Monkey objects to Go values with object.ToGo: integers
+// to int64, arrays to []interface{}, hashes to map[interface{}]interface{}
+// and null to nil. Functions and errors are returned as they are.
+func FromObject(obj object.Object) interface{} {
+	return object.ToGo(obj)
+}
@@ -0,0 +1,265 @@
+// Package interpreter embeds Monkey in Go programs. Each Interpreter keeps
+// its own globals and host functions, and state carries over between runs
+// the same way it does between lines of the REPL.
+package interpreter
+
+import (
+	"context"
+	"fmt"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/module"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Interpreter struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+
+	optimizationLevel compiler.OptimizationLevel
+	moduleLoader      object.ModuleLoader
+	config            object.Config
+
+	budget          int // maximum number of instructions of a run, 0 for no limit
+	allocationLimit int // maximum number of bytes a run allocates, 0 for no limit
+	limits          vm.Limits
+}
+
+func New() *Interpreter {
+	symbolTable := compiler.NewSymbolTable()
+	for i, bi := range object.BuiltIns {
+		symbolTable.DefineBuiltIn(i, bi.Name)
+	}
+
+	return &Interpreter{
+		symbolTable:       symbolTable,
+		constants:         []object.Object{},
+		globals:           make([]object.Object, vm.GlobalsSize),
+		optimizationLevel: compiler.O1,
+		moduleLoader:      module.NewResolver(),
+		limits:            vm.DefaultLimits,
+	}
+}
+
+func (i *Interpreter) SetOptimizationLevel(level compiler.OptimizationLevel) {
+	i.optimizationLevel = level
+}
+
+// SetInstructionBudget limits how many instructions each run executes,
+// together with the tasks it spawns. Runs that use it up fail with
+// object.ErrBudgetExhausted. 0, the default, removes the limit.
+func (i *Interpreter) SetInstructionBudget(budget int) {
+	i.budget = budget
+}
+
+// SetAllocationLimit limits how many bytes each run allocates in total,
+// together with the tasks it spawns, whether or not the objects are still
+// reachable. 0, the default, removes the limit.
+func (i *Interpreter) SetAllocationLimit(limit int) {
+	i.allocationLimit = limit
+}
+
+// SetLimits bounds the stacks of the VMs runs use, vm.DefaultLimits by
+// default.
+func (i *Interpreter) SetLimits(limits vm.Limits) {
+	i.limits = limits
+}
+
+// SetStreams sets what scripts write to with puts and read from with gets,
+// the process's standard streams by default.
+func (i *Interpreter) SetStreams(streams *object.Streams) {
+	i.config.Streams = streams
+}
+
+// SetModuleLoader sets how the modules scripts import are found.
+func (i *Interpreter) SetModuleLoader(loader object.ModuleLoader) {
+	i.moduleLoader = loader
+}
+
+// SetSearchPaths sets the directories imports that are not relative to the
+// importing file are also looked up in.
+func (i *Interpreter) SetSearchPaths(paths ...string) {
+	i.moduleLoader = module.NewResolver(paths...)
+}
+
+// SetFileRoot lets scripts use the file builtins on what is under dir, which
+// they cannot leave. Scripts have no file access until it is set, an empty dir
+// takes it away again.
+func (i *Interpreter) SetFileRoot(dir string) error {
+	if dir == "" {
+		i.config.Sandbox = nil
+		return nil
+	}
+
+	sandbox, err := object.NewSandbox(dir)
+	if err != nil {
+		return err
+	}
+	i.config.Sandbox = sandbox
+	return nil
+}
+
+// SetClock sets what now reads and sleep waits on, the system clock by
+// default. Tests give scripts an object.FixedClock to freeze time.
+func (i *Interpreter) SetClock(clock object.Clock) {
+	i.config.Clock = clock
+}
+
+// SetRandomSeed makes random_int and shuffle give the same numbers every time
+// the interpreter runs the same scripts. They differ between processes by
+// default.
+func (i *Interpreter) SetRandomSeed(seed uint64) {
+	i.config.Random = object.NewRandom(seed)
+}
+
+// RegisterFunction makes fn callable from Monkey as name. Host functions are
+// globals, so scripts run afterwards can call them like any other function.
+func (i *Interpreter) RegisterFunction(name string, fn object.BuiltinFunction) {
+	i.setGlobal(name, &object.Builtin{Fn: fn})
+}
+
+// RegisterCallback is RegisterFunction for host functions that call Monkey
+// functions they are given.
+func (i *Interpreter) RegisterCallback(name string, fn object.CallbackFunction) {
+	i.setGlobal(name, &object.Builtin{Callback: fn})
+}
+
+// SetGlobal converts value with ToObject and binds it to name.
+func (i *Interpreter) SetGlobal(name string, value interface{}) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return err
+	}
+
+	i.setGlobal(name, obj)
+	return nil
+}
+
+// Global returns the value bound to name by a script or SetGlobal.
+func (i *Interpreter) Global(name string) (object.Object, bool) {
+	symbol, ok := i.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope || symbol.Index >= len(i.globals) {
+		return nil, false
+	}
+
+	value := i.globals[symbol.Index]
+	return value, value != nil
+}
+
+func (i *Interpreter) setGlobal(name string, obj object.Object) {
+	symbol, ok := i.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = i.symbolTable.Define(name)
+	}
+
+	if symbol.Index >= len(i.globals) {
+		globals := make([]object.Object, symbol.Index*2)
+		copy(globals, i.globals)
+		i.globals = globals
+	}
+
+	i.globals[symbol.Index] = obj
+}
+
+// Compile parses and compiles source against the interpreter's globals.
+// Imports are relative to the working directory.
+func (i *Interpreter) Compile(source string) (*compiler.Bytecode, error) {
+	return i.compile(source, "")
+}
+
+// CompileFile compiles the script at path, whose imports are relative to it.
+func (i *Interpreter) CompileFile(path string) (*compiler.Bytecode, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.compile(string(source), path)
+}
+
+func (i *Interpreter) compile(source, file string) (bytecode *compiler.Bytecode, err error) {
+	defer recoverPanic(&err)
+
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+
+	comp := compiler.NewWithState(i.symbolTable, i.constants)
+	comp.SetOptimizationLevel(i.optimizationLevel)
+	comp.SetModuleLoader(i.moduleLoader)
+	comp.SetFile(file)
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+
+	bytecode = comp.Bytecode()
+	i.constants = bytecode.Constants
+	return bytecode, nil
+}
+
+// Run compiles and runs source, returning the value of its last expression
+// statement.
+func (i *Interpreter) Run(source string) (object.Object, error) {
+	return i.RunContext(context.Background(), source)
+}
+
+func (i *Interpreter) RunContext(ctx context.Context, source string) (object.Object, error) {
+	bytecode, err := i.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.RunBytecode(ctx, bytecode)
+}
+
+// RunFile compiles and runs the script at path.
+func (i *Interpreter) RunFile(ctx context.Context, path string) (object.Object, error) {
+	bytecode, err := i.CompileFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.RunBytecode(ctx, bytecode)
+}
+
+// RunBytecode runs bytecode from Compile on a new VM sharing the globals.
+// A panic in the run, like one in a host function, is returned as an error.
+func (i *Interpreter) RunBytecode(ctx context.Context, bytecode *compiler.Bytecode) (result object.Object, err error) {
+	machine := vm.NewWithGlobalStore(bytecode, i.globals)
+	machine.SetConfig(i.config)
+	machine.SetInstructionBudget(i.budget)
+	machine.SetAllocationLimit(i.allocationLimit)
+	machine.SetLimits(i.limits)
+
+	defer func() { i.globals = machine.Globals() }()
+	defer recoverPanic(&err)
+
+	err = machine.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine.LastPoppedStackElem(), nil
+}
+
+// recoverPanic keeps a panic from taking the host down with the script,
+// making it the error the function returns instead.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
@@ -0,0 +1,375 @@
+package interpreter
+
+import (
+	"bytes"
+	"context"
+	"monkey/object"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterFunction(t *testing.T) {
+	interp := New()
+	interp.RegisterFunction("double", func(args ...object.Object) object.Object {
+		return object.NewInteger(args[0].(*object.Integer).Value * 2)
+	})
+
+	result, err := interp.Run("double(21)")
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if FromObject(result) != int64(42) {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+
+	other := New()
+	if _, err := other.Run("double(21)"); err == nil {
+		t.Errorf("expected host functions to be registered per instance")
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	interp := New()
+	if err := interp.SetGlobal("base", 10); err != nil {
+		t.Fatalf("set global error: %s", err)
+	}
+
+	if _, err := interp.Run("let total = base + 5;"); err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+
+	total, ok := interp.Global("total")
+	if !ok {
+		t.Fatalf("global total not found")
+	}
+	if FromObject(total) != int64(15) {
+		t.Errorf("wrong total. got=%s", total.Inspect())
+	}
+
+	result, err := interp.Run("total * 2")
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if FromObject(result) != int64(30) {
+		t.Errorf("globals did not persist between runs. got=%s", result.Inspect())
+	}
+
+	if _, ok := interp.Global("missing"); ok {
+		t.Errorf("expected missing global to be absent")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	interp := New()
+
+	if _, err := interp.Run("let = 5;"); err == nil {
+		t.Errorf("expected parser error")
+	}
+	if _, err := interp.Run("undefined"); err == nil {
+		t.Errorf("expected compiler error")
+	}
+	if _, err := interp.Run("1 + true"); err == nil {
+		t.Errorf("expected vm error")
+	}
+}
+
+func TestToObject(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-3), "-3"},
+		{uint32(7), "7"},
+		{"monkey", "monkey"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]string{"a", "b"}, "[a, b]"},
+		{map[string]int{"one": 1}, "{one: 1}"},
+		{&object.Integer{Value: 5}, "5"},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Errorf("ToObject(%#v) error: %s", tt.input, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v) wrong. want=%q, got=%q", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	if _, err := ToObject(3.5); err == nil {
+		t.Errorf("expected error converting float")
+	}
+	if _, err := ToObject(map[interface{}]int{nil: 1}); err == nil {
+		t.Errorf("expected error for unhashable key")
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	interp := New()
+	result, err := interp.Run(`{"list": [1, true, "x", if (false) { 1 }]}`)
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+
+	expected := map[interface{}]interface{}{
+		"list": []interface{}{int64(1), true, "x", nil},
+	}
+	if got := FromObject(result); !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong conversion. want=%#v, got=%#v", expected, got)
+	}
+}
+
+func TestRegisterCallback(t *testing.T) {
+	interp := New()
+	interp.RegisterCallback("twice", func(caller object.Caller, args ...object.Object) object.Object {
+		once, err := caller.Call(args[0], args[1])
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		result, err := caller.Call(args[0], once)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		return result
+	})
+
+	result, err := interp.Run("twice(fn(x) { x * 3 }, 2)")
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if FromObject(result) != int64(18) {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+}
+
+type server struct {
+	Host string
+	Port int
+}
+
+func (s *server) Address() string { return s.Host + ":" + strconv.Itoa(s.Port) }
+
+func TestHostObjects(t *testing.T) {
+	srv := &server{Host: "localhost", Port: 80}
+
+	interp := New()
+	if err := interp.SetGlobal("server", srv); err != nil {
+		t.Fatalf("set global error: %s", err)
+	}
+	readOnly, err := object.NewHostObject(srv, true)
+	if err != nil {
+		t.Fatalf("host object error: %s", err)
+	}
+	if err := interp.SetGlobal("frozen", readOnly); err != nil {
+		t.Fatalf("set global error: %s", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`server.Port + 1`, int64(81)},
+		{`server["Host"]`, "localhost"},
+		{`host.set(server, "Port", 8080); server.Address()`, "localhost:8080"},
+		{`frozen.Port`, int64(80)},
+		{`host.set(frozen, "Port", 1)`, "ERROR: host object interpreter.server is read-only"},
+		{`host.set({}, "Port", 1)`, "ERROR: argument to `host.set` must be a HOST_OBJECT, got HASH"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Run(tt.input)
+		if err != nil {
+			t.Fatalf("run error for %q: %s", tt.input, err)
+		}
+		got := FromObject(result)
+		if errObj, ok := result.(*object.Error); ok {
+			got = errObj.Inspect()
+		}
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%v, got=%v", tt.input, tt.expected, got)
+		}
+	}
+
+	if srv.Port != 8080 {
+		t.Errorf("expected the script to set the port. got=%d", srv.Port)
+	}
+
+	if _, err := interp.Run("server.Missing"); err == nil {
+		t.Errorf("expected an error for a missing field")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	var out bytes.Buffer
+	interp := New()
+	interp.SetStreams(object.NewStreams(strings.NewReader("first\nsecond\n"), &out))
+
+	if _, err := interp.Run(`puts(gets())`); err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if _, err := interp.Run(`puts(gets())`); err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+
+	if out.String() != "first\nsecond\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.monkey":           `let m = import "./lib/inc"; let base = 10; m.inc(base)`,
+		"lib/inc.monkey":        `let helpers = import "helpers"; let step = 1; export let inc = fn(x) { helpers.add(x, step) };`,
+		"vendor/helpers.monkey": `export let add = fn(a, b) { a + b };`,
+	}
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	interp := New()
+	interp.SetSearchPaths(filepath.Join(dir, "vendor"))
+
+	result, err := interp.RunFile(context.Background(), filepath.Join(dir, "main.monkey"))
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if FromObject(result) != int64(11) {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+
+	// globals defined later do not take the slots of the module's globals
+	result, err = interp.Run("let later = 5; m.inc(later)")
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if FromObject(result) != int64(6) {
+		t.Errorf("module globals did not persist between runs. got=%s", result.Inspect())
+	}
+
+	if _, err := interp.Run(`import "./lib/inc"`); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected imports of source to be relative to the working directory, got %v", err)
+	}
+}
+
+func TestFileRoot(t *testing.T) {
+	dir := t.TempDir()
+	interp := New()
+
+	result, err := interp.Run(`write_file("out.txt", "data")`)
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if result.Inspect() != "ERROR: `write_file` is not allowed, file access is disabled" {
+		t.Errorf("file access not disabled by default. got=%s", result.Inspect())
+	}
+
+	if err := interp.SetFileRoot(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interp.Run(`write_file("out.txt", "data")`); err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil || string(content) != "data" {
+		t.Errorf("wrong file content. got=%q, %v", content, err)
+	}
+}
+
+func TestClockAndRandomSeed(t *testing.T) {
+	run := func() string {
+		interp := New()
+		interp.SetClock(object.NewFixedClock(time.Unix(1700000000, 0)))
+		interp.SetRandomSeed(99)
+
+		result, err := interp.Run(`[format_time(now()), random_int(0, 100), shuffle([1, 2, 3, 4])]`)
+		if err != nil {
+			t.Fatalf("run error: %s", err)
+		}
+		return result.Inspect()
+	}
+
+	first := run()
+	if !strings.HasPrefix(first, "[2023-11-14T22:13:20Z, ") {
+		t.Errorf("clock not used. got=%s", first)
+	}
+	if second := run(); second != first {
+		t.Errorf("same seed gave different results: %s and %s", first, second)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		setup    func(*Interpreter)
+		expected string
+	}{
+		{
+			"let f = fn() { f() }; f()",
+			func(i *Interpreter) { i.SetInstructionBudget(1000) },
+			"budget exhausted",
+		},
+		{
+			`let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } }; double("ab", 20)`,
+			func(i *Interpreter) { i.SetAllocationLimit(1000) },
+			"allocation limit of 1000 bytes exceeded",
+		},
+		{
+			"let f = fn(n) { f(n + 1) + 1 }; f(0)",
+			func(i *Interpreter) { i.SetLimits(vm.Limits{MaxFrames: 3}) },
+			"stack overflow\n\tat f\n\tat f\n\tat <main>",
+		},
+		{
+			"boom()",
+			func(i *Interpreter) {
+				i.RegisterFunction("boom", func(args ...object.Object) object.Object { panic("boom") })
+			},
+			"panic: boom",
+		},
+	}
+
+	for _, tt := range tests {
+		interp := New()
+		tt.setup(interp)
+
+		_, err := interp.Run(tt.input)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: expected error %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestPanicInSpawnedTask(t *testing.T) {
+	interp := New()
+	interp.RegisterFunction("boom", func(args ...object.Object) object.Object { panic("boom") })
+
+	result, err := interp.Run("recv(spawn(boom))")
+	if err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	if errObj, ok := result.(*object.Error); !ok || errObj.Message != "panic: boom" {
+		t.Errorf("expected the task to fail with the panic, got %s", result.Inspect())
+	}
+
+	result, err = interp.Run("1 + 1")
+	if err != nil || FromObject(result) != int64(2) {
+		t.Errorf("expected the interpreter to keep working, got %v, %v", result, err)
+	}
+}
@@ -30,6 +30,7 @@ if (5 < 10) {
 "foo bar"
 [1, 2];
 {"foo": "bar"}
+config.name
 `
 
 	tests := []struct {
@@ -122,6 +123,9 @@ if (5 < 10) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.IDENT, "config"},
+		{token.DOT, "."},
+		{token.IDENT, "name"},
 		{token.EOF, ""},
 	}
 
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"monkey/compiler"
 	"monkey/repl"
 	"os"
 	"os/user"
 )
 
+var optimizationLevel = flag.Int("O", 1, "optimization level, 0, 1 or 2")
+var engine = flag.String("engine", "vm", "use 'vm' or 'reg', which does not support generators or imports")
+
 func main() {
+	flag.Parse()
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -15,5 +22,8 @@ func main() {
 	fmt.Printf("Hello %s! This is the Monkey programming language!\n",
 		user.Username)
 	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	repl.StartWithOptions(os.Stdin, os.Stdout, repl.Options{
+		OptimizationLevel: compiler.OptimizationLevel(*optimizationLevel),
+		Engine:            *engine,
+	})
 }
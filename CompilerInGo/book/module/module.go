@@ -0,0 +1,77 @@
+// Package module finds the files Monkey programs import.
+package module
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension is added to imported names that have none.
+const Extension = ".monkey"
+
+// Resolver is an object.ModuleLoader for modules on the file system. Names
+// starting with ./ or ../ are relative to the directory of the importing
+// file, other names are looked up there first and then in each search path.
+// Programs that do not come from a file import relative to the working
+// directory.
+type Resolver struct {
+	SearchPaths []string
+}
+
+func NewResolver(searchPaths ...string) *Resolver {
+	return &Resolver{SearchPaths: searchPaths}
+}
+
+func (r *Resolver) Resolve(name, importer string) (string, error) {
+	file := name
+	if filepath.Ext(file) == "" {
+		file += Extension
+	}
+
+	dir := "."
+	if importer != "" {
+		dir = filepath.Dir(importer)
+	}
+
+	var candidates []string
+	switch {
+	case filepath.IsAbs(file):
+		candidates = []string{file}
+	case strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../"):
+		candidates = []string{filepath.Join(dir, file)}
+	default:
+		candidates = []string{filepath.Join(dir, file)}
+		for _, searchPath := range r.SearchPaths {
+			candidates = append(candidates, filepath.Join(searchPath, file))
+		}
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.IsDir() {
+			return filepath.Abs(candidate)
+		}
+	}
+
+	return "", fmt.Errorf("module %q not found", name)
+}
+
+func (r *Resolver) Load(path string) (*ast.Program, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.New(string(source)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors in %s:\n\t%s", path, strings.Join(p.Errors(), "\n\t"))
+	}
+
+	return program, nil
+}
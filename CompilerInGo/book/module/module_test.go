@@ -0,0 +1,77 @@
+package module
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"app/main.monkey", "app/util.monkey", "lib/util.monkey", "lib/list.monkey", "shared.monkey", "app/data.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("let x = 1;"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "app", "dir.monkey"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := NewResolver(filepath.Join(dir, "lib"))
+	importer := filepath.Join(dir, "app", "main.monkey")
+
+	tests := []struct {
+		name     string
+		expected string // relative to dir, empty if the module is not found
+	}{
+		{"util", "app/util.monkey"},
+		{"list", "lib/list.monkey"},
+		{"./util", "app/util.monkey"},
+		{"../shared", "shared.monkey"},
+		{"./list", ""},
+		{"data.txt", "app/data.txt"},
+		{"dir", ""},
+		{filepath.Join(dir, "lib", "util"), "lib/util.monkey"},
+	}
+
+	for _, tt := range tests {
+		path, err := resolver.Resolve(tt.name, importer)
+		if tt.expected == "" {
+			if err == nil || err.Error() != `module "`+tt.name+`" not found` {
+				t.Errorf("expected %s not to be found, got %q, %v", tt.name, path, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("resolving %s: %s", tt.name, err)
+			continue
+		}
+		if path != filepath.Join(dir, tt.expected) {
+			t.Errorf("wrong path for %s. want=%q, got=%q", tt.name, filepath.Join(dir, tt.expected), path)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bad.monkey")
+	if err := os.WriteFile(path, []byte("let = 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewResolver().Load(path)
+	if err == nil || !strings.HasPrefix(err.Error(), "parser errors in "+path+":\n\t") {
+		t.Errorf("expected parser errors, got %v", err)
+	}
+
+	_, err = NewResolver().Load(filepath.Join(dir, "missing.monkey"))
+	if err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -1,10 +1,18 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"sort"
+)
 
+// BuiltIns are shared by every VM and evaluator, so they must not change once
+// programs run. Hosts register their own functions on an interpreter instead.
+// Each is a *Builtin, or a *Module of them for the namespaces of the standard
+// library.
 var BuiltIns = []struct {
 	Name    string
-	Builtin *Builtin
+	Builtin Object
 }{
 	{
 		"len",
@@ -29,9 +37,10 @@ var BuiltIns = []struct {
 	{
 		"puts",
 		&Builtin{
-			Fn: func(args ...Object) Object {
+			Callback: func(caller Caller, args ...Object) Object {
+				streams := caller.Streams()
 				for _, arg := range args {
-					fmt.Println(arg.Inspect())
+					streams.Println(arg.Inspect())
 				}
 
 				return nil
@@ -132,6 +141,541 @@ var BuiltIns = []struct {
 			},
 		},
 	},
+	{
+		"map",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				err := iterableAndFunction("map", args, 2)
+				if err != nil {
+					return err
+				}
+
+				mapped := []Object{}
+				failed := iterate(caller, args[0], func(elem Object) Object {
+					result := call(caller, args[1], elem)
+					mapped = append(mapped, result)
+					return result
+				})
+				if failed != nil {
+					return failed
+				}
+
+				return &Array{Elements: mapped}
+			},
+		},
+	},
+	{
+		"filter",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				err := iterableAndFunction("filter", args, 2)
+				if err != nil {
+					return err
+				}
+
+				filtered := []Object{}
+				failed := iterate(caller, args[0], func(elem Object) Object {
+					result := call(caller, args[1], elem)
+					if isTruthy(result) {
+						filtered = append(filtered, elem)
+					}
+					return result
+				})
+				if failed != nil {
+					return failed
+				}
+
+				return &Array{Elements: filtered}
+			},
+		},
+	},
+	{
+		"reduce",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				err := iterableAndFunction("reduce", args, 3)
+				if err != nil {
+					return err
+				}
+
+				accumulator := args[1]
+				failed := iterate(caller, args[0], func(elem Object) Object {
+					accumulator = call(caller, args[2], accumulator, elem)
+					return accumulator
+				})
+				if failed != nil {
+					return failed
+				}
+
+				return accumulator
+			},
+		},
+	},
+	{
+		"sort_by",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				err := iterableAndFunction("sort_by", args, 2)
+				if err != nil {
+					return err
+				}
+
+				arr, failed := collect(caller, args[0])
+				if failed != nil {
+					return failed
+				}
+
+				keys := make([]Object, len(arr.Elements))
+				for i, elem := range arr.Elements {
+					key := call(caller, args[1], elem)
+					if isError(key) {
+						return key
+					}
+					if key.Type() != INTEGER_OBJ && key.Type() != STRING_OBJ {
+						return newError("keys for `sort_by` must be INTEGER or STRING, got %s", key.Type())
+					}
+					if i > 0 && key.Type() != keys[0].Type() {
+						return newError("keys for `sort_by` must all have the same type, got %s and %s",
+							keys[0].Type(), key.Type())
+					}
+					keys[i] = key
+				}
+
+				order := make([]int, len(keys))
+				for i := range order {
+					order[i] = i
+				}
+				sort.SliceStable(order, func(i, j int) bool {
+					return lessKey(keys[order[i]], keys[order[j]])
+				})
+
+				sorted := make([]Object, len(order))
+				for i, index := range order {
+					sorted[i] = arr.Elements[index]
+				}
+
+				return &Array{Elements: sorted}
+			},
+		},
+	},
+	{
+		"each",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				err := iterableAndFunction("each", args, 2)
+				if err != nil {
+					return err
+				}
+
+				return iterate(caller, args[0], func(elem Object) Object {
+					return call(caller, args[1], elem)
+				})
+			},
+		},
+	},
+	{"host", hostModule},
+	{"gets", gets},
+	{"read_line", gets},
+	{
+		"spawn",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				if len(args) < 1 {
+					return newError("wrong number of arguments. got=%d, want at least 1",
+						len(args))
+				}
+				spawner, ok := caller.(Spawner)
+				if !ok {
+					return newError("`spawn` is not supported in this engine")
+				}
+
+				result, err := spawner.Spawn(args[0], args[1:]...)
+				if err != nil {
+					return newError("%s", err)
+				}
+				return result
+			},
+		},
+	},
+	{
+		"channel",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				if len(args) > 1 {
+					return newError("wrong number of arguments. got=%d, want=0 or 1",
+						len(args))
+				}
+				spawner, ok := caller.(Spawner)
+				if !ok {
+					return newError("`channel` is not supported in this engine")
+				}
+
+				capacity := int64(0)
+				if len(args) == 1 {
+					integer, ok := args[0].(*Integer)
+					if !ok || integer.Value < 0 {
+						return newError("capacity for `channel` must be a non-negative INTEGER, got %s",
+							args[0].Inspect())
+					}
+					capacity = integer.Value
+				}
+
+				return spawner.TaskGroup().NewChannel(int(capacity))
+			},
+		},
+	},
+	{
+		"send",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2",
+						len(args))
+				}
+				ch, ok := args[0].(*Channel)
+				if !ok {
+					return newError("argument to `send` must be a CHANNEL, got %s",
+						args[0].Type())
+				}
+
+				if err := ch.Send(args[1]); err != nil {
+					return newError("%s", err)
+				}
+				return nil
+			},
+		},
+	},
+	{
+		"recv",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				ch, ok := args[0].(*Channel)
+				if !ok {
+					return newError("argument to `recv` must be a CHANNEL, got %s",
+						args[0].Type())
+				}
+
+				value, _, err := ch.Receive()
+				if err != nil {
+					return newError("%s", err)
+				}
+				return value
+			},
+		},
+	},
+	{"channels", channelsModule},
+	{
+		"select",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				arr, ok := args[0].(*Array)
+				if !ok || len(arr.Elements) == 0 {
+					return newError("argument to `select` must be a non-empty ARRAY of cases, got %s",
+						args[0].Inspect())
+				}
+
+				cases, errObj := selectCases(arr.Elements)
+				if errObj != nil {
+					return errObj
+				}
+
+				index, value, err := cases[0].Channel.group.Select(cases)
+				if err != nil {
+					return newError("%s", err)
+				}
+				if value == nil {
+					value = &Null{}
+				}
+				return &Array{Elements: []Object{NewInteger(int64(index)), value}}
+			},
+		},
+	},
+	{"generators", generatorsModule},
+	{
+		"coroutine",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+
+				switch args[0].(type) {
+				case *Function, *Closure, *Builtin:
+					return NewCoroutine(args[0])
+				default:
+					return newError("argument to `coroutine` must be a function, got %s", args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		"resume",
+		&Builtin{
+			Callback: func(caller Caller, args ...Object) Object {
+				if len(args) < 1 {
+					return newError("wrong number of arguments. got=%d, want at least 1", len(args))
+				}
+
+				co, ok := args[0].(*Coroutine)
+				if !ok {
+					return newError("first argument to `resume` must be a COROUTINE, got %s", args[0].Type())
+				}
+
+				value, err := co.Resume(caller, args[1:]...)
+				if err != nil {
+					return newError("%s", err)
+				}
+
+				return value
+			},
+		},
+	},
+	{
+		"status",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *Coroutine:
+					return &String{Value: string(arg.Status())}
+				case *Generator:
+					return &String{Value: string(arg.Status())}
+				default:
+					return newError("argument to `status` must be a COROUTINE or GENERATOR, got %s", args[0].Type())
+				}
+			},
+		},
+	},
+	{"math", mathModule},
+	{"strings", stringsModule},
+	{"arrays", arraysModule},
+	{"hashes", hashesModule},
+	{"json_parse", jsonParse},
+	{"json_stringify", jsonStringify},
+	{"read_file", readFile},
+	{"write_file", writeFile},
+	{"append_file", appendFile},
+	{"list_dir", listDir},
+	{"exists", exists},
+	{"files", filesModule},
+	{"regex", regex},
+	{"now", now},
+	{"sleep", sleep},
+	{"format_time", formatTime},
+	{"parse_time", parseTime},
+	{"random_int", randomInt},
+	{"shuffle", shuffle},
+}
+
+// channelsModule namespaces close, a name scripts are likely to want for
+// themselves: channels.close(ch).
+var channelsModule = nativeModule("channels", map[string]BuiltinFunction{
+	"close": func(args ...Object) Object {
+		if err := checkArgs("channels.close", args, CHANNEL_OBJ); err != nil {
+			return err
+		}
+
+		if err := args[0].(*Channel).Close(); err != nil {
+			return newError("%s", err)
+		}
+		return nil
+	},
+})
+
+// generatorsModule namespaces next, a name scripts are likely to want for
+// themselves: generators.next(gen). A generator function that ends with
+// generators.delegate(gen) continues as gen, which is how recursive ones
+// yield their way through: fn(n) { yield n; generators.delegate(count(n + 1)) }.
+var generatorsModule = &Module{Name: "generators", Exports: map[string]Object{
+	"next": &Builtin{
+		Callback: func(caller Caller, args ...Object) Object {
+			if err := checkArgs("generators.next", args, GENERATOR_OBJ); err != nil {
+				return err
+			}
+
+			// what the generator returns comes last, null after that
+			value, _, err := args[0].(*Generator).Resume(caller, nil)
+			if err != nil {
+				return newError("%s", err)
+			}
+
+			return value
+		},
+	},
+	"delegate": &Builtin{
+		Fn: func(args ...Object) Object {
+			if err := checkArgs("generators.delegate", args, GENERATOR_OBJ); err != nil {
+				return err
+			}
+
+			gen := args[0].(*Generator)
+			gen.Delegate()
+			return gen
+		},
+	},
+}}
+
+// selectCases converts the cases of a select, a channel to receive from or an
+// array of a channel and a value to send on it.
+func selectCases(elements []Object) ([]SelectCase, *Error) {
+	cases := make([]SelectCase, len(elements))
+
+	for i, elem := range elements {
+		switch elem := elem.(type) {
+		case *Channel:
+			cases[i] = SelectCase{Channel: elem}
+			continue
+		case *Array:
+			if len(elem.Elements) == 2 {
+				if ch, ok := elem.Elements[0].(*Channel); ok {
+					cases[i] = SelectCase{Channel: ch, Send: true, Value: elem.Elements[1]}
+					continue
+				}
+			}
+		}
+
+		return nil, newError("case %d of `select` must be a CHANNEL or [CHANNEL, value], got %s",
+			i, elem.Inspect())
+	}
+
+	return cases, nil
+}
+
+// iterableAndFunction checks the arguments of the higher-order builtins,
+// which take an array or a generator first and a function last.
+func iterableAndFunction(name string, args []Object, want int) *Error {
+	if len(args) != want {
+		return newError("wrong number of arguments. got=%d, want=%d", len(args), want)
+	}
+
+	switch args[0].(type) {
+	case *Array, *Generator:
+	default:
+		return newError("argument to `%s` must be an ARRAY or GENERATOR, got %s", name, args[0].Type())
+	}
+
+	switch args[want-1].(type) {
+	case *Function, *Closure, *Builtin:
+		return nil
+	default:
+		return newError("last argument to `%s` must be a function, got %s", name, args[want-1].Type())
+	}
+}
+
+// iterate calls visit with the elements of an array, or with what a generator
+// yields until it returns. It stops at the first error visit returns or the
+// generator fails with, and returns it.
+func iterate(caller Caller, iterable Object, visit func(elem Object) Object) Object {
+	if arr, ok := iterable.(*Array); ok {
+		for _, elem := range arr.Elements {
+			if result := visit(elem); isError(result) {
+				return result
+			}
+		}
+		return nil
+	}
+
+	gen := iterable.(*Generator)
+	for {
+		value, done, err := gen.Resume(caller, nil)
+		if err != nil {
+			return newError("%s", err)
+		}
+		if done {
+			return nil
+		}
+
+		if value == nil {
+			value = &Null{}
+		}
+		if result := visit(value); isError(result) {
+			return result
+		}
+	}
+}
+
+// collect gives the elements of an array or everything a generator yields.
+func collect(caller Caller, iterable Object) (*Array, Object) {
+	if arr, ok := iterable.(*Array); ok {
+		return arr, nil
+	}
+
+	elements := []Object{}
+	failed := iterate(caller, iterable, func(elem Object) Object {
+		elements = append(elements, elem)
+		return nil
+	})
+	if failed != nil {
+		return nil, failed
+	}
+
+	return &Array{Elements: elements}, nil
+}
+
+func call(caller Caller, fn Object, args ...Object) Object {
+	result, err := caller.Call(fn, args...)
+	if err != nil {
+		return newError("%s", err)
+	}
+	if result == nil {
+		return &Null{}
+	}
+
+	return result
+}
+
+func lessKey(a, b Object) bool {
+	if a, ok := a.(*Integer); ok {
+		return a.Value < b.(*Integer).Value
+	}
+	return a.(*String).Value < b.(*String).Value
+}
+
+func isError(obj Object) bool {
+	return obj != nil && obj.Type() == ERROR_OBJ
+}
+
+func isTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Null:
+		return false
+	case *Boolean:
+		return obj.Value
+	default:
+		return true
+	}
+}
+
+// gets reads a line of input without its line ending, or null at the end of
+// the input.
+var gets = &Builtin{
+	Callback: func(caller Caller, args ...Object) Object {
+		if len(args) != 0 {
+			return newError("wrong number of arguments. got=%d, want=0",
+				len(args))
+		}
+
+		line, err := caller.Streams().ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newError("unable to read input: %s", err)
+		}
+
+		return &String{Value: line}
+	},
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -141,7 +685,8 @@ func newError(format string, a ...interface{}) *Error {
 func GetBuiltInByName(name string) *Builtin {
 	for _, def := range BuiltIns {
 		if def.Name == name {
-			return def.Builtin
+			builtin, _ := def.Builtin.(*Builtin)
+			return builtin
 		}
 	}
 	return nil
@@ -0,0 +1,296 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const CHANNEL_OBJ = "CHANNEL"
+
+var (
+	ErrDeadlock      = errors.New("deadlock: all tasks are blocked on channels")
+	errClosedChannel = errors.New("send on closed channel")
+)
+
+// Spawner is implemented by the callers of engines that can run functions
+// concurrently, it lets the spawn and channel builtins reach the TaskGroup of
+// the running program.
+type Spawner interface {
+	Spawn(fn Object, args ...Object) (*Channel, error)
+	TaskGroup() *TaskGroup
+}
+
+// TaskGroup holds the tasks of one program run, its main task and everything
+// spawned from it, and the channels they share. Channel operations are made
+// under the group's lock, which lets it tell when every task is blocked on a
+// channel and fail them with ErrDeadlock instead of hanging.
+type TaskGroup struct {
+	mu      sync.Mutex
+	running int // tasks not blocked on a channel, the main task included
+	waiting map[*waiter]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewTaskGroup(ctx context.Context) *TaskGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &TaskGroup{running: 1, waiting: map[*waiter]bool{}, ctx: ctx, cancel: cancel}
+}
+
+// Context is done once the group's main task is, spawned tasks stop then.
+func (g *TaskGroup) Context() context.Context {
+	return g.ctx
+}
+
+// Done ends the group when its main task has finished.
+func (g *TaskGroup) Done() {
+	g.cancel()
+}
+
+// Go runs task on a goroutine. The returned channel receives its result and
+// is closed afterwards.
+func (g *TaskGroup) Go(task func() Object) *Channel {
+	result := g.NewChannel(1)
+
+	g.mu.Lock()
+	g.running++
+	g.mu.Unlock()
+
+	go func() {
+		value := task()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		g.try(SelectCase{Channel: result, Send: true, Value: value})
+		result.close()
+		g.running--
+		g.detectDeadlock()
+	}()
+
+	return result
+}
+
+func (g *TaskGroup) NewChannel(capacity int) *Channel {
+	return &Channel{group: g, capacity: capacity}
+}
+
+// detectDeadlock fails every waiting task once none is left to wake them.
+func (g *TaskGroup) detectDeadlock() {
+	if g.running > 0 || len(g.waiting) == 0 {
+		return
+	}
+
+	for w := range g.waiting {
+		g.wake(w, -1, nil, ErrDeadlock)
+	}
+}
+
+// wake completes a blocked select, the task counts as running again.
+func (g *TaskGroup) wake(w *waiter, index int, value Object, err error) {
+	w.index, w.value, w.err = index, value, err
+	delete(g.waiting, w)
+	g.running++
+	close(w.done)
+}
+
+type Channel struct {
+	group    *TaskGroup
+	capacity int
+	buffer   []Object
+	closed   bool
+
+	receivers []waitingCase
+	senders   []waitingCase
+}
+
+func (c *Channel) Type() ObjectType { return CHANNEL_OBJ }
+func (c *Channel) Inspect() string {
+	return fmt.Sprintf("channel(%d)", c.capacity)
+}
+
+// Send blocks until value is received or buffered.
+func (c *Channel) Send(value Object) error {
+	_, _, err := c.group.Select([]SelectCase{{Channel: c, Send: true, Value: value}})
+	return err
+}
+
+// Receive blocks until a value arrives, ok is false once the channel is
+// closed and drained.
+func (c *Channel) Receive() (value Object, ok bool, err error) {
+	_, value, err = c.group.Select([]SelectCase{{Channel: c}})
+	return value, value != nil, err
+}
+
+func (c *Channel) Close() error {
+	c.group.mu.Lock()
+	defer c.group.mu.Unlock()
+
+	if c.closed {
+		return errors.New("close of closed channel")
+	}
+	c.close()
+	return nil
+}
+
+func (c *Channel) close() {
+	c.closed = true
+
+	for _, r := range c.receivers {
+		if !r.waiter.woken() {
+			c.group.wake(r.waiter, r.index, nil, nil)
+		}
+	}
+	for _, s := range c.senders {
+		if !s.waiter.woken() {
+			c.group.wake(s.waiter, s.index, nil, errClosedChannel)
+		}
+	}
+	c.receivers, c.senders = nil, nil
+}
+
+type SelectCase struct {
+	Channel *Channel
+	Send    bool
+	Value   Object // the value to send
+}
+
+type waiter struct {
+	done  chan struct{}
+	index int
+	value Object
+	err   error
+}
+
+func (w *waiter) woken() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type waitingCase struct {
+	waiter *waiter
+	index  int
+	value  Object
+}
+
+// Select blocks until one of cases can proceed, trying them in order, and
+// returns its index. For a receive value is what was received, nil when the
+// channel is closed and drained.
+func (g *TaskGroup) Select(cases []SelectCase) (index int, value Object, err error) {
+	g.mu.Lock()
+
+	for _, c := range cases {
+		if c.Channel.group != g {
+			g.mu.Unlock()
+			return -1, nil, errors.New("channel belongs to another program")
+		}
+	}
+
+	for i, c := range cases {
+		ready, value, err := g.try(c)
+		if ready {
+			g.mu.Unlock()
+			return i, value, err
+		}
+	}
+
+	w := &waiter{done: make(chan struct{})}
+	for i, c := range cases {
+		waiting := waitingCase{waiter: w, index: i, value: c.Value}
+		if c.Send {
+			c.Channel.senders = append(c.Channel.senders, waiting)
+		} else {
+			c.Channel.receivers = append(c.Channel.receivers, waiting)
+		}
+	}
+	g.waiting[w] = true
+	g.running--
+	g.detectDeadlock()
+	g.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-g.ctx.Done():
+		g.mu.Lock()
+		if !w.woken() {
+			g.wake(w, -1, nil, ErrCancelled)
+		}
+		g.mu.Unlock()
+	}
+
+	g.mu.Lock()
+	for _, c := range cases {
+		c.Channel.receivers = removeWaiter(c.Channel.receivers, w)
+		c.Channel.senders = removeWaiter(c.Channel.senders, w)
+	}
+	g.mu.Unlock()
+
+	return w.index, w.value, w.err
+}
+
+// try makes a case that can proceed without blocking, the lock is held.
+func (g *TaskGroup) try(c SelectCase) (ready bool, value Object, err error) {
+	ch := c.Channel
+
+	if c.Send {
+		if ch.closed {
+			return true, nil, errClosedChannel
+		}
+		if r, ok := ch.popWaiting(&ch.receivers); ok {
+			g.wake(r.waiter, r.index, c.Value, nil)
+			return true, nil, nil
+		}
+		if len(ch.buffer) < ch.capacity {
+			ch.buffer = append(ch.buffer, c.Value)
+			return true, nil, nil
+		}
+		return false, nil, nil
+	}
+
+	if len(ch.buffer) > 0 {
+		value = ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+		if s, ok := ch.popWaiting(&ch.senders); ok {
+			ch.buffer = append(ch.buffer, s.value)
+			g.wake(s.waiter, s.index, nil, nil)
+		}
+		return true, value, nil
+	}
+	if s, ok := ch.popWaiting(&ch.senders); ok {
+		g.wake(s.waiter, s.index, nil, nil)
+		return true, s.value, nil
+	}
+	if ch.closed {
+		return true, nil, nil
+	}
+	return false, nil, nil
+}
+
+// popWaiting takes the first case off queue whose select has not completed.
+func (c *Channel) popWaiting(queue *[]waitingCase) (waitingCase, bool) {
+	for len(*queue) > 0 {
+		next := (*queue)[0]
+		*queue = (*queue)[1:]
+		if !next.waiter.woken() {
+			return next, true
+		}
+	}
+	return waitingCase{}, false
+}
+
+func removeWaiter(queue []waitingCase, w *waiter) []waitingCase {
+	kept := queue[:0]
+	for _, waiting := range queue {
+		if waiting.waiter != w {
+			kept = append(kept, waiting)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,122 @@
+package object
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBufferedChannel(t *testing.T) {
+	group := NewTaskGroup(context.Background())
+	defer group.Done()
+
+	ch := group.NewChannel(2)
+	for i := int64(1); i <= 2; i++ {
+		if err := ch.Send(NewInteger(i)); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatalf("close failed: %s", err)
+	}
+
+	for i := int64(1); i <= 2; i++ {
+		value, ok, err := ch.Receive()
+		if err != nil || !ok || value.(*Integer).Value != i {
+			t.Fatalf("wrong receive. got=%v, %t, %v", value, ok, err)
+		}
+	}
+
+	value, ok, err := ch.Receive()
+	if err != nil || ok || value != nil {
+		t.Errorf("receive from drained channel. got=%v, %t, %v", value, ok, err)
+	}
+
+	if err := ch.Send(NewInteger(3)); err == nil || err.Error() != "send on closed channel" {
+		t.Errorf("wrong send error. got=%v", err)
+	}
+	if err := ch.Close(); err == nil || err.Error() != "close of closed channel" {
+		t.Errorf("wrong close error. got=%v", err)
+	}
+}
+
+func TestTaskGroupGo(t *testing.T) {
+	group := NewTaskGroup(context.Background())
+	defer group.Done()
+
+	ch := group.NewChannel(0)
+	result := group.Go(func() Object {
+		value, _, _ := ch.Receive()
+		return NewInteger(value.(*Integer).Value * 2)
+	})
+
+	if err := ch.Send(NewInteger(21)); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+
+	value, ok, err := result.Receive()
+	if err != nil || !ok || value.(*Integer).Value != 42 {
+		t.Errorf("wrong result. got=%v, %t, %v", value, ok, err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	group := NewTaskGroup(context.Background())
+	defer group.Done()
+
+	empty := group.NewChannel(0)
+	full := group.NewChannel(1)
+	full.Send(NewInteger(1))
+
+	index, value, err := group.Select([]SelectCase{{Channel: empty}, {Channel: full}})
+	if err != nil || index != 1 || value.(*Integer).Value != 1 {
+		t.Errorf("wrong select. got=%d, %v, %v", index, value, err)
+	}
+
+	other := NewTaskGroup(context.Background())
+	defer other.Done()
+
+	_, _, err = group.Select([]SelectCase{{Channel: other.NewChannel(0)}})
+	if err == nil || err.Error() != "channel belongs to another program" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	group := NewTaskGroup(context.Background())
+	defer group.Done()
+
+	ch := group.NewChannel(0)
+	result := group.Go(func() Object {
+		if _, _, err := ch.Receive(); err != nil {
+			return &Error{Message: err.Error()}
+		}
+		return nil
+	})
+
+	_, _, err := group.NewChannel(0).Receive()
+	if err != ErrDeadlock {
+		t.Fatalf("expected deadlock, got=%v", err)
+	}
+
+	value, _, _ := result.Receive()
+	if errObj, ok := value.(*Error); !ok || errObj.Message != ErrDeadlock.Error() {
+		t.Errorf("spawned task was not failed. got=%v", value)
+	}
+}
+
+func TestCancelledGroup(t *testing.T) {
+	group := NewTaskGroup(context.Background())
+
+	errs := make(chan error, 1)
+	ch := group.NewChannel(0)
+	group.Go(func() Object {
+		_, _, err := ch.Receive()
+		errs <- err
+		return nil
+	})
+	group.Done()
+
+	if err := <-errs; err != ErrCancelled {
+		t.Errorf("expected the task to be cancelled, got=%v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package object
+
+// Config is what the host of a run decides for it: what builtins like puts
+// and gets write to and read from, the directory the file builtins work in,
+// and the clock and random numbers the time and random builtins use. Engines
+// hand it whole to the calls, modules and tasks of the run.
+type Config struct {
+	Streams *Streams
+	Sandbox *Sandbox // nil disables the file builtins
+	Clock   Clock
+	Random  *Random
+}
+
+// WithDefaults fills in the fields left unset, with DefaultStreams,
+// SystemClock and DefaultRandom.
+func (c Config) WithDefaults() Config {
+	if c.Streams == nil {
+		c.Streams = DefaultStreams
+	}
+	if c.Clock == nil {
+		c.Clock = SystemClock
+	}
+	if c.Random == nil {
+		c.Random = DefaultRandom
+	}
+	return c
+}
@@ -0,0 +1,84 @@
+package object
+
+import (
+	"errors"
+	"sync"
+)
+
+const COROUTINE_OBJ = "COROUTINE"
+
+// Coroutine runs a function that suspends itself with yield until it is
+// resumed again. The first resume calls the function, which for a generator
+// function gives the generator the coroutine resumes from then on. A
+// function that does not yield finishes on its first resume.
+type Coroutine struct {
+	mu        sync.Mutex
+	fn        Object
+	generator *Generator // nil until the function has been called
+	status    GeneratorStatus
+}
+
+func NewCoroutine(fn Object) *Coroutine {
+	return &Coroutine{fn: fn, status: GeneratorSuspended}
+}
+
+func (c *Coroutine) Type() ObjectType { return COROUTINE_OBJ }
+func (c *Coroutine) Inspect() string  { return "coroutine(" + c.fn.Inspect() + ")" }
+
+func (c *Coroutine) Status() GeneratorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// Resume runs the coroutine until it yields or returns and gives the value
+// yielded or returned. The first resume passes args to the function, later
+// ones pass the first of them, or null, as the value of the yield the
+// coroutine is suspended at.
+func (c *Coroutine) Resume(caller Caller, args ...Object) (Object, error) {
+	c.mu.Lock()
+	switch c.status {
+	case GeneratorDead:
+		c.mu.Unlock()
+		return nil, errors.New("cannot resume dead coroutine")
+	case GeneratorRunning:
+		c.mu.Unlock()
+		return nil, errors.New("cannot resume running coroutine")
+	}
+	c.status = GeneratorRunning
+	c.mu.Unlock()
+
+	value, done, err := c.resume(caller, args)
+
+	c.mu.Lock()
+	if done || err != nil {
+		c.status = GeneratorDead
+		c.generator = nil
+	} else {
+		c.status = GeneratorSuspended
+	}
+	c.mu.Unlock()
+
+	return value, err
+}
+
+func (c *Coroutine) resume(caller Caller, args []Object) (Object, bool, error) {
+	var sent Object
+	if c.generator == nil {
+		result, err := caller.Call(c.fn, args...)
+		if err != nil {
+			return nil, true, err
+		}
+
+		generator, ok := result.(*Generator)
+		if !ok {
+			return result, true, nil
+		}
+		c.generator = generator
+	} else if len(args) > 0 {
+		sent = args[0]
+	}
+
+	return c.generator.Resume(caller, sent)
+}
@@ -1,23 +1,132 @@
 package object
 
+import "sync"
+
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.run = outer.run
+	return env
+}
+
+// NewCallEnvironment encloses outer for a function called from the caller
+// environment, continuing the caller's run one call deeper.
+func NewCallEnvironment(outer *Environment, caller *Environment) *Environment {
+	env := NewEnvironment()
+	env.outer = outer
+	env.callDepth = caller.callDepth + 1
+	env.run = caller.run
 	return env
 }
 
+// NewRunEnvironment makes an environment enclosing nothing that is part of
+// the same run as env, like the environment of a module env imports.
+func NewRunEnvironment(env *Environment) *Environment {
+	runEnv := NewEnvironment()
+	runEnv.run = env.run
+	return runEnv
+}
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
 	return &Environment{store: s, outer: nil}
 }
 
+// Environments are locked while read and written, spawned tasks share the
+// environments their functions were defined in with the rest of the program.
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	mu        sync.RWMutex
+	store     map[string]Object
+	outer     *Environment
+	callDepth int
+	run       run
+	generator GeneratorState
+	file      string
+}
+
+// run is what the environments of one run of a program share, it is copied
+// whole into the environments made for the run.
+type run struct {
+	config    Config
+	execution *Execution
+	group     *TaskGroup
+	imports   *Imports
+}
+
+// CallDepth is the number of function calls active in this environment.
+func (e *Environment) CallDepth() int {
+	return e.callDepth
+}
+
+// Config is what the host set for the run this environment belongs to, with
+// the defaults for what it did not set.
+func (e *Environment) Config() Config {
+	return e.run.config.WithDefaults()
+}
+
+func (e *Environment) SetConfig(config Config) {
+	e.run.config = config
+}
+
+// Execution is the run this environment belongs to, nil outside of one
+// started with evaluator.EvalContext.
+func (e *Environment) Execution() *Execution {
+	return e.run.execution
+}
+
+func (e *Environment) SetExecution(execution *Execution) {
+	e.run.execution = execution
+}
+
+// TaskGroup is the group of the program run this environment belongs to, nil
+// outside of one.
+func (e *Environment) TaskGroup() *TaskGroup {
+	return e.run.group
+}
+
+func (e *Environment) SetTaskGroup(group *TaskGroup) {
+	e.run.group = group
+}
+
+// Generator is the state of the generator running the call this environment
+// belongs to, nil unless the call is to a generator function.
+func (e *Environment) Generator() GeneratorState {
+	return e.generator
+}
+
+func (e *Environment) SetGenerator(generator GeneratorState) {
+	e.generator = generator
+}
+
+// Imports are the modules imported by the run this environment belongs to,
+// nil outside of one.
+func (e *Environment) Imports() *Imports {
+	return e.run.imports
+}
+
+func (e *Environment) SetImports(imports *Imports) {
+	e.run.imports = imports
+}
+
+// File is the path of the file the code run in this environment comes from,
+// empty when it does not come from one.
+func (e *Environment) File() string {
+	for env := e; env != nil; env = env.outer {
+		if env.file != "" {
+			return env.file
+		}
+	}
+	return ""
+}
+
+func (e *Environment) SetFile(path string) {
+	e.file = path
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
+	e.mu.RLock()
 	obj, ok := e.store[name]
+	e.mu.RUnlock()
 	if !ok && e.outer != nil {
 		obj, ok = e.outer.Get(name)
 	}
@@ -25,6 +134,9 @@ func (e *Environment) Get(name string) (Object, bool) {
 }
 
 func (e *Environment) Set(name string, val Object) Object {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	e.store[name] = val
 	return val
 }
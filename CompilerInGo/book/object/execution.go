@@ -0,0 +1,96 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrCancelled and ErrBudgetExhausted stop a run of the vm or the evaluator
+// early. Everything evaluated until then is kept so the run can be inspected.
+var (
+	ErrCancelled       = errors.New("execution cancelled")
+	ErrBudgetExhausted = errors.New("budget exhausted")
+)
+
+// CancelCheckInterval is how many steps pass between checks of the context,
+// checking on every step would dominate the cost of cheap instructions.
+const CancelCheckInterval = 1024
+
+// Execution is the state of one evaluator run, shared by the environments of
+// all calls made during the run.
+type Execution struct {
+	Context      context.Context
+	Budget       int // maximum number of steps, 0 for no limit
+	MaxCallDepth int // maximum depth of nested calls, 0 for the evaluator's default
+	Steps        int
+	Err          error
+
+	shared  *atomic.Int64 // the steps of the run and its tasks, once it spawns any
+	flushed int           // the steps already added to shared
+	checkAt int           // when the next checkpoint is due
+}
+
+// Task makes the execution of a task the run spawns, which ctx stops. The
+// task draws on the budget of the run, their steps are counted together.
+func (e *Execution) Task(ctx context.Context) *Execution {
+	if e.shared == nil {
+		e.shared = &atomic.Int64{}
+		e.shared.Store(int64(e.Steps))
+		e.flushed = e.Steps
+	}
+
+	return &Execution{
+		Context:      ctx,
+		Budget:       e.Budget,
+		MaxCallDepth: e.MaxCallDepth,
+		shared:       e.shared,
+	}
+}
+
+// Step counts one evaluation step, or returns the reason the run must stop.
+func (e *Execution) Step() error {
+	if e.Err != nil {
+		return e.Err
+	}
+
+	if e.Steps >= e.checkAt {
+		if err := e.checkpoint(); err != nil {
+			e.Err = err
+			return err
+		}
+	}
+
+	e.Steps++
+	return nil
+}
+
+// checkpoint is reached on the first step and then at least every
+// CancelCheckInterval steps, it is no further away than what is left of the
+// budget so a run without tasks stops right at its end.
+func (e *Execution) checkpoint() error {
+	steps := int64(e.Steps)
+	if e.shared != nil {
+		steps = e.shared.Add(int64(e.Steps - e.flushed))
+		e.flushed = e.Steps
+	}
+
+	next := CancelCheckInterval
+	if e.Budget > 0 {
+		if steps >= int64(e.Budget) {
+			return ErrBudgetExhausted
+		}
+		next = int(min(int64(next), int64(e.Budget)-steps))
+	}
+
+	if e.Context != nil {
+		select {
+		case <-e.Context.Done():
+			return ErrCancelled
+		default:
+		}
+	}
+
+	e.checkAt = e.Steps + next
+	return nil
+}
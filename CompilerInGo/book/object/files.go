@@ -0,0 +1,251 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// FileAccess is implemented by the callers of engines the host can give a
+// Sandbox, it lets the file builtins reach the one of the running program.
+type FileAccess interface {
+	Sandbox() *Sandbox
+}
+
+// Sandbox is the directory the file builtins work in. Paths are relative to
+// it and cannot leave it, with .. or through symbolic links pointing out of
+// it. Scripts have no file access unless the host gives them a sandbox.
+type Sandbox struct {
+	root *os.Root
+}
+
+func NewSandbox(dir string) (*Sandbox, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sandbox{root: root}, nil
+}
+
+// Dir is the directory the sandbox was made for.
+func (s *Sandbox) Dir() string {
+	return s.root.Name()
+}
+
+func (s *Sandbox) Close() error {
+	return s.root.Close()
+}
+
+func (s *Sandbox) ReadFile(name string) (string, error) {
+	if err := checkSandboxPath(name); err != nil {
+		return "", err
+	}
+
+	content, err := s.root.ReadFile(name)
+	if err != nil {
+		return "", sandboxError("read", name, err)
+	}
+	return string(content), nil
+}
+
+func (s *Sandbox) WriteFile(name, content string) error {
+	if err := checkSandboxPath(name); err != nil {
+		return err
+	}
+
+	if err := s.root.WriteFile(name, []byte(content), 0o644); err != nil {
+		return sandboxError("write", name, err)
+	}
+	return nil
+}
+
+func (s *Sandbox) AppendFile(name, content string) error {
+	if err := checkSandboxPath(name); err != nil {
+		return err
+	}
+
+	file, err := s.root.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return sandboxError("append to", name, err)
+	}
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return sandboxError("append to", name, err)
+	}
+	return nil
+}
+
+// ListDir gives the names of the entries of a directory, sorted.
+func (s *Sandbox) ListDir(name string) ([]string, error) {
+	if err := checkSandboxPath(name); err != nil {
+		return nil, err
+	}
+
+	dir, err := s.root.Open(name)
+	if err != nil {
+		return nil, sandboxError("list", name, err)
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, sandboxError("list", name, err)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (s *Sandbox) Exists(name string) (bool, error) {
+	if err := checkSandboxPath(name); err != nil {
+		return false, err
+	}
+
+	_, err := s.root.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, sandboxError("check", name, err)
+	}
+	return true, nil
+}
+
+// Remove removes a file or an empty directory.
+func (s *Sandbox) Remove(name string) error {
+	if err := checkSandboxPath(name); err != nil {
+		return err
+	}
+
+	if err := s.root.Remove(name); err != nil {
+		return sandboxError("remove", name, err)
+	}
+	return nil
+}
+
+// checkSandboxPath rejects the paths that cannot be in the sandbox whatever
+// it contains, the root itself checks where symbolic links lead.
+func checkSandboxPath(name string) error {
+	if name == "" {
+		return errors.New("path must not be empty")
+	}
+	if name != "." && !filepath.IsLocal(name) {
+		return fmt.Errorf("path %s is outside of the sandbox", name)
+	}
+	return nil
+}
+
+func sandboxError(action, name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to %s %s: no such file or directory", action, name)
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return fmt.Errorf("unable to %s %s: %s", action, name, err)
+}
+
+// sandboxBuiltin makes a builtin working on the sandbox of the engine calling
+// it, which fails when there is none.
+func sandboxBuiltin(name string, fn func(sandbox *Sandbox, args ...Object) Object) *Builtin {
+	return &Builtin{
+		Callback: func(caller Caller, args ...Object) Object {
+			access, ok := caller.(FileAccess)
+			if !ok || access.Sandbox() == nil {
+				return newError("`%s` is not allowed, file access is disabled", name)
+			}
+			return fn(access.Sandbox(), args...)
+		},
+	}
+}
+
+var readFile = sandboxBuiltin("read_file", func(sandbox *Sandbox, args ...Object) Object {
+	if err := checkArgs("read_file", args, STRING_OBJ); err != nil {
+		return err
+	}
+
+	content, err := sandbox.ReadFile(args[0].(*String).Value)
+	if err != nil {
+		return newError("%s", err)
+	}
+	return &String{Value: content}
+})
+
+var writeFile = sandboxBuiltin("write_file", func(sandbox *Sandbox, args ...Object) Object {
+	if err := checkArgs("write_file", args, STRING_OBJ, STRING_OBJ); err != nil {
+		return err
+	}
+
+	if err := sandbox.WriteFile(args[0].(*String).Value, args[1].(*String).Value); err != nil {
+		return newError("%s", err)
+	}
+	return nil
+})
+
+var appendFile = sandboxBuiltin("append_file", func(sandbox *Sandbox, args ...Object) Object {
+	if err := checkArgs("append_file", args, STRING_OBJ, STRING_OBJ); err != nil {
+		return err
+	}
+
+	if err := sandbox.AppendFile(args[0].(*String).Value, args[1].(*String).Value); err != nil {
+		return newError("%s", err)
+	}
+	return nil
+})
+
+// listDir lists the root of the sandbox when not given a directory.
+var listDir = sandboxBuiltin("list_dir", func(sandbox *Sandbox, args ...Object) Object {
+	dir := "."
+	if len(args) != 0 {
+		if err := checkArgs("list_dir", args, STRING_OBJ); err != nil {
+			return err
+		}
+		dir = args[0].(*String).Value
+	}
+
+	names, err := sandbox.ListDir(dir)
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	elements := make([]Object, len(names))
+	for i, name := range names {
+		elements[i] = &String{Value: name}
+	}
+	return &Array{Elements: elements}
+})
+
+var exists = sandboxBuiltin("exists", func(sandbox *Sandbox, args ...Object) Object {
+	if err := checkArgs("exists", args, STRING_OBJ); err != nil {
+		return err
+	}
+
+	found, err := sandbox.Exists(args[0].(*String).Value)
+	if err != nil {
+		return newError("%s", err)
+	}
+	return &Boolean{Value: found}
+})
+
+// filesModule namespaces remove, a name scripts are likely to want for
+// themselves: files.remove("out.txt").
+var filesModule = &Module{Name: "files", Exports: map[string]Object{
+	"remove": sandboxBuiltin("files.remove", func(sandbox *Sandbox, args ...Object) Object {
+		if err := checkArgs("files.remove", args, STRING_OBJ); err != nil {
+			return err
+		}
+
+		if err := sandbox.Remove(args[0].(*String).Value); err != nil {
+			return newError("%s", err)
+		}
+		return nil
+	}),
+}}
@@ -0,0 +1,82 @@
+package object
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	sandbox, err := NewSandbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+
+	if err := sandbox.WriteFile("sub/a.txt", "one"); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := sandbox.AppendFile("sub/a.txt", ", two"); err != nil {
+		t.Fatalf("AppendFile: %s", err)
+	}
+	content, err := sandbox.ReadFile("sub/../sub/a.txt")
+	if err != nil || content != "one, two" {
+		t.Errorf("ReadFile gave %q, %v. want=%q", content, err, "one, two")
+	}
+
+	names, err := sandbox.ListDir(".")
+	if err != nil || !reflect.DeepEqual(names, []string{"link", "sub"}) {
+		t.Errorf("ListDir gave %v, %v", names, err)
+	}
+
+	if found, err := sandbox.Exists("sub/a.txt"); !found || err != nil {
+		t.Errorf("Exists gave %t, %v for an existing file", found, err)
+	}
+	if err := sandbox.Remove("sub/a.txt"); err != nil {
+		t.Errorf("Remove: %s", err)
+	}
+	if found, err := sandbox.Exists("sub/a.txt"); found || err != nil {
+		t.Errorf("Exists gave %t, %v for a removed file", found, err)
+	}
+
+	errors := []struct {
+		err      error
+		expected string
+	}{
+		{func() error { _, err := sandbox.ReadFile("missing"); return err }(), "unable to read missing: no such file or directory"},
+		{func() error { _, err := sandbox.ReadFile("../secret"); return err }(), "path ../secret is outside of the sandbox"},
+		{func() error { _, err := sandbox.ReadFile(filepath.Join(outside, "secret")); return err }(), "path " + filepath.Join(outside, "secret") + " is outside of the sandbox"},
+		{func() error { _, err := sandbox.ReadFile("link"); return err }(), "unable to read link: path escapes from parent"},
+		{sandbox.WriteFile("link", "x"), "unable to write link: path escapes from parent"},
+		{sandbox.WriteFile("", "x"), "path must not be empty"},
+		{sandbox.Remove("sub/../../x"), "path sub/../../x is outside of the sandbox"},
+	}
+
+	for i, tt := range errors {
+		if tt.err == nil {
+			t.Errorf("case %d: expected error %q, got none", i, tt.expected)
+			continue
+		}
+		if tt.err.Error() != tt.expected {
+			t.Errorf("case %d: wrong error. want=%q, got=%q", i, tt.expected, tt.err)
+		}
+	}
+
+	if content, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(content) != "s" {
+		t.Errorf("file outside of the sandbox changed: %q, %v", content, err)
+	}
+}
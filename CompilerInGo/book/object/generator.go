@@ -0,0 +1,130 @@
+package object
+
+import (
+	"errors"
+	"sync"
+)
+
+const GENERATOR_OBJ = "GENERATOR"
+
+// GeneratorState is the suspended execution of a generator in the engine that
+// created it.
+type GeneratorState interface {
+	// Resume runs the generator until it yields, returning the yielded value,
+	// or until it returns, returning the return value with done set. sent
+	// becomes the value of the yield the generator is suspended at.
+	Resume(caller Caller, sent Object) (value Object, done bool, err error)
+}
+
+type GeneratorStatus string
+
+const (
+	GeneratorSuspended GeneratorStatus = "suspended"
+	GeneratorRunning   GeneratorStatus = "running"
+	GeneratorDead      GeneratorStatus = "dead"
+)
+
+// Generator is what calling a generator function, one whose body yields,
+// returns. Nothing of the body runs until the generator is first resumed.
+type Generator struct {
+	Name string // empty for anonymous functions
+
+	mu        sync.Mutex
+	state     GeneratorState
+	status    GeneratorStatus
+	delegated bool // continues the generator that returns it, see Delegate
+}
+
+func NewGenerator(name string, state GeneratorState) *Generator {
+	return &Generator{Name: name, state: state, status: GeneratorSuspended}
+}
+
+func (g *Generator) Type() ObjectType { return GENERATOR_OBJ }
+func (g *Generator) Inspect() string {
+	if g.Name == "" {
+		return "generator"
+	}
+	return "generator " + g.Name
+}
+
+func (g *Generator) Status() GeneratorStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.status
+}
+
+// Resume continues the generator, see GeneratorState. A generator that has
+// returned or failed is dead, resuming it again gives nil and done.
+//
+// A generator that returns a delegated generator, as a recursive generator
+// function does, continues as that one, so what it yields comes next. Other
+// generators are returned like any other value.
+func (g *Generator) Resume(caller Caller, sent Object) (value Object, done bool, err error) {
+	g.mu.Lock()
+	switch g.status {
+	case GeneratorDead:
+		g.mu.Unlock()
+		return nil, true, nil
+	case GeneratorRunning:
+		g.mu.Unlock()
+		return nil, false, errors.New("generator is already running")
+	}
+	g.status = GeneratorRunning
+	state := g.state
+	g.mu.Unlock()
+
+	for {
+		value, done, err = state.Resume(caller, sent)
+		if err != nil || !done {
+			break
+		}
+
+		next, ok := value.(*Generator)
+		if !ok || next == g {
+			break
+		}
+		nextState := next.take()
+		if nextState == nil {
+			break
+		}
+		state, sent = nextState, nil
+	}
+
+	g.mu.Lock()
+	if done || err != nil {
+		g.status = GeneratorDead
+		g.state = nil
+	} else {
+		g.status = GeneratorSuspended
+		g.state = state
+	}
+	g.mu.Unlock()
+
+	return value, done, err
+}
+
+// Delegate marks g to be continued by the generator that returns it, instead
+// of being its return value.
+func (g *Generator) Delegate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.delegated = true
+}
+
+// take hands the state of a suspended, delegated generator over to the
+// generator that returned it, the generator itself is dead afterwards.
+func (g *Generator) take() GeneratorState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.status != GeneratorSuspended || !g.delegated {
+		return nil
+	}
+
+	state := g.state
+	g.status = GeneratorDead
+	g.state = nil
+	return state
+}
@@ -0,0 +1,405 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const HOST_OBJ = "HOST_OBJECT"
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// HostObject exposes a Go struct to scripts. Indexing it with the name of an
+// exported field converts the field with FromGo, the name of an exported
+// method gives a builtin that calls it.
+//
+// A read-only host object wraps a copy of the struct and cannot be Set, so
+// only methods with value receivers are exposed and nothing a script does
+// changes the original. Structs reached through it are read-only as well.
+type HostObject struct {
+	value    reflect.Value
+	readOnly bool
+}
+
+// NewHostObject wraps a struct or a pointer to one. Fields can only be Set
+// through a pointer.
+func NewHostObject(value interface{}, readOnly bool) (*HostObject, error) {
+	return newHostObject(reflect.ValueOf(value), readOnly)
+}
+
+func newHostObject(v reflect.Value, readOnly bool) (*HostObject, error) {
+	if v.Kind() == reflect.Pointer && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+		if readOnly {
+			v = v.Elem()
+		}
+	} else if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("host objects must be structs, got %s", v.Type())
+	}
+
+	if readOnly {
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		v = copied
+	}
+
+	return &HostObject{value: v, readOnly: readOnly}, nil
+}
+
+func (h *HostObject) Type() ObjectType { return HOST_OBJ }
+func (h *HostObject) Inspect() string  { return fmt.Sprintf("%+v", h.value.Interface()) }
+
+func (h *HostObject) ReadOnly() bool { return h.readOnly }
+
+// Value returns the wrapped struct, or the copy of it for read-only objects.
+func (h *HostObject) Value() interface{} {
+	return h.value.Interface()
+}
+
+func (h *HostObject) Get(name string) (Object, error) {
+	if method := h.value.MethodByName(name); method.IsValid() {
+		return hostMethod(name, method), nil
+	}
+
+	field, err := h.field(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromGo(field, h.readOnly)
+}
+
+func (h *HostObject) Set(name string, value Object) error {
+	if h.readOnly {
+		return fmt.Errorf("host object %s is read-only", h.structType())
+	}
+	if h.value.Kind() != reflect.Pointer {
+		return fmt.Errorf("fields of host object %s cannot be set", h.structType())
+	}
+
+	field, err := h.field(name)
+	if err != nil {
+		return err
+	}
+
+	converted, err := toGo(value, field.Type())
+	if err != nil {
+		return fmt.Errorf("cannot set %s.%s: %s", h.structType(), name, err)
+	}
+
+	field.Set(converted)
+	return nil
+}
+
+func (h *HostObject) field(name string) (reflect.Value, error) {
+	structValue := reflect.Indirect(h.value)
+
+	field, ok := structValue.Type().FieldByName(name)
+	if !ok || !field.IsExported() {
+		return reflect.Value{}, fmt.Errorf("host object %s has no field or method %s", h.structType(), name)
+	}
+
+	return structValue.FieldByIndex(field.Index), nil
+}
+
+func (h *HostObject) structType() reflect.Type {
+	return reflect.Indirect(h.value).Type()
+}
+
+// hostMethod converts the arguments to the parameter types of method and its
+// results back. A method may return nothing, a value, or a value or nothing
+// followed by an error, which becomes an error object.
+func hostMethod(name string, method reflect.Value) *Builtin {
+	methodType := method.Type()
+
+	return &Builtin{Fn: func(args ...Object) Object {
+		numIn := methodType.NumIn()
+		if methodType.IsVariadic() {
+			if len(args) < numIn-1 {
+				return newError("wrong number of arguments to %s. got=%d, want at least %d", name, len(args), numIn-1)
+			}
+		} else if len(args) != numIn {
+			return newError("wrong number of arguments to %s. got=%d, want=%d", name, len(args), numIn)
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var paramType reflect.Type
+			if methodType.IsVariadic() && i >= numIn-1 {
+				paramType = methodType.In(numIn - 1).Elem()
+			} else {
+				paramType = methodType.In(i)
+			}
+
+			converted, err := toGo(arg, paramType)
+			if err != nil {
+				return newError("argument %d to %s: %s", i+1, name, err)
+			}
+			in[i] = converted
+		}
+
+		out := method.Call(in)
+		if len(out) > 0 && methodType.Out(len(out)-1) == errorType {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return newError("%s", err)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return nil
+		}
+
+		result, err := fromGo(out[0], false)
+		if err != nil {
+			return newError("result of %s: %s", name, err)
+		}
+		return result
+	}}
+}
+
+// hostModule holds the builtins working on host objects, namespaced so
+// names like set stay free for scripts: host.set(config, "Port", 8080).
+var hostModule = nativeModule("host", map[string]BuiltinFunction{
+	"set": func(args ...Object) Object {
+		if len(args) != 3 {
+			return newError("wrong number of arguments. got=%d, want=3", len(args))
+		}
+		host, ok := args[0].(*HostObject)
+		if !ok {
+			return newError("argument to `host.set` must be a HOST_OBJECT, got %s", args[0].Type())
+		}
+		name, ok := args[1].(*String)
+		if !ok {
+			return newError("field name for `host.set` must be a STRING, got %s", args[1].Type())
+		}
+
+		if err := host.Set(name.Value, args[2]); err != nil {
+			return newError("%s", err)
+		}
+
+		return args[2]
+	},
+})
+
+// FromGo converts a Go value to an object. Integers, booleans, strings and
+// nil convert to their objects, slices and arrays to arrays, maps to hashes,
+// structs and pointers to them to host objects and functions with the
+// BuiltinFunction signature to builtins. Objects are returned as they are.
+func FromGo(value interface{}) (Object, error) {
+	return fromGo(reflect.ValueOf(value), false)
+}
+
+func fromGo(v reflect.Value, readOnly bool) (Object, error) {
+	if !v.IsValid() {
+		return &Null{}, nil
+	}
+
+	if v.CanInterface() {
+		switch value := v.Interface().(type) {
+		case Object:
+			if v.Kind() != reflect.Pointer || !v.IsNil() {
+				return value, nil
+			}
+		case BuiltinFunction:
+			return &Builtin{Fn: value}, nil
+		case func(args ...Object) Object:
+			return &Builtin{Fn: value}, nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return &Boolean{Value: v.Bool()}, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInteger(v.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return NewInteger(int64(v.Uint())), nil
+
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return &Null{}, nil
+		}
+
+		elements := make([]Object, v.Len())
+		for i := range elements {
+			elem, err := fromGo(v.Index(i), readOnly)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = elem
+		}
+		return &Array{Elements: elements}, nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return &Null{}, nil
+		}
+
+		pairs := make(map[HashKey]HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := fromGo(iter.Key(), readOnly)
+			if err != nil {
+				return nil, err
+			}
+
+			hashable, ok := key.(Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unable to use %s as a hash key", key.Type())
+			}
+
+			value, err := fromGo(iter.Value(), readOnly)
+			if err != nil {
+				return nil, err
+			}
+
+			pairs[hashable.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+
+	case reflect.Struct:
+		if v.CanAddr() && !readOnly {
+			// a field of a struct that can be set, keep it settable too
+			v = v.Addr()
+		}
+		return newHostObject(v, readOnly)
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &Null{}, nil
+		}
+		if v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct {
+			return newHostObject(v, readOnly)
+		}
+		return fromGo(v.Elem(), readOnly)
+	}
+
+	return nil, fmt.Errorf("unable to convert %s to a monkey object", v.Type())
+}
+
+// ToGo converts an object to a Go value: integers to int64, arrays to
+// []interface{}, hashes to map[interface{}]interface{}, null to nil and host
+// objects to the value they wrap. Other objects are returned as they are.
+func ToGo(obj Object) interface{} {
+	switch obj := obj.(type) {
+	case nil, *Null:
+		return nil
+	case *Integer:
+		return obj.Value
+	case *Boolean:
+		return obj.Value
+	case *String:
+		return obj.Value
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, elem := range obj.Elements {
+			elements[i] = ToGo(elem)
+		}
+		return elements
+	case *Hash:
+		pairs := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			pairs[ToGo(pair.Key)] = ToGo(pair.Value)
+		}
+		return pairs
+	case *HostObject:
+		return obj.Value()
+	default:
+		return obj
+	}
+}
+
+// toGo converts obj to a value of type t.
+func toGo(obj Object, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface {
+		if obj.Type() == NULL_OBJ {
+			return reflect.Zero(t), nil
+		}
+
+		value := reflect.ValueOf(ToGo(obj))
+		if !value.Type().AssignableTo(t) {
+			return reflect.Value{}, fmt.Errorf("cannot use %s as %s", obj.Type(), t)
+		}
+		return value, nil
+	}
+
+	switch obj := obj.(type) {
+	case *Null:
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), nil
+		}
+
+	case *Integer:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			value := reflect.New(t).Elem()
+			if value.OverflowInt(obj.Value) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", obj.Value, t)
+			}
+			value.SetInt(obj.Value)
+			return value, nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value := reflect.New(t).Elem()
+			if obj.Value < 0 || value.OverflowUint(uint64(obj.Value)) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", obj.Value, t)
+			}
+			value.SetUint(uint64(obj.Value))
+			return value, nil
+		}
+
+	case *Boolean:
+		if t.Kind() == reflect.Bool {
+			return reflect.ValueOf(obj.Value).Convert(t), nil
+		}
+
+	case *String:
+		if t.Kind() == reflect.String {
+			return reflect.ValueOf(obj.Value).Convert(t), nil
+		}
+
+	case *Array:
+		if t.Kind() == reflect.Slice {
+			value := reflect.MakeSlice(t, len(obj.Elements), len(obj.Elements))
+			for i, elem := range obj.Elements {
+				converted, err := toGo(elem, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				value.Index(i).Set(converted)
+			}
+			return value, nil
+		}
+
+	case *Hash:
+		if t.Kind() == reflect.Map {
+			value := reflect.MakeMapWithSize(t, len(obj.Pairs))
+			for _, pair := range obj.Pairs {
+				key, err := toGo(pair.Key, t.Key())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				elem, err := toGo(pair.Value, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				value.SetMapIndex(key, elem)
+			}
+			return value, nil
+		}
+
+	case *HostObject:
+		if obj.value.Type().AssignableTo(t) {
+			return obj.value, nil
+		}
+		if obj.value.Kind() == reflect.Pointer && obj.value.Elem().Type().AssignableTo(t) {
+			return obj.value.Elem(), nil
+		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", obj.Type(), t)
+}
@@ -0,0 +1,247 @@
+package object
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testServer struct {
+	Host string
+	Port int
+}
+
+type testConfig struct {
+	Name   string
+	Debug  bool
+	Tags   []string
+	Limits map[string]uint8
+	Server testServer
+	Backup *testServer
+	secret string
+}
+
+func (c testConfig) Greeting(name string) string { return c.Name + " greets " + name }
+func (c testConfig) Sum(values ...int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+func (c testConfig) Check(ok bool) (int, error) {
+	if !ok {
+		return 0, errors.New("check failed")
+	}
+	return 1, nil
+}
+func (c *testConfig) Rename(name string) { c.Name = name }
+
+func newTestConfig() *testConfig {
+	return &testConfig{
+		Name:   "app",
+		Tags:   []string{"a", "b"},
+		Limits: map[string]uint8{"conns": 10},
+		Server: testServer{Host: "localhost", Port: 80},
+		secret: "hidden",
+	}
+}
+
+func TestHostObjectGet(t *testing.T) {
+	host, err := NewHostObject(newTestConfig(), false)
+	if err != nil {
+		t.Fatalf("NewHostObject error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Name", "app"},
+		{"Debug", "false"},
+		{"Tags", "[a, b]"},
+		{"Limits", "{conns: 10}"},
+		{"Backup", "null"},
+	}
+
+	for _, tt := range tests {
+		obj, err := host.Get(tt.name)
+		if err != nil {
+			t.Errorf("Get(%q) error: %s", tt.name, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("Get(%q) wrong. want=%q, got=%q", tt.name, tt.expected, obj.Inspect())
+		}
+	}
+
+	server, err := host.Get("Server")
+	if err != nil {
+		t.Fatalf("Get(Server) error: %s", err)
+	}
+	port, err := server.(*HostObject).Get("Port")
+	if err != nil || port.Inspect() != "80" {
+		t.Errorf("wrong nested field. got=%v, err=%v", port, err)
+	}
+
+	for _, name := range []string{"secret", "Missing"} {
+		if _, err := host.Get(name); err == nil {
+			t.Errorf("expected an error getting %s", name)
+		}
+	}
+}
+
+func TestHostObjectMethods(t *testing.T) {
+	host, _ := NewHostObject(newTestConfig(), false)
+
+	tests := []struct {
+		method   string
+		args     []Object
+		expected string
+	}{
+		{"Greeting", []Object{&String{Value: "bob"}}, "app greets bob"},
+		{"Sum", []Object{}, "0"},
+		{"Sum", []Object{NewInteger(1), NewInteger(2), NewInteger(3)}, "6"},
+		{"Check", []Object{&Boolean{Value: true}}, "1"},
+		{"Check", []Object{&Boolean{Value: false}}, "ERROR: check failed"},
+		{"Greeting", []Object{NewInteger(1)}, "ERROR: argument 1 to Greeting: cannot use INTEGER as string"},
+		{"Greeting", []Object{}, "ERROR: wrong number of arguments to Greeting. got=0, want=1"},
+		{"Rename", []Object{&String{Value: "renamed"}}, "null"},
+		{"Name", nil, "renamed"},
+	}
+
+	for _, tt := range tests {
+		obj, err := host.Get(tt.method)
+		if err != nil {
+			t.Fatalf("Get(%q) error: %s", tt.method, err)
+		}
+
+		if builtin, ok := obj.(*Builtin); ok {
+			obj = builtin.Call(nil, tt.args...)
+			if obj == nil {
+				obj = &Null{}
+			}
+		}
+
+		if obj.Inspect() != tt.expected {
+			t.Errorf("%s wrong. want=%q, got=%q", tt.method, tt.expected, obj.Inspect())
+		}
+	}
+}
+
+func TestHostObjectSet(t *testing.T) {
+	config := newTestConfig()
+	host, _ := NewHostObject(config, false)
+
+	if err := host.Set("Name", &String{Value: "changed"}); err != nil {
+		t.Fatalf("Set error: %s", err)
+	}
+	if err := host.Set("Tags", &Array{Elements: []Object{&String{Value: "c"}}}); err != nil {
+		t.Fatalf("Set error: %s", err)
+	}
+	if config.Name != "changed" || len(config.Tags) != 1 || config.Tags[0] != "c" {
+		t.Errorf("fields not set on the original struct. got=%+v", config)
+	}
+
+	server, _ := host.Get("Server")
+	if err := server.(*HostObject).Set("Port", NewInteger(8080)); err != nil {
+		t.Fatalf("Set on nested struct error: %s", err)
+	}
+	if config.Server.Port != 8080 {
+		t.Errorf("nested field not set. got=%d", config.Server.Port)
+	}
+
+	errorTests := []struct {
+		name     string
+		value    Object
+		expected string
+	}{
+		{"Name", NewInteger(1), "cannot use INTEGER as string"},
+		{"Limits", &Hash{Pairs: map[HashKey]HashPair{}}, ""},
+		{"secret", &String{Value: "x"}, "has no field or method secret"},
+	}
+
+	for _, tt := range errorTests {
+		err := host.Set(tt.name, tt.value)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("Set(%q) error: %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("Set(%q) wrong error. want %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+
+	byValue, _ := NewHostObject(*config, false)
+	if err := byValue.Set("Name", &String{Value: "x"}); err == nil {
+		t.Errorf("expected an error setting a field of a struct passed by value")
+	}
+}
+
+func TestReadOnlyHostObject(t *testing.T) {
+	config := newTestConfig()
+	host, _ := NewHostObject(config, true)
+
+	if err := host.Set("Name", &String{Value: "changed"}); err == nil {
+		t.Errorf("expected an error setting a read-only host object")
+	}
+
+	if _, err := host.Get("Rename"); err == nil {
+		t.Errorf("expected pointer methods to be hidden on a read-only host object")
+	}
+
+	greeting, err := host.Get("Greeting")
+	if err != nil {
+		t.Fatalf("Get(Greeting) error: %s", err)
+	}
+	if result := greeting.(*Builtin).Call(nil, &String{Value: "x"}); result.Inspect() != "app greets x" {
+		t.Errorf("wrong greeting. got=%q", result.Inspect())
+	}
+
+	server, _ := host.Get("Server")
+	if !server.(*HostObject).ReadOnly() {
+		t.Errorf("expected nested host objects to be read-only")
+	}
+	if err := server.(*HostObject).Set("Port", NewInteger(1)); err == nil {
+		t.Errorf("expected an error setting a nested read-only host object")
+	}
+
+	config.Name = "later"
+	name, _ := host.Get("Name")
+	if name.Inspect() != "app" {
+		t.Errorf("read-only host object should not see later changes. got=%q", name.Inspect())
+	}
+}
+
+func TestFromGo(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected ObjectType
+	}{
+		{nil, NULL_OBJ},
+		{int16(3), INTEGER_OBJ},
+		{[]int(nil), NULL_OBJ},
+		{testServer{}, HOST_OBJ},
+		{&testServer{}, HOST_OBJ},
+		{(*testServer)(nil), NULL_OBJ},
+		{NewInteger(1), INTEGER_OBJ},
+		{func(args ...Object) Object { return nil }, BUILTIN_OBJ},
+	}
+
+	for _, tt := range tests {
+		obj, err := FromGo(tt.input)
+		if err != nil {
+			t.Errorf("FromGo(%#v) error: %s", tt.input, err)
+			continue
+		}
+		if obj.Type() != tt.expected {
+			t.Errorf("FromGo(%#v) wrong type. want=%s, got=%s", tt.input, tt.expected, obj.Type())
+		}
+	}
+
+	if _, err := FromGo(1.5); err == nil {
+		t.Errorf("expected an error converting a float")
+	}
+}
@@ -0,0 +1,255 @@
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// jsonParse reads a JSON document. Objects become hashes keeping the order of
+// their keys, numbers integers or, with a fraction or exponent, floats.
+var jsonParse = &Builtin{
+	Fn: func(args ...Object) Object {
+		if err := checkArgs("json_parse", args, STRING_OBJ); err != nil {
+			return err
+		}
+
+		value, err := parseJSON(args[0].(*String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return value
+	},
+}
+
+// jsonStringify writes a value as JSON, on one line unless an indent is given
+// as a number of spaces or a string. Hash keys have to be strings.
+var jsonStringify = &Builtin{
+	Fn: func(args ...Object) Object {
+		if len(args) != 1 && len(args) != 2 {
+			return newError("wrong number of arguments. got=%d, want=1 or 2", len(args))
+		}
+
+		indent := ""
+		if len(args) == 2 {
+			switch arg := args[1].(type) {
+			case *Integer:
+				if arg.Value < 0 || arg.Value > 10 {
+					return newError("indent for `json_stringify` must be between 0 and 10 spaces, got %d", arg.Value)
+				}
+				indent = strings.Repeat(" ", int(arg.Value))
+			case *String:
+				indent = arg.Value
+			default:
+				return newError("indent for `json_stringify` must be an INTEGER or STRING, got %s", args[1].Type())
+			}
+		}
+
+		var out bytes.Buffer
+		err := writeJSON(&out, args[0], "$")
+		if err != nil {
+			return newError("%s", err)
+		}
+
+		if indent == "" {
+			return &String{Value: out.String()}
+		}
+
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, out.Bytes(), "", indent); err != nil {
+			return newError("%s", err)
+		}
+		return &String{Value: indented.String()}
+	},
+}
+
+func parseJSON(source string) (Object, error) {
+	dec := json.NewDecoder(strings.NewReader(source))
+	dec.UseNumber()
+
+	value, err := readJSON(dec)
+	if err == nil {
+		end := int(dec.InputOffset())
+		if _, extra := dec.Token(); extra != io.EOF {
+			err = extra
+			if extra == nil {
+				start := end + len(source[end:]) - len(strings.TrimLeft(source[end:], " \t\r\n"))
+				err = &jsonError{offset: start, message: "unexpected data after the value"}
+			}
+		}
+	}
+	if err != nil {
+		return nil, jsonSyntaxError(source, dec, err)
+	}
+
+	return value, nil
+}
+
+// jsonError is malformed input the decoder itself does not object to.
+type jsonError struct {
+	offset  int
+	message string
+}
+
+func (e *jsonError) Error() string { return e.message }
+
+func readJSON(dec *json.Decoder) (Object, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '[' {
+			elements := []Object{}
+			for dec.More() {
+				elem, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, elem)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return &Array{Elements: elements}, nil
+		}
+
+		hash := NewHash(0)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(&String{Value: key.(string)}, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return hash, nil
+
+	case json.Number:
+		if n, err := token.Int64(); err == nil {
+			return NewInteger(n), nil
+		}
+		f, err := strconv.ParseFloat(string(token), 64)
+		if err != nil {
+			return nil, &jsonError{
+				offset:  int(dec.InputOffset()) - len(token),
+				message: fmt.Sprintf("number %s is out of range", token),
+			}
+		}
+		return &Float{Value: f}, nil
+
+	case string:
+		return &String{Value: token}, nil
+
+	case bool:
+		return &Boolean{Value: token}, nil
+
+	default:
+		return &Null{}, nil
+	}
+}
+
+// jsonSyntaxError gives the line and column malformed input stops making
+// sense at.
+func jsonSyntaxError(source string, dec *json.Decoder, err error) error {
+	offset := int(dec.InputOffset())
+	var syntaxErr *json.SyntaxError
+	var ownErr *jsonError
+	switch {
+	case errors.As(err, &ownErr):
+		offset = ownErr.offset
+	case err == io.EOF || err == io.ErrUnexpectedEOF ||
+		errors.As(err, &syntaxErr) && syntaxErr.Error() == "unexpected end of JSON input":
+		offset = len(source)
+		err = errors.New("unexpected end of input")
+	case errors.As(err, &syntaxErr):
+		offset = int(syntaxErr.Offset) - 1
+	}
+	offset = min(max(offset, 0), len(source))
+
+	line := strings.Count(source[:offset], "\n") + 1
+	column := offset - strings.LastIndex(source[:offset], "\n")
+	return fmt.Errorf("invalid JSON at line %d, column %d: %s", line, column, err)
+}
+
+// writeJSON writes value compactly, path is where in the value passed to
+// json_stringify it is, for errors.
+func writeJSON(out *bytes.Buffer, value Object, path string) error {
+	switch value := value.(type) {
+	case nil, *Null:
+		out.WriteString("null")
+
+	case *Integer:
+		out.WriteString(strconv.FormatInt(value.Value, 10))
+
+	case *Float:
+		if math.IsInf(value.Value, 0) || math.IsNaN(value.Value) {
+			return fmt.Errorf("cannot serialize %s at %s as JSON", value.Inspect(), path)
+		}
+		out.WriteString(value.Inspect())
+
+	case *Boolean:
+		out.WriteString(strconv.FormatBool(value.Value))
+
+	case *String:
+		writeJSONString(out, value.Value)
+
+	case *Array:
+		out.WriteByte('[')
+		for i, elem := range value.Elements {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeJSON(out, elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+
+	case *Hash:
+		out.WriteByte('{')
+		for i, pair := range value.OrderedPairs() {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+
+			// JSON keys are strings, writing others the way they print would
+			// let {1: 2, "1": 3} give the same key twice
+			key, ok := pair.Key.(*String)
+			if !ok {
+				return fmt.Errorf("cannot serialize %s key %s at %s as JSON", pair.Key.Type(), pair.Key.Inspect(), path)
+			}
+			writeJSONString(out, key.Value)
+			out.WriteByte(':')
+			if err := writeJSON(out, pair.Value, path+"."+key.Value); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+
+	default:
+		return fmt.Errorf("cannot serialize %s at %s as JSON", value.Type(), path)
+	}
+
+	return nil
+}
+
+func writeJSONString(out *bytes.Buffer, s string) {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	out.Truncate(out.Len() - 1) // the newline Encode ends with
+}
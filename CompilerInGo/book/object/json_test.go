@@ -0,0 +1,75 @@
+package object
+
+import "testing"
+
+func TestJSONParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"b": 1, "a": [1, 2.5, -3e2, null, true, "x"]}`, "{b: 1, a: [1, 2.5, -300.0, null, true, x]}"},
+		{`{"z": 1, "y": 2, "z": 3}`, "{z: 3, y: 2}"},
+		{`[]`, "[]"},
+		{`"é\n"`, "é\n"},
+		{`9223372036854775808`, "9.223372036854776e+18"},
+		{`{"a" 1}`, "ERROR: invalid JSON at line 1, column 6: invalid character '1' after object key"},
+		{"[1,\n 2,", "ERROR: invalid JSON at line 2, column 4: unexpected end of input"},
+		{``, "ERROR: invalid JSON at line 1, column 1: unexpected end of input"},
+		{`[1] 2`, "ERROR: invalid JSON at line 1, column 5: unexpected data after the value"},
+		{`[1]]`, "ERROR: invalid JSON at line 1, column 4: invalid character ']' looking for beginning of value"},
+		{`{"a": 1e400}`, "ERROR: invalid JSON at line 1, column 7: number 1e400 is out of range"},
+		{"{\n  \"a\": tru\n}", "ERROR: invalid JSON at line 2, column 11: invalid character '\\n' in literal true (expecting 'e')"},
+	}
+
+	for _, tt := range tests {
+		result := jsonParse.Call(nil, &String{Value: tt.input})
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestJSONStringify(t *testing.T) {
+	parsed := jsonParse.Call(nil, &String{Value: `{"name": "m<o>n\"key", "tags": ["a", 1, 1.5, null, false], "nested": {"z": {}, "a": []}}`})
+
+	tests := []struct {
+		args     []Object
+		expected string
+	}{
+		{[]Object{parsed}, `{"name":"m<o>n\"key","tags":["a",1,1.5,null,false],"nested":{"z":{},"a":[]}}`},
+		{[]Object{&Array{Elements: []Object{NewInteger(1), &Float{Value: 2}}}, NewInteger(2)}, "[\n  1,\n  2.0\n]"},
+		{[]Object{&Array{Elements: []Object{NewInteger(1)}}, &String{Value: "\t"}}, "[\n\t1\n]"},
+		{[]Object{NewHash(0)}, "{}"},
+		{[]Object{&Null{}}, "null"},
+		{
+			[]Object{&Array{Elements: []Object{parsed, &Closure{Fn: &CompiledFunction{}}}}},
+			"ERROR: cannot serialize CLOSURE at $[1] as JSON",
+		},
+		{[]Object{NewInteger(1), &Boolean{}}, "ERROR: indent for `json_stringify` must be an INTEGER or STRING, got BOOLEAN"},
+		{[]Object{NewInteger(1), NewInteger(-1)}, "ERROR: indent for `json_stringify` must be between 0 and 10 spaces, got -1"},
+		{[]Object{}, "ERROR: wrong number of arguments. got=0, want=1 or 2"},
+	}
+
+	for _, tt := range tests {
+		result := jsonStringify.Call(nil, tt.args...)
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result. want=%q, got=%q", tt.expected, result.Inspect())
+		}
+	}
+
+	hash := NewHash(0)
+	hash.Set(&String{Value: "1"}, &Builtin{})
+	result := jsonStringify.Call(nil, &Array{Elements: []Object{hash}})
+	if result.Inspect() != "ERROR: cannot serialize BUILTIN at $[0].1 as JSON" {
+		t.Errorf("wrong error for a builtin. got=%q", result.Inspect())
+	}
+
+	// {1: 2, "1": 3} would have the key "1" twice
+	hash = NewHash(0)
+	hash.Set(NewInteger(1), NewInteger(2))
+	hash.Set(&String{Value: "1"}, NewInteger(3))
+	result = jsonStringify.Call(nil, &Array{Elements: []Object{hash}})
+	if result.Inspect() != "ERROR: cannot serialize INTEGER key 1 at $[0] as JSON" {
+		t.Errorf("wrong error for an integer key. got=%q", result.Inspect())
+	}
+}
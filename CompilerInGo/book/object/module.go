@@ -0,0 +1,111 @@
+package object
+
+import (
+	"fmt"
+	"monkey/ast"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const MODULE_OBJ = "MODULE"
+
+// Module is what importing a file gives, the values of the file's exported
+// let statements by name.
+type Module struct {
+	Name    string // the path the module was loaded from
+	Exports map[string]Object
+}
+
+func (m *Module) Type() ObjectType { return MODULE_OBJ }
+func (m *Module) Inspect() string {
+	names := make([]string, 0, len(m.Exports))
+	for name := range m.Exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("module %s {%s}", m.Name, strings.Join(names, ", "))
+}
+
+func (m *Module) Get(name string) (Object, error) {
+	value, ok := m.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s has no export %s", m.Name, name)
+	}
+	return value, nil
+}
+
+// ModuleLoader finds and parses the files import expressions name.
+type ModuleLoader interface {
+	// Resolve gives the path of the module name imported from the file at
+	// importer, which is empty for programs that do not come from a file.
+	Resolve(name, importer string) (string, error)
+	Load(path string) (*ast.Program, error)
+}
+
+// Imports keeps track of the modules one run of the evaluator has imported,
+// so each is evaluated once, and of those being imported, to catch cycles.
+type Imports struct {
+	Loader ModuleLoader
+
+	mu      sync.Mutex
+	loaded  map[string]*Module
+	loading []string
+}
+
+func NewImports(loader ModuleLoader) *Imports {
+	return &Imports{Loader: loader, loaded: map[string]*Module{}}
+}
+
+// Import returns the module at path, which the first import evaluates with
+// eval.
+func (i *Imports) Import(path string, eval func(program *ast.Program) (*Module, error)) (*Module, error) {
+	i.mu.Lock()
+	if module, ok := i.loaded[path]; ok {
+		i.mu.Unlock()
+		return module, nil
+	}
+	if err := ImportCycle(i.loading, path); err != nil {
+		i.mu.Unlock()
+		return nil, err
+	}
+	i.loading = append(i.loading, path)
+	i.mu.Unlock()
+
+	module, err := i.load(path, eval)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for j, loading := range i.loading {
+		if loading == path {
+			i.loading = append(i.loading[:j], i.loading[j+1:]...)
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.loaded[path] = module
+	return module, nil
+}
+
+func (i *Imports) load(path string, eval func(program *ast.Program) (*Module, error)) (*Module, error) {
+	program, err := i.Loader.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return eval(program)
+}
+
+// ImportCycle returns an error if importing path while the modules in loading
+// are being imported, outermost first, closes a cycle.
+func ImportCycle(loading []string, path string) error {
+	for i, l := range loading {
+		if l == path {
+			cycle := append(append([]string{}, loading[i:]...), path)
+			return fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
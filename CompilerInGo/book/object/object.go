@@ -6,11 +6,24 @@ import (
 	"hash/fnv"
 	"monkey/ast"
 	"monkey/code"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 type BuiltinFunction func(args ...Object) Object
 
+// CallbackFunction is a builtin that calls functions it is given through the
+// engine running it.
+type CallbackFunction func(caller Caller, args ...Object) Object
+
+// Caller calls Monkey functions and builtins on behalf of a builtin and gives
+// it the streams of the run it was called in.
+type Caller interface {
+	Call(fn Object, args ...Object) (Object, error)
+	Streams() *Streams
+}
+
 type ObjectType string
 
 const (
@@ -18,10 +31,12 @@ const (
 	ERROR_OBJ = "ERROR"
 
 	INTEGER_OBJ = "INTEGER"
+	FLOAT_OBJ   = "FLOAT"
 	BOOLEAN_OBJ = "BOOLEAN"
 	STRING_OBJ  = "STRING"
 
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
+	TAIL_CALL_OBJ    = "TAIL_CALL"
 
 	FUNCTION_OBJ          = "FUNCTION"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
@@ -56,6 +71,44 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+const (
+	minCachedInteger = -128
+	maxCachedInteger = 1024
+)
+
+var smallIntegers = func() []*Integer {
+	cache := make([]*Integer, maxCachedInteger-minCachedInteger+1)
+	for i := range cache {
+		cache[i] = &Integer{Value: int64(i + minCachedInteger)}
+	}
+	return cache
+}()
+
+// NewInteger returns a shared Integer for small values and a fresh one
+// otherwise. Integers are never mutated so sharing them is safe.
+func NewInteger(value int64) *Integer {
+	if value >= minCachedInteger && value <= maxCachedInteger {
+		return smallIntegers[value-minCachedInteger]
+	}
+	return &Integer{Value: value}
+}
+
+// Float holds numbers with a fraction, such as those json_parse reads. There
+// is no arithmetic on floats yet.
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		// keep floats with integral values apart from integers
+		s += ".0"
+	}
+	return s
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -86,6 +139,16 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// TailCall stands in for the result of a call a function ends with, the
+// evaluator makes the call once the calling function has returned.
+type TailCall struct {
+	Function  Object
+	Arguments []Object
+}
+
+func (tc *TailCall) Type() ObjectType { return TAIL_CALL_OBJ }
+func (tc *TailCall) Inspect() string  { return "tail call to " + tc.Function.Inspect() }
+
 type Error struct {
 	Message string
 }
@@ -94,9 +157,11 @@ func (e *Error) Type() ObjectType { return ERROR_OBJ }
 func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
 
 type Function struct {
-	Parameters []*ast.Identifier
-	Body       *ast.BlockStatement
-	Env        *Environment
+	Parameters  []*ast.Identifier
+	Body        *ast.BlockStatement
+	Env         *Environment
+	Name        string
+	IsGenerator bool
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -132,12 +197,26 @@ func (s *String) HashKey() HashKey {
 }
 
 type Builtin struct {
-	Fn BuiltinFunction
+	Fn       BuiltinFunction
+	Callback CallbackFunction // used instead of Fn when set
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
+// Call calls the builtin. caller may be nil when a host calls it directly,
+// builtins that need one then fail.
+func (b *Builtin) Call(caller Caller, args ...Object) Object {
+	if b.Callback == nil {
+		return b.Fn(args...)
+	}
+	if caller == nil {
+		return newError("builtin cannot call functions in this engine")
+	}
+
+	return b.Callback(caller, args...)
+}
+
 type Array struct {
 	Elements []Object
 }
@@ -163,8 +242,69 @@ type HashPair struct {
 	Value Object
 }
 
+// Hash keeps its pairs in the order their keys were first Set. Pairs added to
+// the map directly come after those, ordered by key.
 type Hash struct {
 	Pairs map[HashKey]HashPair
+	keys  []HashKey
+}
+
+func NewHash(size int) *Hash {
+	return &Hash{Pairs: make(map[HashKey]HashPair, size), keys: make([]HashKey, 0, size)}
+}
+
+// Set adds the pair of key and value, or replaces the value of a key that is
+// already there without moving it.
+func (h *Hash) Set(key Hashable, value Object) {
+	hashKey := key.HashKey()
+	if _, ok := h.Pairs[hashKey]; !ok {
+		h.keys = append(h.keys, hashKey)
+	}
+	h.Pairs[hashKey] = HashPair{Key: key.(Object), Value: value}
+}
+
+// OrderedPairs gives the pairs in the order of the hash.
+func (h *Hash) OrderedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	ordered := make(map[HashKey]bool, len(h.keys))
+	for _, key := range h.keys {
+		if pair, ok := h.Pairs[key]; ok && !ordered[key] {
+			pairs = append(pairs, pair)
+			ordered[key] = true
+		}
+	}
+	if len(pairs) == len(h.Pairs) {
+		return pairs
+	}
+
+	var rest []HashPair
+	for key, pair := range h.Pairs {
+		if !ordered[key] {
+			rest = append(rest, pair)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return lessHashKey(rest[i].Key, rest[j].Key)
+	})
+	return append(pairs, rest...)
+}
+
+// lessHashKey orders keys booleans first, then integers, then strings.
+func lessHashKey(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	default:
+		return false
+	}
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
@@ -172,7 +312,7 @@ func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
+	for _, pair := range h.OrderedPairs() {
 		pairs = append(pairs, fmt.Sprintf("%s: %s",
 			pair.Key.Inspect(), pair.Value.Inspect()))
 	}
@@ -188,6 +328,8 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string // empty for anonymous functions
+	IsGenerator   bool   // calls return an object.Generator running the function
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -58,3 +58,19 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestSmallIntegerCache(t *testing.T) {
+	if NewInteger(5) != NewInteger(5) {
+		t.Errorf("small integers should be shared")
+	}
+
+	if NewInteger(100000) == NewInteger(100000) {
+		t.Errorf("large integers should not be shared")
+	}
+
+	for _, v := range []int64{-129, -128, 0, 1024, 1025} {
+		if NewInteger(v).Value != v {
+			t.Errorf("NewInteger(%d) has value %d", v, NewInteger(v).Value)
+		}
+	}
+}
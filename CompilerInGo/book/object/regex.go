@@ -0,0 +1,215 @@
+package object
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const REGEX_OBJ = "REGEX"
+
+// Regex is a compiled pattern, what regex("a+") gives. Its methods are
+// reached like a module's exports: regex("a+").find_all("aa b aaa").
+type Regex struct {
+	Regexp  *regexp.Regexp
+	methods map[string]Object
+}
+
+func (r *Regex) Type() ObjectType { return REGEX_OBJ }
+func (r *Regex) Inspect() string  { return "/" + r.Regexp.String() + "/" }
+
+func (r *Regex) Get(name string) (Object, error) {
+	if name == "pattern" {
+		return &String{Value: r.Regexp.String()}, nil
+	}
+
+	method, ok := r.methods[name]
+	if !ok {
+		return nil, fmt.Errorf("regex %s has no method %s", r.Inspect(), name)
+	}
+	return method, nil
+}
+
+// maxCachedRegexes bounds the cache of compiled patterns, which is emptied
+// when it is full so scripts making patterns up as they go cannot grow it
+// without end.
+const maxCachedRegexes = 256
+
+var regexCache = struct {
+	mu      sync.Mutex
+	regexes map[string]*Regex
+}{regexes: map[string]*Regex{}}
+
+// CompileRegex compiles pattern, or gives the Regex it was compiled to
+// before. Regexes are only read once made, so every engine shares them.
+func CompileRegex(pattern string) (*Regex, error) {
+	regexCache.mu.Lock()
+	defer regexCache.mu.Unlock()
+
+	if r, ok := regexCache.regexes[pattern]; ok {
+		return r, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for `regex`: %s",
+			strings.TrimPrefix(err.Error(), "error parsing regexp: "))
+	}
+
+	r := &Regex{Regexp: re}
+	r.methods = regexMethods(r)
+
+	if len(regexCache.regexes) >= maxCachedRegexes {
+		clear(regexCache.regexes)
+	}
+	regexCache.regexes[pattern] = r
+	return r, nil
+}
+
+var regex = &Builtin{
+	Fn: func(args ...Object) Object {
+		if err := checkArgs("regex", args, STRING_OBJ); err != nil {
+			return err
+		}
+
+		r, err := CompileRegex(args[0].(*String).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return r
+	},
+}
+
+func regexMethods(r *Regex) map[string]Object {
+	re := r.Regexp
+	methods := map[string]BuiltinFunction{
+		"match": func(args ...Object) Object {
+			if err := checkArgs("regex.match", args, STRING_OBJ); err != nil {
+				return err
+			}
+			return &Boolean{Value: re.MatchString(args[0].(*String).Value)}
+		},
+		// find gives the first match, or null
+		"find": func(args ...Object) Object {
+			if err := checkArgs("regex.find", args, STRING_OBJ); err != nil {
+				return err
+			}
+
+			loc := re.FindStringIndex(args[0].(*String).Value)
+			if loc == nil {
+				return nil
+			}
+			return &String{Value: args[0].(*String).Value[loc[0]:loc[1]]}
+		},
+		// find_all gives every match, or the first n when given n
+		"find_all": func(args ...Object) Object {
+			s, n, err := regexArgs("regex.find_all", args)
+			if err != nil {
+				return err
+			}
+			return stringArray(re.FindAllString(s, n))
+		},
+		// replace replaces every match, $1 or ${name} in the replacement
+		// stand for what a group matched
+		"replace": func(args ...Object) Object {
+			if err := checkArgs("regex.replace", args, STRING_OBJ, STRING_OBJ); err != nil {
+				return err
+			}
+			return &String{Value: re.ReplaceAllString(args[0].(*String).Value, args[1].(*String).Value)}
+		},
+		// split gives the text between the matches, at most n pieces when
+		// given n
+		"split": func(args ...Object) Object {
+			s, n, err := regexArgs("regex.split", args)
+			if err != nil {
+				return err
+			}
+			return stringArray(re.Split(s, n))
+		},
+		// captures gives the groups of the first match by number and by name,
+		// 0 being the whole match, or null without a match
+		"captures": func(args ...Object) Object {
+			if err := checkArgs("regex.captures", args, STRING_OBJ); err != nil {
+				return err
+			}
+
+			s := args[0].(*String).Value
+			loc := re.FindStringSubmatchIndex(s)
+			if loc == nil {
+				return nil
+			}
+			return captures(re, s, loc)
+		},
+		// captures_all gives the captures of every match
+		"captures_all": func(args ...Object) Object {
+			s, n, err := regexArgs("regex.captures_all", args)
+			if err != nil {
+				return err
+			}
+
+			matches := re.FindAllStringSubmatchIndex(s, n)
+			elements := make([]Object, len(matches))
+			for i, loc := range matches {
+				elements[i] = captures(re, s, loc)
+			}
+			return &Array{Elements: elements}
+		},
+	}
+
+	objects := make(map[string]Object, len(methods))
+	for name, fn := range methods {
+		objects[name] = &Builtin{Fn: fn}
+	}
+	return objects
+}
+
+// regexArgs checks the arguments of the methods taking a string and an
+// optional limit, which is -1 for none.
+func regexArgs(name string, args []Object) (string, int, *Error) {
+	var err *Error
+	if len(args) == 2 {
+		err = checkArgs(name, args, STRING_OBJ, INTEGER_OBJ)
+	} else {
+		err = checkArgs(name, args, STRING_OBJ)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	n := -1
+	if len(args) == 2 {
+		n = int(args[1].(*Integer).Value)
+	}
+	return args[0].(*String).Value, n, nil
+}
+
+// captures makes the hash of the groups of the match at loc, groups that did
+// not take part in it are null.
+func captures(re *regexp.Regexp, s string, loc []int) *Hash {
+	names := re.SubexpNames()
+	hash := NewHash(len(names))
+
+	for i := range names {
+		var value Object = &Null{}
+		if loc[2*i] >= 0 {
+			value = &String{Value: s[loc[2*i]:loc[2*i+1]]}
+		}
+		hash.Set(NewInteger(int64(i)), value)
+	}
+	for i, name := range names {
+		if name != "" {
+			hash.Set(&String{Value: name}, hash.Pairs[NewInteger(int64(i)).HashKey()].Value)
+		}
+	}
+
+	return hash
+}
+
+func stringArray(strs []string) *Array {
+	elements := make([]Object, len(strs))
+	for i, s := range strs {
+		elements[i] = &String{Value: s}
+	}
+	return &Array{Elements: elements}
+}
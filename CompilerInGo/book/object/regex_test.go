@@ -0,0 +1,23 @@
+package object
+
+import "testing"
+
+func TestCompileRegexCaches(t *testing.T) {
+	first, err := CompileRegex(`(\w+)@(\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CompileRegex(`(\w+)@(\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("pattern compiled twice")
+	}
+
+	_, err = CompileRegex(`(a`)
+	expected := "invalid pattern for `regex`: missing closing ): `(a`"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
@@ -0,0 +1,372 @@
+package object
+
+import "strings"
+
+// The namespaces of the standard library, builtins indexed like imported
+// modules: math.abs(-1), strings.split("a,b", ",").
+
+var mathModule = nativeModule("math", map[string]BuiltinFunction{
+	"abs": func(args ...Object) Object {
+		if err := checkArgs("math.abs", args, INTEGER_OBJ); err != nil {
+			return err
+		}
+
+		n := args[0].(*Integer).Value
+		if n < 0 {
+			n = -n
+		}
+		return NewInteger(n)
+	},
+	"min": func(args ...Object) Object {
+		return extreme("math.min", args, func(a, b int64) bool { return a < b })
+	},
+	"max": func(args ...Object) Object {
+		return extreme("math.max", args, func(a, b int64) bool { return a > b })
+	},
+	"pow": func(args ...Object) Object {
+		if err := checkArgs("math.pow", args, INTEGER_OBJ, INTEGER_OBJ); err != nil {
+			return err
+		}
+
+		base, exponent := args[0].(*Integer).Value, args[1].(*Integer).Value
+		if exponent < 0 {
+			return newError("negative exponent to `math.pow`: %d", exponent)
+		}
+
+		result := int64(1)
+		for ; exponent > 0; exponent-- {
+			next := result * base
+			if base != 0 && next/base != result {
+				return newError("integer overflow in `math.pow`")
+			}
+			result = next
+		}
+		return NewInteger(result)
+	},
+})
+
+var stringsModule = nativeModule("strings", map[string]BuiltinFunction{
+	"split": func(args ...Object) Object {
+		if err := checkArgs("strings.split", args, STRING_OBJ, STRING_OBJ); err != nil {
+			return err
+		}
+
+		parts := strings.Split(args[0].(*String).Value, args[1].(*String).Value)
+		elements := make([]Object, len(parts))
+		for i, part := range parts {
+			elements[i] = &String{Value: part}
+		}
+		return &Array{Elements: elements}
+	},
+	"join": func(args ...Object) Object {
+		if err := checkArgs("strings.join", args, ARRAY_OBJ, STRING_OBJ); err != nil {
+			return err
+		}
+
+		elements := args[0].(*Array).Elements
+		parts := make([]string, len(elements))
+		for i, elem := range elements {
+			str, ok := elem.(*String)
+			if !ok {
+				return newError("element %d of the array passed to `strings.join` must be a STRING, got %s", i, elem.Type())
+			}
+			parts[i] = str.Value
+		}
+		return &String{Value: strings.Join(parts, args[1].(*String).Value)}
+	},
+	"trim": func(args ...Object) Object {
+		if err := checkArgs("strings.trim", args, STRING_OBJ); err != nil {
+			return err
+		}
+		return &String{Value: strings.TrimSpace(args[0].(*String).Value)}
+	},
+	"replace": func(args ...Object) Object {
+		if err := checkArgs("strings.replace", args, STRING_OBJ, STRING_OBJ, STRING_OBJ); err != nil {
+			return err
+		}
+
+		s, old, new := args[0].(*String).Value, args[1].(*String).Value, args[2].(*String).Value
+		return &String{Value: strings.ReplaceAll(s, old, new)}
+	},
+	"contains": func(args ...Object) Object {
+		if err := checkArgs("strings.contains", args, STRING_OBJ, STRING_OBJ); err != nil {
+			return err
+		}
+		return &Boolean{Value: strings.Contains(args[0].(*String).Value, args[1].(*String).Value)}
+	},
+	"upper": func(args ...Object) Object {
+		if err := checkArgs("strings.upper", args, STRING_OBJ); err != nil {
+			return err
+		}
+		return &String{Value: strings.ToUpper(args[0].(*String).Value)}
+	},
+	"lower": func(args ...Object) Object {
+		if err := checkArgs("strings.lower", args, STRING_OBJ); err != nil {
+			return err
+		}
+		return &String{Value: strings.ToLower(args[0].(*String).Value)}
+	},
+	// index_of gives the byte offset len counts in, or -1
+	"index_of": func(args ...Object) Object {
+		if err := checkArgs("strings.index_of", args, STRING_OBJ, STRING_OBJ); err != nil {
+			return err
+		}
+		return NewInteger(int64(strings.Index(args[0].(*String).Value, args[1].(*String).Value)))
+	},
+})
+
+var arraysModule = nativeModule("arrays", map[string]BuiltinFunction{
+	// slice takes the elements from start up to end, or the end of the array.
+	// Negative positions count from the end, positions out of range are
+	// clamped like they are in Python.
+	"slice": func(args ...Object) Object {
+		var err *Error
+		if len(args) == 2 {
+			err = checkArgs("arrays.slice", args, ARRAY_OBJ, INTEGER_OBJ)
+		} else {
+			err = checkArgs("arrays.slice", args, ARRAY_OBJ, INTEGER_OBJ, INTEGER_OBJ)
+		}
+		if err != nil {
+			return err
+		}
+
+		elements := args[0].(*Array).Elements
+		start, end := sliceBound(args[1], len(elements)), len(elements)
+		if len(args) == 3 {
+			end = sliceBound(args[2], len(elements))
+		}
+		if start >= end {
+			return &Array{Elements: []Object{}}
+		}
+
+		return &Array{Elements: append([]Object{}, elements[start:end]...)}
+	},
+	"concat": func(args ...Object) Object {
+		elements := []Object{}
+		for i, arg := range args {
+			arr, ok := arg.(*Array)
+			if !ok {
+				return newError("argument %d to `arrays.concat` must be an ARRAY, got %s", i, arg.Type())
+			}
+			elements = append(elements, arr.Elements...)
+		}
+		return &Array{Elements: elements}
+	},
+	"reverse": func(args ...Object) Object {
+		if err := checkArgs("arrays.reverse", args, ARRAY_OBJ); err != nil {
+			return err
+		}
+
+		elements := args[0].(*Array).Elements
+		reversed := make([]Object, len(elements))
+		for i, elem := range elements {
+			reversed[len(elements)-1-i] = elem
+		}
+		return &Array{Elements: reversed}
+	},
+	"contains": func(args ...Object) Object {
+		if len(args) != 2 {
+			return newError("wrong number of arguments. got=%d, want=2", len(args))
+		}
+		arr, ok := args[0].(*Array)
+		if !ok {
+			return newError("argument to `arrays.contains` must be an ARRAY, got %s", args[0].Type())
+		}
+
+		for _, elem := range arr.Elements {
+			if Equal(elem, args[1]) {
+				return &Boolean{Value: true}
+			}
+		}
+		return &Boolean{Value: false}
+	},
+})
+
+var hashesModule = nativeModule("hashes", map[string]BuiltinFunction{
+	"keys": func(args ...Object) Object {
+		if err := checkArgs("hashes.keys", args, HASH_OBJ); err != nil {
+			return err
+		}
+
+		pairs := args[0].(*Hash).OrderedPairs()
+		keys := make([]Object, len(pairs))
+		for i, pair := range pairs {
+			keys[i] = pair.Key
+		}
+		return &Array{Elements: keys}
+	},
+	"values": func(args ...Object) Object {
+		if err := checkArgs("hashes.values", args, HASH_OBJ); err != nil {
+			return err
+		}
+
+		pairs := args[0].(*Hash).OrderedPairs()
+		values := make([]Object, len(pairs))
+		for i, pair := range pairs {
+			values[i] = pair.Value
+		}
+		return &Array{Elements: values}
+	},
+	"has": func(args ...Object) Object {
+		if len(args) != 2 {
+			return newError("wrong number of arguments. got=%d, want=2", len(args))
+		}
+		hash, ok := args[0].(*Hash)
+		if !ok {
+			return newError("argument to `hashes.has` must be a HASH, got %s", args[0].Type())
+		}
+		key, ok := args[1].(Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", args[1].Type())
+		}
+
+		_, found := hash.Pairs[key.HashKey()]
+		return &Boolean{Value: found}
+	},
+	// delete gives a copy of the hash without the key, like push gives a
+	// copy of the array with the element added
+	"delete": func(args ...Object) Object {
+		if len(args) != 2 {
+			return newError("wrong number of arguments. got=%d, want=2", len(args))
+		}
+		hash, ok := args[0].(*Hash)
+		if !ok {
+			return newError("argument to `hashes.delete` must be a HASH, got %s", args[0].Type())
+		}
+		key, ok := args[1].(Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", args[1].Type())
+		}
+
+		deleted := NewHash(len(hash.Pairs))
+		for _, pair := range hash.OrderedPairs() {
+			if pair.Key.(Hashable).HashKey() != key.HashKey() {
+				deleted.Set(pair.Key.(Hashable), pair.Value)
+			}
+		}
+		return deleted
+	},
+	// merge gives a hash with the pairs of all the hashes, the value of a key
+	// in more than one comes from the last
+	"merge": func(args ...Object) Object {
+		merged := NewHash(0)
+		for i, arg := range args {
+			hash, ok := arg.(*Hash)
+			if !ok {
+				return newError("argument %d to `hashes.merge` must be a HASH, got %s", i, arg.Type())
+			}
+			for _, pair := range hash.OrderedPairs() {
+				merged.Set(pair.Key.(Hashable), pair.Value)
+			}
+		}
+		return merged
+	},
+})
+
+func nativeModule(name string, functions map[string]BuiltinFunction) *Module {
+	exports := make(map[string]Object, len(functions))
+	for fnName, fn := range functions {
+		exports[fnName] = &Builtin{Fn: fn}
+	}
+	return &Module{Name: name, Exports: exports}
+}
+
+// checkArgs checks the number and the types of the arguments to the builtin
+// name.
+func checkArgs(name string, args []Object, types ...ObjectType) *Error {
+	if len(args) != len(types) {
+		return newError("wrong number of arguments. got=%d, want=%d", len(args), len(types))
+	}
+
+	for i, arg := range args {
+		if arg.Type() != types[i] {
+			if len(types) == 1 {
+				return newError("argument to `%s` must be %s, got %s", name, article(types[i]), arg.Type())
+			}
+			return newError("argument %d to `%s` must be %s, got %s", i, name, article(types[i]), arg.Type())
+		}
+	}
+
+	return nil
+}
+
+func article(t ObjectType) string {
+	switch t[0] {
+	case 'A', 'E', 'I', 'O', 'U':
+		return "an " + string(t)
+	default:
+		return "a " + string(t)
+	}
+}
+
+// extreme gives the integer argument before all others in the order of
+// before.
+func extreme(name string, args []Object, before func(a, b int64) bool) Object {
+	if len(args) == 0 {
+		return newError("wrong number of arguments. got=0, want at least 1")
+	}
+
+	var result int64
+	for i, arg := range args {
+		n, ok := arg.(*Integer)
+		if !ok {
+			return newError("argument %d to `%s` must be an INTEGER, got %s", i, name, arg.Type())
+		}
+		if i == 0 || before(n.Value, result) {
+			result = n.Value
+		}
+	}
+	return NewInteger(result)
+}
+
+func sliceBound(position Object, length int) int {
+	i := int(position.(*Integer).Value)
+	if i < 0 {
+		i += length
+	}
+	return min(max(i, 0), length)
+}
+
+// Equal reports whether two values are equal, comparing integers, strings,
+// booleans and nulls by value and arrays and hashes element by element.
+func Equal(a, b Object) bool {
+	switch a := a.(type) {
+	case *Integer:
+		b, ok := b.(*Integer)
+		return ok && a.Value == b.Value
+	case *String:
+		b, ok := b.(*String)
+		return ok && a.Value == b.Value
+	case *Boolean:
+		b, ok := b.(*Boolean)
+		return ok && a.Value == b.Value
+	case *Null:
+		_, ok := b.(*Null)
+		return ok
+	case *Array:
+		b, ok := b.(*Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		for i := range a.Elements {
+			if !Equal(a.Elements[i], b.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		b, ok := b.(*Hash)
+		if !ok || len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		for key, pair := range a.Pairs {
+			other, ok := b.Pairs[key]
+			if !ok || !Equal(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,54 @@
+package object
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Streams are what builtins like puts and gets write to and read from. Each
+// VM or evaluator run has its own so hosts can capture a script's output.
+// Builtins go through Println and ReadLine, which tasks spawned by the run
+// can call at the same time.
+type Streams struct {
+	Out io.Writer
+	In  *bufio.Reader
+
+	outMu sync.Mutex
+	inMu  sync.Mutex
+}
+
+func NewStreams(in io.Reader, out io.Writer) *Streams {
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+
+	return &Streams{Out: out, In: reader}
+}
+
+func (s *Streams) Println(a ...interface{}) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+
+	fmt.Fprintln(s.Out, a...)
+}
+
+// ReadLine reads a line without its line ending, io.EOF means there is none.
+func (s *Streams) ReadLine() (string, error) {
+	s.inMu.Lock()
+	defer s.inMu.Unlock()
+
+	line, err := s.In.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// DefaultStreams are the process's standard input and output, used when no
+// others are set.
+var DefaultStreams = NewStreams(os.Stdin, os.Stdout)
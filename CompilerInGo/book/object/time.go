@@ -0,0 +1,235 @@
+package object
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// TimeSource is implemented by the callers of engines the host can give a
+// Clock and a Random, it lets the time and random builtins reach the ones of
+// the running program. Engines that do not implement it use the system clock
+// and DefaultRandom.
+type TimeSource interface {
+	Clock() Clock
+	Random() *Random
+	Context() context.Context
+}
+
+// Clock is what now reads and sleep waits on. Hosts freeze time in tests by
+// giving scripts a FixedClock.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, or until ctx is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// SystemClock is the real time, used when no other clock is set.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FixedClock stands still until it is slept on, which moves it forward at
+// once instead of waiting.
+type FixedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFixedClock(now time.Time) *FixedClock {
+	return &FixedClock{now: now}
+}
+
+func (c *FixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FixedClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	return ctx.Err()
+}
+
+// Random is the source of random_int and shuffle. Tasks spawned by a run
+// share it, so it is locked while used.
+type Random struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewRandom makes a Random giving the same numbers every time for the same
+// seed.
+func NewRandom(seed uint64) *Random {
+	return &Random{rand: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// DefaultRandom is seeded differently in every process, it is used when no
+// other Random is set.
+var DefaultRandom = &Random{rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+
+// Int64 gives a number from lo up to and including hi.
+func (r *Random) Int64(lo, hi int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	span := uint64(hi - lo)
+	if span == math.MaxUint64 {
+		return int64(r.rand.Uint64())
+	}
+	return lo + int64(r.rand.Uint64N(span+1))
+}
+
+func (r *Random) Shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rand.Shuffle(n, swap)
+}
+
+func timeSource(caller Caller) (Clock, *Random, context.Context) {
+	source, ok := caller.(TimeSource)
+	if !ok {
+		return SystemClock, DefaultRandom, context.Background()
+	}
+	ctx := source.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return source.Clock(), source.Random(), ctx
+}
+
+// Times are integers, milliseconds since the Unix epoch.
+
+const defaultTimeLayout = time.RFC3339
+
+var now = &Builtin{
+	Callback: func(caller Caller, args ...Object) Object {
+		if len(args) != 0 {
+			return newError("wrong number of arguments. got=%d, want=0", len(args))
+		}
+
+		clock, _, _ := timeSource(caller)
+		return NewInteger(clock.Now().UnixMilli())
+	},
+}
+
+var sleep = &Builtin{
+	Callback: func(caller Caller, args ...Object) Object {
+		if err := checkArgs("sleep", args, INTEGER_OBJ); err != nil {
+			return err
+		}
+		ms := args[0].(*Integer).Value
+		if ms < 0 {
+			return newError("argument to `sleep` must not be negative, got %d", ms)
+		}
+
+		clock, _, ctx := timeSource(caller)
+		if err := clock.Sleep(ctx, time.Duration(ms)*time.Millisecond); err != nil {
+			return newError("`sleep` was interrupted: %s", err)
+		}
+		return nil
+	},
+}
+
+// formatTime writes a time in UTC, as RFC 3339 or in the layout given the way
+// Go's time package takes it.
+var formatTime = &Builtin{
+	Fn: func(args ...Object) Object {
+		layout, err := timeLayout("format_time", args, INTEGER_OBJ)
+		if err != nil {
+			return err
+		}
+
+		t := time.UnixMilli(args[0].(*Integer).Value).UTC()
+		return &String{Value: t.Format(layout)}
+	},
+}
+
+// parseTime reads a time written like format_time writes it, times without a
+// zone are in UTC.
+var parseTime = &Builtin{
+	Fn: func(args ...Object) Object {
+		layout, err := timeLayout("parse_time", args, STRING_OBJ)
+		if err != nil {
+			return err
+		}
+
+		t, parseErr := time.Parse(layout, args[0].(*String).Value)
+		if parseErr != nil {
+			return newError("unable to parse time %s: %s", args[0].(*String).Value, parseErr)
+		}
+		return NewInteger(t.UnixMilli())
+	},
+}
+
+// timeLayout checks the arguments of format_time and parse_time, a time and
+// an optional layout, and gives the layout.
+func timeLayout(name string, args []Object, first ObjectType) (string, *Error) {
+	var err *Error
+	if len(args) == 2 {
+		err = checkArgs(name, args, first, STRING_OBJ)
+	} else {
+		err = checkArgs(name, args, first)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 2 {
+		return args[1].(*String).Value, nil
+	}
+	return defaultTimeLayout, nil
+}
+
+// randomInt gives a number from lo up to and including hi.
+var randomInt = &Builtin{
+	Callback: func(caller Caller, args ...Object) Object {
+		if err := checkArgs("random_int", args, INTEGER_OBJ, INTEGER_OBJ); err != nil {
+			return err
+		}
+		lo, hi := args[0].(*Integer).Value, args[1].(*Integer).Value
+		if lo > hi {
+			return newError("empty range for `random_int`: %d > %d", lo, hi)
+		}
+
+		_, random, _ := timeSource(caller)
+		return NewInteger(random.Int64(lo, hi))
+	},
+}
+
+// shuffle gives a shuffled copy of the array.
+var shuffle = &Builtin{
+	Callback: func(caller Caller, args ...Object) Object {
+		if err := checkArgs("shuffle", args, ARRAY_OBJ); err != nil {
+			return err
+		}
+
+		elements := append([]Object{}, args[0].(*Array).Elements...)
+		_, random, _ := timeSource(caller)
+		random.Shuffle(len(elements), func(i, j int) {
+			elements[i], elements[j] = elements[j], elements[i]
+		})
+		return &Array{Elements: elements}
+	},
+}
@@ -0,0 +1,52 @@
+package object
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFixedClock(t *testing.T) {
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	clock := NewFixedClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Errorf("wrong time. want=%s, got=%s", start, clock.Now())
+	}
+	if err := clock.Sleep(context.Background(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(time.Hour); !clock.Now().Equal(want) {
+		t.Errorf("sleep did not move the clock. want=%s, got=%s", want, clock.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := SystemClock.Sleep(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("sleep not interrupted. got=%v", err)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	draw := func(r *Random) []int64 {
+		numbers := make([]int64, 20)
+		for i := range numbers {
+			numbers[i] = r.Int64(-3, 3)
+			if numbers[i] < -3 || numbers[i] > 3 {
+				t.Fatalf("number out of range: %d", numbers[i])
+			}
+		}
+		return numbers
+	}
+
+	first, second := draw(NewRandom(42)), draw(NewRandom(42))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("same seed gave different numbers: %v and %v", first, second)
+	}
+
+	if n := NewRandom(1).Int64(5, 5); n != 5 {
+		t.Errorf("wrong number for a range of one. got=%d", n)
+	}
+	NewRandom(1).Int64(-1<<63, 1<<63-1)
+}
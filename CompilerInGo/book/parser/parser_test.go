@@ -788,6 +788,125 @@ func TestParsingIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestParsingDotExpressions(t *testing.T) {
+	input := "config.server.Port"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	if stmt.Expression.String() != "((config[server])[Port])" {
+		t.Errorf("wrong expression. got=%q", stmt.Expression.String())
+	}
+
+	outer, ok := stmt.Expression.(*ast.IndexExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.IndexExpression. got=%T", stmt.Expression)
+	}
+
+	port, ok := outer.Index.(*ast.StringLiteral)
+	if !ok || port.Value != "Port" {
+		t.Fatalf("index is not the string literal Port. got=%T (%+v)", outer.Index, outer.Index)
+	}
+
+	p = New(lexer.New("config.1"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Errorf("expected an error for a dot not followed by an identifier")
+	}
+}
+
+func TestParsingYieldExpressions(t *testing.T) {
+	input := `fn() { let x = yield 1 + 2; fn() { x }; yield }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	function, ok := stmt.Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FunctionLiteral. got=%T", stmt.Expression)
+	}
+	if !function.IsGenerator {
+		t.Errorf("function with yield is not a generator")
+	}
+
+	let := function.Body.Statements[0].(*ast.LetStatement)
+	yield, ok := let.Value.(*ast.YieldExpression)
+	if !ok {
+		t.Fatalf("let value not *ast.YieldExpression. got=%T", let.Value)
+	}
+	if yield.String() != "yield (1 + 2)" {
+		t.Errorf("wrong yield expression. got=%q", yield.String())
+	}
+
+	inner := function.Body.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+	if inner.IsGenerator {
+		t.Errorf("function nested in a generator is a generator")
+	}
+
+	last := function.Body.Statements[2].(*ast.ExpressionStatement).Expression.(*ast.YieldExpression)
+	if last.Value != nil {
+		t.Errorf("yield without a value has value %s", last.Value)
+	}
+
+	p = New(lexer.New("yield 1"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "yield outside of a function" {
+		t.Errorf("expected an error for yield outside of a function. got=%v", p.Errors())
+	}
+}
+
+func TestParsingImportAndExport(t *testing.T) {
+	input := `let m = import "lib/math"; export let double = fn(x) { x * 2 };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	imp, ok := let.Value.(*ast.ImportExpression)
+	if !ok {
+		t.Fatalf("let value not *ast.ImportExpression. got=%T", let.Value)
+	}
+	if imp.Path != "lib/math" {
+		t.Errorf("wrong import path. got=%q", imp.Path)
+	}
+	if let.Exported {
+		t.Errorf("let without export is exported")
+	}
+
+	export, ok := program.Statements[1].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("export not *ast.LetStatement. got=%T", program.Statements[1])
+	}
+	if !export.Exported || export.Name.Value != "double" {
+		t.Errorf("wrong export. got=%q", export.String())
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`fn() { export let x = 1; }`, "export inside of a function"},
+		{`export 1`, "expected next token to be LET, got INT instead"},
+		{`import x`, "expected next token to be STRING, got IDENT instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("expected error %q. got=%v", tt.expected, p.Errors())
+		}
+	}
+}
+
 func TestParsingEmptyHashLiteral(t *testing.T) {
 	input := "{}"
 
@@ -0,0 +1,159 @@
+package regvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"monkey/code"
+)
+
+// Register instructions are an opcode byte followed by two byte operands.
+// A, B and C name registers relative to the current frame, K a constant,
+// G a global, I a builtin or free variable index, N a count and J a jump target.
+type Opcode byte
+
+const (
+	OpLoadConst Opcode = iota
+	OpLoadTrue
+	OpLoadFalse
+	OpLoadNull
+	OpMove
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpGreaterThan
+	OpMinus
+	OpBang
+	OpJump
+	OpJumpNotTruthy
+	OpGetGlobal
+	OpSetGlobal
+	OpGetBuiltIn
+	OpGetFree
+	OpCurrentClosure
+	OpArray
+	OpHash
+	OpIndex
+	OpClosure
+	OpCall
+	OpReturn
+	OpResult
+)
+
+var definitions = map[Opcode]*code.Defintion{
+	OpLoadConst:      newDefinition("OpLoadConst", 2),      // A K
+	OpLoadTrue:       newDefinition("OpLoadTrue", 1),       // A
+	OpLoadFalse:      newDefinition("OpLoadFalse", 1),      // A
+	OpLoadNull:       newDefinition("OpLoadNull", 1),       // A
+	OpMove:           newDefinition("OpMove", 2),           // A B
+	OpAdd:            newDefinition("OpAdd", 3),            // A B C
+	OpSub:            newDefinition("OpSub", 3),            // A B C
+	OpMul:            newDefinition("OpMul", 3),            // A B C
+	OpDiv:            newDefinition("OpDiv", 3),            // A B C
+	OpEqual:          newDefinition("OpEqual", 3),          // A B C
+	OpNotEqual:       newDefinition("OpNotEqual", 3),       // A B C
+	OpGreaterThan:    newDefinition("OpGreaterThan", 3),    // A B C
+	OpMinus:          newDefinition("OpMinus", 2),          // A B
+	OpBang:           newDefinition("OpBang", 2),           // A B
+	OpJump:           newDefinition("OpJump", 1),           // J
+	OpJumpNotTruthy:  newDefinition("OpJumpNotTruthy", 2),  // A J
+	OpGetGlobal:      newDefinition("OpGetGlobal", 2),      // A G
+	OpSetGlobal:      newDefinition("OpSetGlobal", 2),      // G A
+	OpGetBuiltIn:     newDefinition("OpGetBuiltIn", 2),     // A I
+	OpGetFree:        newDefinition("OpGetFree", 2),        // A I
+	OpCurrentClosure: newDefinition("OpCurrentClosure", 1), // A
+	OpArray:          newDefinition("OpArray", 3),          // A B N
+	OpHash:           newDefinition("OpHash", 3),           // A B N
+	OpIndex:          newDefinition("OpIndex", 3),          // A B C
+	OpClosure:        newDefinition("OpClosure", 4),        // A K B N
+	OpCall:           newDefinition("OpCall", 3),           // A B N
+	OpReturn:         newDefinition("OpReturn", 1),         // A
+	OpResult:         newDefinition("OpResult", 1),         // A
+}
+
+func newDefinition(name string, numOperands int) *code.Defintion {
+	widths := make([]int, numOperands)
+	for i := range widths {
+		widths[i] = 2
+	}
+	return &code.Defintion{Name: name, OperandWidths: widths}
+}
+
+func Lookup(op byte) (*code.Defintion, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("register opcode %d is undefined", op)
+	}
+
+	return def, nil
+}
+
+// Make encodes an instruction whose operands are known to fit, as in tests,
+// and panics if one does not. The compiler uses MakeInstruction.
+func Make(op Opcode, operands ...int) []byte {
+	instruction, err := MakeInstruction(op, operands...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return instruction
+}
+
+// MakeInstruction encodes an instruction, an operand that does not fit in
+// two bytes is an error.
+func MakeInstruction(op Opcode, operands ...int) ([]byte, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("register opcode %d is undefined", op)
+	}
+
+	instruction := make([]byte, 1+2*len(def.OperandWidths))
+	instruction[0] = byte(op)
+
+	for i, o := range operands {
+		if !fitsOperand(o) {
+			return nil, operandError(def.Name, o)
+		}
+		binary.BigEndian.PutUint16(instruction[1+2*i:], uint16(o))
+	}
+
+	return instruction, nil
+}
+
+func fitsOperand(o int) bool {
+	return o >= 0 && o <= math.MaxUint16
+}
+
+func operandError(name string, o int) error {
+	return fmt.Errorf("operand %d of %s does not fit in 2 bytes", o, name)
+}
+
+// Disassemble renders register instructions the same way code.Instructions does
+// for the stack instruction set.
+func Disassemble(ins code.Instructions) string {
+	var out bytes.Buffer
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			return out.String()
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		fmt.Fprintf(&out, "%04d %s", i, def.Name)
+		for _, o := range operands {
+			fmt.Fprintf(&out, " %d", o)
+		}
+		out.WriteString("\n")
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
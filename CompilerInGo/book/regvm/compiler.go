@@ -0,0 +1,513 @@
+package regvm
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/object"
+	"sort"
+)
+
+// MaxRegisters is the most registers a single function can address with a two
+// byte operand.
+const MaxRegisters = 1 << 16
+
+// anyRegister lets the expression compiler pick where a value ends up, which
+// for locals means reading straight from the register they already live in.
+const anyRegister = -1
+
+type Bytecode struct {
+	Instructions code.Instructions
+	Constants    []object.Object
+	NumRegisters int
+}
+
+type registerScope struct {
+	instructions code.Instructions
+
+	// locals maps a symbol table index to the register holding that local
+	locals       map[int]int
+	nextRegister int
+	maxRegisters int
+	// registers below this hold locals and are never reused for temporaries
+	reserved int
+}
+
+type Compiler struct {
+	constants   []object.Object
+	symbolTable *compiler.SymbolTable
+	scopes      []*registerScope
+
+	err error // the first instruction that could not be encoded
+}
+
+func NewCompiler() *Compiler {
+	symbolTable := compiler.NewSymbolTable()
+	for i, bi := range object.BuiltIns {
+		symbolTable.DefineBuiltIn(i, bi.Name)
+	}
+
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: symbolTable,
+		scopes:      []*registerScope{newRegisterScope()},
+	}
+}
+
+func NewCompilerWithState(st *compiler.SymbolTable, constants []object.Object) *Compiler {
+	c := NewCompiler()
+	c.symbolTable = st
+	c.constants = constants
+	return c
+}
+
+func newRegisterScope() *registerScope {
+	return &registerScope{
+		instructions: code.Instructions{},
+		locals:       map[int]int{},
+	}
+}
+
+func (c *Compiler) Compile(program *ast.Program) error {
+	for _, s := range program.Statements {
+		if es, ok := s.(*ast.ExpressionStatement); ok {
+			mark := c.scope().nextRegister
+			reg, err := c.compileExpression(es.Expression, anyRegister)
+			if err != nil {
+				return err
+			}
+			c.emit(OpResult, reg)
+			c.releaseTemporaries(mark)
+			continue
+		}
+
+		err := c.compileStatement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.err
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	return &Bytecode{
+		Instructions: c.scope().instructions,
+		Constants:    c.constants,
+		NumRegisters: c.scope().maxRegisters,
+	}
+}
+
+func (c *Compiler) compileStatement(s ast.Statement) error {
+	mark := c.scope().nextRegister
+
+	switch s := s.(type) {
+	case *ast.ExpressionStatement:
+		_, err := c.compileExpression(s.Expression, anyRegister)
+		if err != nil {
+			return err
+		}
+
+	case *ast.LetStatement:
+		symbol := c.symbolTable.Define(s.Name.Value)
+
+		if symbol.Scope == compiler.GlobalScope {
+			reg, err := c.compileExpression(s.Value, anyRegister)
+			if err != nil {
+				return err
+			}
+			c.emit(OpSetGlobal, symbol.Index, reg)
+			break
+		}
+
+		// the binding gets a register of its own before its value is compiled,
+		// so a value naming the binding reads null, as in the stack VM, rather
+		// than whatever local its register would otherwise be shared with
+		reg := c.allocate()
+		c.scope().locals[symbol.Index] = reg
+		c.scope().reserved = reg + 1
+		c.emit(OpLoadNull, reg)
+
+		_, err := c.compileExpression(s.Value, reg)
+		if err != nil {
+			return err
+		}
+
+	case *ast.ReturnStatement:
+		reg, err := c.compileExpression(s.ReturnValue, anyRegister)
+		if err != nil {
+			return err
+		}
+		c.emit(OpReturn, reg)
+
+	case *ast.BlockStatement:
+		for _, st := range s.Statements {
+			err := c.compileStatement(st)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	c.releaseTemporaries(mark)
+	return nil
+}
+
+// compileBlock compiles a block used as a value, leaving the value of its last
+// expression statement (or null) in dst.
+func (c *Compiler) compileBlock(block *ast.BlockStatement, dst int) error {
+	if block == nil || len(block.Statements) == 0 {
+		c.emit(OpLoadNull, dst)
+		return nil
+	}
+
+	last := len(block.Statements) - 1
+	for _, s := range block.Statements[:last] {
+		err := c.compileStatement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	es, ok := block.Statements[last].(*ast.ExpressionStatement)
+	if !ok {
+		err := c.compileStatement(block.Statements[last])
+		if err != nil {
+			return err
+		}
+		c.emit(OpLoadNull, dst)
+		return nil
+	}
+
+	_, err := c.compileExpression(es.Expression, dst)
+	return err
+}
+
+// compileExpression emits code leaving the value of exp in a register and
+// returns that register. When dst is anyRegister the compiler chooses.
+func (c *Compiler) compileExpression(exp ast.Expression, dst int) (int, error) {
+	switch exp := exp.(type) {
+	case *ast.IntegerLiteral:
+		dst = c.target(dst)
+		c.emit(OpLoadConst, dst, c.addConstant(&object.Integer{Value: exp.Value}))
+
+	case *ast.StringLiteral:
+		dst = c.target(dst)
+		c.emit(OpLoadConst, dst, c.addConstant(&object.String{Value: exp.Value}))
+
+	case *ast.Boolean:
+		dst = c.target(dst)
+		if exp.Value {
+			c.emit(OpLoadTrue, dst)
+		} else {
+			c.emit(OpLoadFalse, dst)
+		}
+
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(exp.Value)
+		if !ok {
+			return 0, fmt.Errorf("unable to resolve symbol %s", exp.Value)
+		}
+		return c.loadSymbol(symbol, dst), nil
+
+	case *ast.PrefixExpression:
+		right, err := c.compileExpression(exp.Right, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+
+		dst = c.target(dst)
+		switch exp.Operator {
+		case "!":
+			c.emit(OpBang, dst, right)
+		case "-":
+			c.emit(OpMinus, dst, right)
+		default:
+			return 0, fmt.Errorf("unknown prefix operator : %s", exp.Operator)
+		}
+
+	case *ast.InfixExpression:
+		left, err := c.compileExpression(exp.Left, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+		right, err := c.compileExpression(exp.Right, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+
+		dst = c.target(dst)
+		switch exp.Operator {
+		case "+":
+			c.emit(OpAdd, dst, left, right)
+		case "-":
+			c.emit(OpSub, dst, left, right)
+		case "*":
+			c.emit(OpMul, dst, left, right)
+		case "/":
+			c.emit(OpDiv, dst, left, right)
+		case ">":
+			c.emit(OpGreaterThan, dst, left, right)
+		case "<":
+			c.emit(OpGreaterThan, dst, right, left)
+		case "==":
+			c.emit(OpEqual, dst, left, right)
+		case "!=":
+			c.emit(OpNotEqual, dst, left, right)
+		default:
+			return 0, fmt.Errorf("unknown operator %s", exp.Operator)
+		}
+
+	case *ast.IfExpression:
+		dst = c.target(dst)
+
+		condition, err := c.compileExpression(exp.Condition, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+
+		jumpNotTruthyPos := c.emit(OpJumpNotTruthy, condition, 9999)
+		err = c.compileBlock(exp.Consequence, dst)
+		if err != nil {
+			return 0, err
+		}
+
+		jumpPos := c.emit(OpJump, 9999)
+		c.replaceOperand(jumpNotTruthyPos, 1, len(c.scope().instructions))
+
+		err = c.compileBlock(exp.Alternative, dst)
+		if err != nil {
+			return 0, err
+		}
+		c.replaceOperand(jumpPos, 0, len(c.scope().instructions))
+
+	case *ast.ArrayLiteral:
+		first, err := c.compileContiguous(exp.Elements)
+		if err != nil {
+			return 0, err
+		}
+		dst = c.target(dst)
+		c.emit(OpArray, dst, first, len(exp.Elements))
+
+	case *ast.HashLiteral:
+		var keys []ast.Expression
+		for k := range exp.Pairs {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		items := []ast.Expression{}
+		for _, k := range keys {
+			items = append(items, k, exp.Pairs[k])
+		}
+
+		first, err := c.compileContiguous(items)
+		if err != nil {
+			return 0, err
+		}
+		dst = c.target(dst)
+		c.emit(OpHash, dst, first, len(items))
+
+	case *ast.IndexExpression:
+		left, err := c.compileExpression(exp.Left, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+		index, err := c.compileExpression(exp.Index, anyRegister)
+		if err != nil {
+			return 0, err
+		}
+		dst = c.target(dst)
+		c.emit(OpIndex, dst, left, index)
+
+	case *ast.FunctionLiteral:
+		return c.compileFunction(exp, dst)
+
+	case *ast.CallExpression:
+		callee, err := c.compileContiguous(append([]ast.Expression{exp.Function}, exp.Arguments...))
+		if err != nil {
+			return 0, err
+		}
+		dst = c.target(dst)
+		c.emit(OpCall, dst, callee, len(exp.Arguments))
+
+	case *ast.YieldExpression:
+		return 0, fmt.Errorf("generators are not supported by the register backend, use -engine vm")
+
+	case *ast.ImportExpression:
+		return 0, fmt.Errorf("import is not supported by the register backend, use -engine vm")
+
+	default:
+		return 0, fmt.Errorf("unable to compile %T in the register backend", exp)
+	}
+
+	if c.scope().maxRegisters > MaxRegisters {
+		return 0, fmt.Errorf("function needs more than %d registers", MaxRegisters)
+	}
+
+	return dst, nil
+}
+
+// compileContiguous evaluates expressions into consecutive registers, as
+// needed by calls, arrays and hashes, and returns the first register.
+func (c *Compiler) compileContiguous(exps []ast.Expression) (int, error) {
+	first := c.scope().nextRegister
+	for range exps {
+		c.allocate()
+	}
+
+	for i, e := range exps {
+		_, err := c.compileExpression(e, first+i)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return first, nil
+}
+
+func (c *Compiler) compileFunction(fn *ast.FunctionLiteral, dst int) (int, error) {
+	c.scopes = append(c.scopes, newRegisterScope())
+	c.symbolTable = compiler.NewEnclosedSymbolTable(c.symbolTable)
+
+	if fn.Name != "" {
+		c.symbolTable.DefineFunctionName(fn.Name)
+	}
+
+	for _, p := range fn.Parameters {
+		symbol := c.symbolTable.Define(p.Value)
+		c.scope().locals[symbol.Index] = c.allocate()
+	}
+	c.scope().reserved = c.scope().nextRegister
+
+	result := c.allocate()
+	err := c.compileBlock(fn.Body, result)
+	if err != nil {
+		return 0, err
+	}
+	c.emit(OpReturn, result)
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	fnScope := c.scope()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.symbolTable = c.symbolTable.Outer
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:  fnScope.instructions,
+		NumLocals:     fnScope.maxRegisters,
+		NumParameters: len(fn.Parameters),
+	}
+	fnIndex := c.addConstant(compiledFn)
+
+	first := c.scope().nextRegister
+	for range freeSymbols {
+		c.allocate()
+	}
+	for i, s := range freeSymbols {
+		c.loadSymbol(s, first+i)
+	}
+
+	dst = c.target(dst)
+	c.emit(OpClosure, dst, fnIndex, first, len(freeSymbols))
+	return dst, nil
+}
+
+func (c *Compiler) loadSymbol(s compiler.Symbol, dst int) int {
+	if s.Scope == compiler.LocalScope {
+		reg := c.scope().locals[s.Index]
+		if dst == anyRegister || dst == reg {
+			return reg
+		}
+		c.emit(OpMove, dst, reg)
+		return dst
+	}
+
+	dst = c.target(dst)
+	switch s.Scope {
+	case compiler.GlobalScope:
+		c.emit(OpGetGlobal, dst, s.Index)
+	case compiler.BuiltInScope:
+		c.emit(OpGetBuiltIn, dst, s.Index)
+	case compiler.FreeScope:
+		c.emit(OpGetFree, dst, s.Index)
+	case compiler.FunctionScope:
+		c.emit(OpCurrentClosure, dst)
+	}
+	return dst
+}
+
+func (c *Compiler) scope() *registerScope {
+	return c.scopes[len(c.scopes)-1]
+}
+
+func (c *Compiler) target(dst int) int {
+	if dst == anyRegister {
+		return c.allocate()
+	}
+	return dst
+}
+
+func (c *Compiler) allocate() int {
+	scope := c.scope()
+	reg := scope.nextRegister
+	scope.nextRegister++
+	if scope.nextRegister > scope.maxRegisters {
+		scope.maxRegisters = scope.nextRegister
+	}
+	return reg
+}
+
+// releaseTemporaries frees registers allocated since mark, keeping any that
+// were claimed by a let statement in the meantime.
+func (c *Compiler) releaseTemporaries(mark int) {
+	scope := c.scope()
+	if mark < scope.reserved {
+		mark = scope.reserved
+	}
+	if mark < scope.nextRegister {
+		scope.nextRegister = mark
+	}
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1
+}
+
+func (c *Compiler) emit(op Opcode, operands ...int) int {
+	scope := c.scope()
+	pos := len(scope.instructions)
+	ins, err := MakeInstruction(op, operands...)
+	if err != nil {
+		c.fail(err)
+		// keep the positions of what follows right until Compile reports it
+		ins = Make(op, make([]int, len(operands))...)
+	}
+	scope.instructions = append(scope.instructions, ins...)
+	return pos
+}
+
+// fail records the first instruction that could not be encoded, Compile
+// reports it once the program is compiled.
+func (c *Compiler) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *Compiler) replaceOperand(pos int, operandIndex int, operand int) {
+	ins := c.scope().instructions
+	if !fitsOperand(operand) {
+		def, _ := Lookup(ins[pos])
+		c.fail(operandError(def.Name, operand))
+		return
+	}
+	offset := pos + 1 + 2*operandIndex
+	ins[offset] = byte(operand >> 8)
+	ins[offset+1] = byte(operand)
+}
@@ -0,0 +1,149 @@
+package regvm
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"strings"
+	"testing"
+)
+
+func concatInstructions(ins [][]byte) code.Instructions {
+	out := code.Instructions{}
+	for _, i := range ins {
+		out = append(out, i...)
+	}
+	return out
+}
+
+func TestRegisterCompiler(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedInstructions [][]byte
+		expectedRegisters    int
+	}{
+		{
+			input: "1 + 2",
+			expectedInstructions: [][]byte{
+				Make(OpLoadConst, 0, 0),
+				Make(OpLoadConst, 1, 1),
+				Make(OpAdd, 2, 0, 1),
+				Make(OpResult, 2),
+			},
+			expectedRegisters: 3,
+		},
+		{
+			input: "1 < 2; 3",
+			expectedInstructions: [][]byte{
+				Make(OpLoadConst, 0, 0),
+				Make(OpLoadConst, 1, 1),
+				Make(OpGreaterThan, 2, 1, 0),
+				Make(OpResult, 2),
+				Make(OpLoadConst, 0, 2),
+				Make(OpResult, 0),
+			},
+			expectedRegisters: 3,
+		},
+		{
+			input: "if (true) { 10 } else { 20 }",
+			expectedInstructions: [][]byte{
+				// 0000
+				Make(OpLoadTrue, 1),
+				// 0003
+				Make(OpJumpNotTruthy, 1, 16),
+				// 0008
+				Make(OpLoadConst, 0, 0),
+				// 0013
+				Make(OpJump, 21),
+				// 0016
+				Make(OpLoadConst, 0, 1),
+				// 0021
+				Make(OpResult, 0),
+			},
+			expectedRegisters: 2,
+		},
+		{
+			input: "let one = 1; len([one])",
+			expectedInstructions: [][]byte{
+				Make(OpLoadConst, 0, 0),
+				Make(OpSetGlobal, 0, 0),
+				Make(OpGetBuiltIn, 0, 0),
+				Make(OpGetGlobal, 2, 0),
+				Make(OpArray, 1, 2, 1),
+				Make(OpCall, 3, 0, 1),
+				Make(OpResult, 3),
+			},
+			expectedRegisters: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := comp.Bytecode()
+		expected := concatInstructions(tt.expectedInstructions)
+		if string(bytecode.Instructions) != string(expected) {
+			t.Errorf("%q: wrong instructions.\nwant:\n%s\ngot:\n%s", tt.input, Disassemble(expected), Disassemble(bytecode.Instructions))
+		}
+
+		if bytecode.NumRegisters != tt.expectedRegisters {
+			t.Errorf("%q: wrong register count, want %d got %d", tt.input, tt.expectedRegisters, bytecode.NumRegisters)
+		}
+	}
+}
+
+func TestFunctionsUseParameterRegisters(t *testing.T) {
+	comp := NewCompiler()
+	err := comp.Compile(parse("fn(a, b) { a + b }"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn, ok := comp.Bytecode().Constants[0].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not a function: %T", comp.Bytecode().Constants[0])
+	}
+
+	expected := concatInstructions([][]byte{
+		Make(OpAdd, 2, 0, 1),
+		Make(OpReturn, 2),
+	})
+	if string(fn.Instructions) != string(expected) {
+		t.Errorf("wrong instructions.\nwant:\n%s\ngot:\n%s", Disassemble(expected), Disassemble(fn.Instructions))
+	}
+
+	if fn.NumLocals != 3 || fn.NumParameters != 2 {
+		t.Errorf("wrong frame layout, NumLocals=%d NumParameters=%d", fn.NumLocals, fn.NumParameters)
+	}
+}
+
+func TestOperandsTooLargeToEncode(t *testing.T) {
+	params := make([]string, 65537)
+	for i := range params {
+		params[i] = letterIdentifier(i)
+	}
+	input := fmt.Sprintf("fn(%s) { %s }", strings.Join(params, ", "), params[65536])
+
+	err := NewCompiler().Compile(parse(input))
+	expected := "operand 65537 of OpMove does not fit in 2 bytes"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected compiler error %q, got %v", expected, err)
+	}
+}
+
+// letterIdentifier names the i-th of many generated identifiers, identifiers
+// may not contain digits.
+func letterIdentifier(i int) string {
+	name := ""
+	for {
+		name = string(rune('a'+i%26)) + name
+		i = i/26 - 1
+		if i < 0 {
+			return "v" + name
+		}
+	}
+}
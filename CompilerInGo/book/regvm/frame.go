@@ -0,0 +1,28 @@
+package regvm
+
+import (
+	"monkey/code"
+	"monkey/object"
+)
+
+type Frame struct {
+	closure            *object.Closure
+	instructionPointer int
+	// basePointer is the index of register 0 of this frame in the register file
+	basePointer int
+	// returnRegister is the caller's register that receives the return value
+	returnRegister int
+}
+
+func NewFrame(closure *object.Closure, basePointer int, returnRegister int) *Frame {
+	return &Frame{
+		closure:            closure,
+		instructionPointer: 0,
+		basePointer:        basePointer,
+		returnRegister:     returnRegister,
+	}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.closure.Fn.Instructions
+}
@@ -0,0 +1,527 @@
+// Package regvm is a register based backend for the compiler's front end,
+// selected with -engine reg. It runs the core language and the builtins,
+// including those calling Monkey functions like map and resume. Generators
+// and imports are rejected when compiling, they need the stack VM.
+package regvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"monkey/vm"
+)
+
+// MaxRegisterFile bounds the registers of all active frames combined.
+const MaxRegisterFile = 1 << 20
+
+// initialGlobals is where the global store starts, it grows as globals are
+// set like the stack VM's.
+const initialGlobals = 64
+
+var trueObj = &object.Boolean{Value: true}
+var falseObj = &object.Boolean{Value: false}
+var nullObj = &object.Null{}
+
+type VM struct {
+	constants []object.Object
+	globals   []object.Object
+
+	registers []object.Object
+	frames    []*Frame
+
+	lastValue object.Object
+
+	streams     *object.Streams
+	callbackErr error // first error from a call made by the running builtin
+}
+
+func New(bytecode *Bytecode) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		NumLocals:    bytecode.NumRegisters,
+	}
+	mainClosure := &object.Closure{Fn: mainFn}
+
+	return &VM{
+		constants: bytecode.Constants,
+		globals:   make([]object.Object, initialGlobals),
+		registers: make([]object.Object, bytecode.NumRegisters+256),
+		frames:    []*Frame{NewFrame(mainClosure, 0, 0)},
+		lastValue: nullObj,
+		streams:   object.DefaultStreams,
+	}
+}
+
+func NewWithGlobalStore(bytecode *Bytecode, globals []object.Object) *VM {
+	machine := New(bytecode)
+	machine.globals = globals
+	return machine
+}
+
+// LastValue is the value of the last top level expression statement, the
+// register VM's counterpart to vm.VM.LastPoppedStackElem.
+func (m *VM) LastValue() object.Object {
+	return m.lastValue
+}
+
+// Globals returns the global store, which is replaced when it has to grow.
+func (m *VM) Globals() []object.Object {
+	return m.globals
+}
+
+// SetStreams sets what builtins like puts and gets write to and read from.
+func (m *VM) SetStreams(streams *object.Streams) {
+	m.streams = streams
+}
+
+// builtinCaller gives builtins the VM's streams and lets them call Monkey
+// functions, which run on frames above the one calling the builtin.
+type builtinCaller struct {
+	vm *VM
+}
+
+// Call runs fn to completion. An error stops the builtin's caller too, as it
+// would have had the call been made in Monkey.
+func (c builtinCaller) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	m := c.vm
+
+	var result object.Object
+	var err error
+
+	switch fn := fn.(type) {
+	case *object.Closure:
+		result, err = m.callClosure(fn, args)
+	case *object.Builtin:
+		previous := m.callbackErr
+		m.callbackErr = nil
+		result = fn.Call(c, args...)
+		err = m.callbackErr
+		m.callbackErr = previous
+	default:
+		err = fmt.Errorf("calling non-closure and non-built-in")
+	}
+
+	if err != nil {
+		m.callbackErr = err
+	}
+	return result, err
+}
+
+func (m *VM) callClosure(fn *object.Closure, args []object.Object) (object.Object, error) {
+	if len(args) != fn.Fn.NumParameters {
+		return nil, fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.Fn.NumParameters, len(args))
+	}
+
+	// each call from a builtin nests a run of the VM on the Go stack
+	if len(m.frames) >= vm.DefaultLimits.MaxFrames {
+		return nil, fmt.Errorf("stack overflow")
+	}
+
+	top := m.frames[len(m.frames)-1]
+	base := top.basePointer + top.closure.Fn.NumLocals
+	err := m.ensureRegisters(base + fn.Fn.NumLocals)
+	if err != nil {
+		return nil, err
+	}
+	copy(m.registers[base:], args)
+
+	stopAt := len(m.frames) + 1
+	m.frames = append(m.frames, NewFrame(fn, base, 0))
+
+	result, err := m.run(stopAt)
+	if err != nil {
+		m.frames = m.frames[:stopAt-1]
+		return nil, err
+	}
+	if result == nil {
+		result = nullObj
+	}
+	return result, nil
+}
+
+func (c builtinCaller) Streams() *object.Streams {
+	return c.vm.streams
+}
+
+func operand(ins code.Instructions, ip int, n int) int {
+	return int(binary.BigEndian.Uint16(ins[ip+1+2*n:]))
+}
+
+func (m *VM) Run() error {
+	_, err := m.run(1)
+	return err
+}
+
+// run executes instructions until the frame stack drops below stopAt frames,
+// giving the value the last frame returned, or until the main function ends
+// when stopAt is 1.
+func (m *VM) run(stopAt int) (object.Object, error) {
+	frame := m.frames[len(m.frames)-1]
+	ins := frame.Instructions()
+	ip := frame.instructionPointer
+	regs := m.registers[frame.basePointer:]
+
+	for ip < len(ins) {
+		switch Opcode(ins[ip]) {
+		case OpLoadConst:
+			regs[operand(ins, ip, 0)] = m.constants[operand(ins, ip, 1)]
+			ip += 5
+
+		case OpLoadTrue:
+			regs[operand(ins, ip, 0)] = trueObj
+			ip += 3
+
+		case OpLoadFalse:
+			regs[operand(ins, ip, 0)] = falseObj
+			ip += 3
+
+		case OpLoadNull:
+			regs[operand(ins, ip, 0)] = nullObj
+			ip += 3
+
+		case OpMove:
+			regs[operand(ins, ip, 0)] = regs[operand(ins, ip, 1)]
+			ip += 5
+
+		case OpAdd, OpSub, OpMul, OpDiv:
+			result, err := executeBinaryOperation(Opcode(ins[ip]), regs[operand(ins, ip, 1)], regs[operand(ins, ip, 2)])
+			if err != nil {
+				return nil, err
+			}
+			regs[operand(ins, ip, 0)] = result
+			ip += 7
+
+		case OpEqual, OpNotEqual, OpGreaterThan:
+			result, err := executeComparison(Opcode(ins[ip]), regs[operand(ins, ip, 1)], regs[operand(ins, ip, 2)])
+			if err != nil {
+				return nil, err
+			}
+			regs[operand(ins, ip, 0)] = result
+			ip += 7
+
+		case OpMinus:
+			right := regs[operand(ins, ip, 1)]
+			integer, ok := right.(*object.Integer)
+			if !ok {
+				return nil, fmt.Errorf("unable to execute minus operator on type %s", right.Type())
+			}
+			regs[operand(ins, ip, 0)] = object.NewInteger(-integer.Value)
+			ip += 5
+
+		case OpBang:
+			regs[operand(ins, ip, 0)] = nativeBoolToBooleanObject(!isTruthy(regs[operand(ins, ip, 1)]))
+			ip += 5
+
+		case OpJump:
+			ip = operand(ins, ip, 0)
+
+		case OpJumpNotTruthy:
+			if !isTruthy(regs[operand(ins, ip, 0)]) {
+				ip = operand(ins, ip, 1)
+			} else {
+				ip += 5
+			}
+
+		case OpGetGlobal:
+			regs[operand(ins, ip, 0)] = m.getGlobal(operand(ins, ip, 1))
+			ip += 5
+
+		case OpSetGlobal:
+			m.setGlobal(operand(ins, ip, 0), regs[operand(ins, ip, 1)])
+			ip += 5
+
+		case OpGetBuiltIn:
+			regs[operand(ins, ip, 0)] = object.BuiltIns[operand(ins, ip, 1)].Builtin
+			ip += 5
+
+		case OpGetFree:
+			regs[operand(ins, ip, 0)] = frame.closure.Free[operand(ins, ip, 1)]
+			ip += 5
+
+		case OpCurrentClosure:
+			regs[operand(ins, ip, 0)] = frame.closure
+			ip += 3
+
+		case OpArray:
+			first, count := operand(ins, ip, 1), operand(ins, ip, 2)
+			elements := make([]object.Object, count)
+			copy(elements, regs[first:first+count])
+			regs[operand(ins, ip, 0)] = &object.Array{Elements: elements}
+			ip += 7
+
+		case OpHash:
+			first, count := operand(ins, ip, 1), operand(ins, ip, 2)
+			hash, err := buildHash(regs[first : first+count])
+			if err != nil {
+				return nil, err
+			}
+			regs[operand(ins, ip, 0)] = hash
+			ip += 7
+
+		case OpIndex:
+			result, err := executeIndexExpression(regs[operand(ins, ip, 1)], regs[operand(ins, ip, 2)])
+			if err != nil {
+				return nil, err
+			}
+			regs[operand(ins, ip, 0)] = result
+			ip += 7
+
+		case OpClosure:
+			constant := m.constants[operand(ins, ip, 1)]
+			function, ok := constant.(*object.CompiledFunction)
+			if !ok {
+				return nil, fmt.Errorf("not a function: %+v", constant)
+			}
+
+			first, count := operand(ins, ip, 2), operand(ins, ip, 3)
+			free := make([]object.Object, count)
+			copy(free, regs[first:first+count])
+
+			regs[operand(ins, ip, 0)] = &object.Closure{Fn: function, Free: free}
+			ip += 9
+
+		case OpCall:
+			dst, callee, numArgs := operand(ins, ip, 0), operand(ins, ip, 1), operand(ins, ip, 2)
+			args := regs[callee+1 : callee+1+numArgs]
+			ip += 7
+
+			switch fn := regs[callee].(type) {
+			case *object.Closure:
+				if numArgs != fn.Fn.NumParameters {
+					return nil, fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.Fn.NumParameters, numArgs)
+				}
+
+				base := frame.basePointer + frame.closure.Fn.NumLocals
+				err := m.ensureRegisters(base + fn.Fn.NumLocals)
+				if err != nil {
+					return nil, err
+				}
+				copy(m.registers[base:], args)
+
+				frame.instructionPointer = ip
+				frame = NewFrame(fn, base, dst)
+				m.frames = append(m.frames, frame)
+
+				ins = frame.Instructions()
+				ip = 0
+				regs = m.registers[base:]
+
+			case *object.Builtin:
+				frame.instructionPointer = ip
+				result := fn.Call(builtinCaller{m}, args...)
+				if m.callbackErr != nil {
+					err := m.callbackErr
+					m.callbackErr = nil
+					return nil, err
+				}
+				if result == nil {
+					result = nullObj
+				}
+
+				// calls made by the builtin may have grown the register file
+				regs = m.registers[frame.basePointer:]
+				regs[dst] = result
+
+			default:
+				return nil, fmt.Errorf("calling non-closure and non-built-in")
+			}
+
+		case OpReturn:
+			value := regs[operand(ins, ip, 0)]
+
+			if len(m.frames) == 1 {
+				return nil, nil
+			}
+
+			returnRegister := frame.returnRegister
+			m.frames = m.frames[:len(m.frames)-1]
+			if len(m.frames) < stopAt {
+				return value, nil
+			}
+			frame = m.frames[len(m.frames)-1]
+
+			ins = frame.Instructions()
+			ip = frame.instructionPointer
+			regs = m.registers[frame.basePointer:]
+			regs[returnRegister] = value
+
+		case OpResult:
+			m.lastValue = regs[operand(ins, ip, 0)]
+			ip += 3
+
+		default:
+			return nil, fmt.Errorf("unknown register opcode %d", ins[ip])
+		}
+	}
+
+	frame.instructionPointer = ip
+	return nil, nil
+}
+
+func (m *VM) ensureRegisters(size int) error {
+	if size <= len(m.registers) {
+		return nil
+	}
+
+	if size > MaxRegisterFile {
+		return fmt.Errorf("stack overflow")
+	}
+
+	newSize := len(m.registers) * 2
+	for newSize < size {
+		newSize *= 2
+	}
+
+	registers := make([]object.Object, newSize)
+	copy(registers, m.registers)
+	m.registers = registers
+	return nil
+}
+
+func (m *VM) getGlobal(index int) object.Object {
+	if index >= len(m.globals) || m.globals[index] == nil {
+		return nullObj
+	}
+
+	return m.globals[index]
+}
+
+func (m *VM) setGlobal(index int, obj object.Object) {
+	if index >= len(m.globals) {
+		globals := make([]object.Object, max(index+1, len(m.globals)*2))
+		copy(globals, m.globals)
+		m.globals = globals
+	}
+
+	m.globals[index] = obj
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func nativeBoolToBooleanObject(input bool) object.Object {
+	if input {
+		return trueObj
+	}
+
+	return falseObj
+}
+
+func executeBinaryOperation(op Opcode, left, right object.Object) (object.Object, error) {
+	leftType := left.Type()
+	rightType := right.Type()
+
+	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
+		leftValue := left.(*object.Integer).Value
+		rightValue := right.(*object.Integer).Value
+
+		switch op {
+		case OpAdd:
+			return object.NewInteger(leftValue + rightValue), nil
+		case OpSub:
+			return object.NewInteger(leftValue - rightValue), nil
+		case OpMul:
+			return object.NewInteger(leftValue * rightValue), nil
+		case OpDiv:
+			if rightValue == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return object.NewInteger(leftValue / rightValue), nil
+		}
+	}
+
+	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
+		if op != OpAdd {
+			return nil, fmt.Errorf("unable to do operation %q on strings", op)
+		}
+
+		return &object.String{Value: left.(*object.String).Value + right.(*object.String).Value}, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %d on type %s and %s", op, leftType, rightType)
+}
+
+func executeComparison(op Opcode, left, right object.Object) (object.Object, error) {
+	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
+		leftVal := left.(*object.Integer).Value
+		rightVal := right.(*object.Integer).Value
+
+		switch op {
+		case OpEqual:
+			return nativeBoolToBooleanObject(leftVal == rightVal), nil
+		case OpNotEqual:
+			return nativeBoolToBooleanObject(leftVal != rightVal), nil
+		case OpGreaterThan:
+			return nativeBoolToBooleanObject(leftVal > rightVal), nil
+		}
+	}
+
+	switch op {
+	case OpEqual:
+		return nativeBoolToBooleanObject(left == right), nil
+	case OpNotEqual:
+		return nativeBoolToBooleanObject(left != right), nil
+	}
+
+	return nil, fmt.Errorf("unable to do comparison of types %s and %s", left.Type(), right.Type())
+}
+
+func executeIndexExpression(left, index object.Object) (object.Object, error) {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		elements := left.(*object.Array).Elements
+		i := index.(*object.Integer).Value
+		if i < 0 || i > int64(len(elements)-1) {
+			return nullObj, nil
+		}
+		return elements[i], nil
+
+	case left.Type() == object.HASH_OBJ:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unable to use type %s for an index", index.Type())
+		}
+		pair, ok := left.(*object.Hash).Pairs[key.HashKey()]
+		if !ok {
+			return nullObj, nil
+		}
+		return pair.Value, nil
+
+	case left.Type() == object.HOST_OBJ && index.Type() == object.STRING_OBJ:
+		return left.(*object.HostObject).Get(index.(*object.String).Value)
+
+	case left.Type() == object.MODULE_OBJ && index.Type() == object.STRING_OBJ:
+		return left.(*object.Module).Get(index.(*object.String).Value)
+
+	case left.Type() == object.REGEX_OBJ && index.Type() == object.STRING_OBJ:
+		return left.(*object.Regex).Get(index.(*object.String).Value)
+
+	default:
+		return nil, fmt.Errorf("unable to execute index on type %s", left.Type())
+	}
+}
+
+func buildHash(items []object.Object) (object.Object, error) {
+	hash := object.NewHash(len(items) / 2)
+
+	for i := 0; i < len(items); i += 2 {
+		key := items[i]
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unable to has key %s", key.Type())
+		}
+
+		hash.Set(hashKey, items[i+1])
+	}
+
+	return hash, nil
+}
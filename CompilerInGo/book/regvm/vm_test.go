@@ -0,0 +1,408 @@
+package regvm
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"strings"
+	"testing"
+)
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+func runRegisterVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("Error while compiling program: %s", err)
+		}
+
+		machine := New(comp.Bytecode())
+		err = machine.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		testExpectedObject(t, tt.input, tt.expected, machine.LastValue())
+	}
+}
+
+func testExpectedObject(t *testing.T, input string, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		result, ok := actual.(*object.Integer)
+		if !ok || result.Value != int64(expected) {
+			t.Errorf("%q: expected integer %d, got %T (%+v)", input, expected, actual, actual)
+		}
+	case bool:
+		result, ok := actual.(*object.Boolean)
+		if !ok || result.Value != expected {
+			t.Errorf("%q: expected boolean %t, got %T (%+v)", input, expected, actual, actual)
+		}
+	case string:
+		result, ok := actual.(*object.String)
+		if !ok || result.Value != expected {
+			t.Errorf("%q: expected string %q, got %T (%+v)", input, expected, actual, actual)
+		}
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok || len(array.Elements) != len(expected) {
+			t.Errorf("%q: expected array %v, got %T (%+v)", input, expected, actual, actual)
+			return
+		}
+		for i, elem := range array.Elements {
+			testExpectedObject(t, input, expected[i], elem)
+		}
+	case []interface{}:
+		array, ok := actual.(*object.Array)
+		if !ok || len(array.Elements) != len(expected) {
+			t.Errorf("%q: expected array %v, got %T (%+v)", input, expected, actual, actual)
+			return
+		}
+		for i, elem := range array.Elements {
+			testExpectedObject(t, input, expected[i], elem)
+		}
+	case object.Null:
+		if actual != nullObj {
+			t.Errorf("%q: expected null, got %T (%+v)", input, actual, actual)
+		}
+	case *object.Error:
+		errObj, ok := actual.(*object.Error)
+		if !ok || errObj.Message != expected.Message {
+			t.Errorf("%q: expected error %q, got %T (%+v)", input, expected.Message, actual, actual)
+		}
+	}
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1", 1},
+		{"1 + 2", 3},
+		{"1 - 2", -1},
+		{"4 / 2", 2},
+		{"50 / 2 * 2 + 10 - 5", 55},
+		{"5 * (2 + 10)", 60},
+		{"-50 + 100 + -50", 0},
+		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestBooleanLogic(t *testing.T) {
+	tests := []vmTestCase{
+		{"true", true},
+		{"1 < 2", true},
+		{"1 > 2", false},
+		{"1 == 1", true},
+		{"1 != 1", false},
+		{"true == false", false},
+		{"(1 < 2) == true", true},
+		{"!true", false},
+		{"!!5", true},
+		{"!(if (false) { 5 })", true},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (true) { 10 }", 10},
+		{"if (false) { 10 } else { 20 }", 20},
+		{"if (1 > 2) { 10 }", object.Null{}},
+		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{"if (true) { }", object.Null{}},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestGlobalsStringsArraysHashes(t *testing.T) {
+	tests := []vmTestCase{
+		{"let one = 1; let two = one + one; one + two", 3},
+		{`"mon" + "key"`, "monkey"},
+		{"[1, 2 * 2, 3 + 3]", []int{1, 4, 6}},
+		{"[1, 2, 3][1]", 2},
+		{"[1, 2, 3][99]", object.Null{}},
+		{"{1: 2, 3: 4}[3]", 4},
+		{"{}[0]", object.Null{}},
+		{"let f = fn(a) { let b = a; let a = 2; [a, b] }; f(1)", []int{2, 1}},
+		{"let f = fn(a) { let a = a; a }; f(1)", object.Null{}},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestGlobalsGrowAsTheyAreSet(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 3*initialGlobals; i++ {
+		fmt.Fprintf(&input, "let %s = %d; ", letterIdentifier(i), i)
+	}
+	input.WriteString(letterIdentifier(0) + " + " + letterIdentifier(3*initialGlobals-1))
+
+	runRegisterVmTests(t, []vmTestCase{{input.String(), 3*initialGlobals - 1}})
+}
+
+func TestFunctionsAndClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn() { 5 + 10 }; f()", 15},
+		{"let f = fn() { return 99; 100 }; f()", 99},
+		{"let f = fn() { }; f()", object.Null{}},
+		{"let f = fn(a, b) { let c = a + b; c * 2 }; f(1, 2)", 6},
+		{"let f = fn(a) { let b = a; let a = 10; a + b }; f(1)", 11},
+		{"let f = fn() { let g = fn() { 7 }; g }; f()()", 7},
+		{"let adder = fn(a, b) { fn(c) { a + b + c } }; adder(1, 2)(3)", 6},
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
+				let c = a + b;
+				fn(d) {
+					let e = d + c;
+					fn(f) { e + f; };
+				};
+			};
+			let newAdderInner = newAdderOuter(1, 2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) { return 0; } else { countDown(x - 1); }
+				};
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x == 0) { return 0 }
+				if (x == 1) { return 1 }
+				fibonacci(x - 1) + fibonacci(x - 2)
+			}
+			fibonacci(15)
+			`,
+			expected: 610,
+		},
+		{"let f = fn(x) { if (x) { let y = 1; y } else { 2 } }; f(true) + f(false)", 3},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestBuiltInFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("four")`, 4},
+		{`len(1)`, &object.Error{Message: "argument to `len` not supported, got INTEGER"}},
+		{`map([1], fn(x) { x })`, []int{1}},
+		{`first([1, 2, 3])`, 1},
+		{`last([1, 2, 3])`, 3},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`push([], 1)`, []int{1}},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestStreams(t *testing.T) {
+	comp := NewCompiler()
+	err := comp.Compile(parse(`let name = gets(); puts("hello " + name, 1); gets()`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	machine := New(comp.Bytecode())
+	machine.SetStreams(object.NewStreams(strings.NewReader("monkey\n"), &out))
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if out.String() != "hello monkey\n1\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+	testExpectedObject(t, "gets()", object.Null{}, machine.LastValue())
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn() { 1 }(1)", "wrong number of arguments: expected 0, got 1"},
+		{"1()", "calling non-closure and non-built-in"},
+		{"-true", "unable to execute minus operator on type BOOLEAN"},
+		{"let x = 0; 1 / x", "division by zero"},
+	}
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestErrorsMatchStackVM(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1] > [2]", "unable to do comparison of types ARRAY and ARRAY"},
+		{`"a" > "b"`, "unable to do comparison of types STRING and STRING"},
+		{"let f = fn(x) { let y = y > 1; y }; f(1)", "unable to do comparison of types NULL and INTEGER"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		stackComp := compiler.New()
+		if err := stackComp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err := vm.New(stackComp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("stack vm: expected error %q, got %v", tt.expected, err)
+		}
+
+		regComp := NewCompiler()
+		if err := regComp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err = New(regComp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("register vm: expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{"map([1, 2, 3], fn(x) { x * 2 })", []int{2, 4, 6}},
+		{"filter([1, 2, 3, 4], fn(x) { x > 2 })", []int{3, 4}},
+		{"reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })", 10},
+		{"sort_by([1, 2, 3, 4], fn(x) { 0 - x })", []int{4, 3, 2, 1}},
+		{"each([1, 2], fn(x) { x })", object.Null{}},
+		{"map([[1], [2, 3]], len)", []int{1, 2}},
+		{"let f = fn(a) { let b = 10; map([1, 2], fn(x) { x + a + b }) }; f(1)", []int{12, 13}},
+		{"map([1, 2], fn(x) { reduce([x, x], 0, fn(a, b) { a + b }) })", []int{2, 4}},
+		{
+			// the recursion grows the register file while map is running
+			input:    "let depth = fn(x) { if (x == 0) { 0 } else { 1 + depth(x - 1) } }; map([5000, 1], depth)",
+			expected: []int{5000, 1},
+		},
+		{"let c = coroutine(fn(x) { x * 2 }); [resume(c, 21), status(c)]", []interface{}{42, "dead"}},
+	}
+
+	runRegisterVmTests(t, tests)
+}
+
+func TestCallbackErrorsStopTheProgram(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"map([1, 2], fn(x) { -true })", "unable to execute minus operator on type BOOLEAN"},
+		{"map([1, 2], fn(x, y) { x })", "wrong number of arguments: expected 2, got 1"},
+		{"let f = fn(n) { map([n], f) }; f(1)", "stack overflow"},
+	}
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let gen = fn() { yield 1 }; generators.next(gen())", "generators are not supported by the register backend, use -engine vm"},
+		{`let m = import "./m"`, "import is not supported by the register backend, use -engine vm"},
+	}
+
+	for _, tt := range tests {
+		err := NewCompiler().Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected compiler error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestMatchesStackVM(t *testing.T) {
+	inputs := []string{
+		"let a = [1, 2, 3]; let f = fn(x) { x * 2 }; [f(a[0]), f(a[1]), f(a[2])]",
+		`let h = {"a": 1, "b": 2}; h["a"] + h["b"]`,
+		"let map = fn(arr, f) { if (len(arr) == 0) { [] } else { push(map(rest(arr), f), f(first(arr))) } }; map([1, 2, 3], fn(x) { x + 1 })",
+	}
+
+	for _, input := range inputs {
+		program := parse(input)
+
+		stackComp := compiler.New()
+		if err := stackComp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		stackMachine := vm.New(stackComp.Bytecode())
+		if err := stackMachine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		regComp := NewCompiler()
+		if err := regComp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		regMachine := New(regComp.Bytecode())
+		if err := regMachine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		expected := stackMachine.LastPoppedStackElem().Inspect()
+		actual := regMachine.LastValue().Inspect()
+		if expected != actual {
+			t.Errorf("%q: stack vm gave %s, register vm gave %s", input, expected, actual)
+		}
+	}
+}
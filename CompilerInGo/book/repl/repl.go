@@ -1,20 +1,31 @@
 package repl
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/regvm"
 	"monkey/vm"
 )
 
 const PROMPT = ">> "
 
+type Options struct {
+	OptimizationLevel compiler.OptimizationLevel
+	// Engine is "vm" for the stack VM or "reg" for the register VM
+	Engine string
+}
+
 func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+	StartWithOptions(in, out, Options{OptimizationLevel: compiler.O1, Engine: "vm"})
+}
+
+func StartWithOptions(in io.Reader, out io.Writer, options Options) {
+	// scripts read the lines of input after the one they are on with gets
+	streams := object.NewStreams(in, out)
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
@@ -25,12 +36,11 @@ func Start(in io.Reader, out io.Writer) {
 
 	for {
 		fmt.Fprint(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, err := streams.ReadLine()
+		if err != nil {
 			return
 		}
 
-		line := scanner.Text()
 		l := lexer.New(line)
 		p := parser.New(l)
 
@@ -40,22 +50,56 @@ func Start(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		// Comiler stuff
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed: \n %s \n", err)
-		}
+		var result object.Object
+		if options.Engine == "reg" {
+			comp := regvm.NewCompilerWithState(symbolTable, constants)
+			err := comp.Compile(program)
+			if err != nil {
+				fmt.Fprintf(out, "Woops! Compilation failed: \n %s \n", err)
+				continue
+			}
 
-		machine := vm.NewWithGlobalStore(comp.Bytecode(), globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Running program failed with error %s", err)
+			bytecode := comp.Bytecode()
+			constants = bytecode.Constants
+
+			machine := regvm.NewWithGlobalStore(bytecode, globals)
+			machine.SetStreams(streams)
+			err = machine.Run()
+			globals = machine.Globals()
+			if err != nil {
+				fmt.Fprintf(out, "Running program failed with error %s\n", err)
+				continue
+			}
+
+			result = machine.LastValue()
+		} else {
+			comp := compiler.NewWithState(symbolTable, constants)
+			comp.SetOptimizationLevel(options.OptimizationLevel)
+			err := comp.Compile(program)
+			if err != nil {
+				fmt.Fprintf(out, "Woops! Compilation failed: \n %s \n", err)
+				continue
+			}
+
+			bytecode := comp.Bytecode()
+			constants = bytecode.Constants
+
+			machine := vm.NewWithGlobalStore(bytecode, globals)
+			machine.SetConfig(object.Config{Streams: streams})
+			err = machine.Run()
+			globals = machine.Globals()
+			if err != nil {
+				fmt.Fprintf(out, "Running program failed with error %s\n", err)
+				continue
+			}
+
+			result = machine.LastPoppedStackElem()
 		}
 
-		stackTop := machine.LastPoppedStackElem()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+		if result != nil {
+			io.WriteString(out, result.Inspect())
+			io.WriteString(out, "\n")
+		}
 
 		// Interpreter stuff
 		// env := object.NewEnvironment()
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/object"
+)
+
+// Rough sizes in bytes of what the Go runtime allocates for each object.
+const (
+	stringSize    = 16
+	arraySize     = 24
+	hashSize      = 48
+	hashEntrySize = 48
+	closureSize   = 32
+	referenceSize = 16
+)
+
+// AllocationStats counts the objects a VM has created and their approximate
+// size. It counts every allocation, not just what is still reachable.
+type AllocationStats struct {
+	Bytes    int
+	Strings  int
+	Arrays   int
+	Hashes   int
+	Closures int
+}
+
+// SetAllocationLimit aborts execution once the VM and the tasks it spawns have
+// allocated more than limit bytes in total, 0 removes the limit. It is a
+// budget for the whole run: objects that are no longer reachable still count,
+// so a long run that keeps creating short-lived values uses it up too.
+func (vm *VM) SetAllocationLimit(limit int) {
+	vm.meter.allocationLimit.Store(int64(limit))
+}
+
+// AllocationStats counts what the VM and the tasks it spawned allocated.
+func (vm *VM) AllocationStats() AllocationStats {
+	return AllocationStats{
+		Bytes:    int(vm.meter.bytes.Load()),
+		Strings:  int(vm.meter.strings.Load()),
+		Arrays:   int(vm.meter.arrays.Load()),
+		Hashes:   int(vm.meter.hashes.Load()),
+		Closures: int(vm.meter.closures.Load()),
+	}
+}
+
+// track accounts for a newly created object and enforces the allocation
+// limit.
+func (vm *VM) track(v Value) error {
+	var size int
+	switch obj := v.obj.(type) {
+	case *object.String:
+		vm.meter.strings.Add(1)
+		size = stringSize + len(obj.Value)
+	case *object.Array:
+		vm.meter.arrays.Add(1)
+		size = arraySize + referenceSize*len(obj.Elements)
+	case *object.Hash:
+		vm.meter.hashes.Add(1)
+		size = hashSize + hashEntrySize*len(obj.Pairs)
+	case *object.Closure:
+		vm.meter.closures.Add(1)
+		size = closureSize + referenceSize*len(obj.Free)
+	default:
+		return nil
+	}
+
+	bytes := vm.meter.bytes.Add(int64(size))
+	if limit := vm.meter.allocationLimit.Load(); limit > 0 && bytes > limit {
+		return fmt.Errorf("allocation limit of %d bytes exceeded", limit)
+	}
+
+	return nil
+}
+
+// trackBuiltinResult accounts for what a builtin returned and the objects
+// nested in it, like the strings in the array split gives. The arguments,
+// their elements and pairs, and what the functions the builtin called gave
+// back exist already and are not counted again.
+func (vm *VM) trackBuiltinResult(result object.Object, args []object.Object, returned []object.Object) error {
+	switch result.(type) {
+	case *object.String, *object.Array, *object.Hash, *object.Closure:
+	default:
+		return nil
+	}
+
+	existing := map[object.Object]bool{}
+	for _, obj := range args {
+		addExisting(existing, obj)
+	}
+	for _, obj := range returned {
+		addExisting(existing, obj)
+	}
+
+	return vm.trackNew(result, existing)
+}
+
+func addExisting(existing map[object.Object]bool, obj object.Object) {
+	existing[obj] = true
+
+	switch obj := obj.(type) {
+	case *object.Array:
+		for _, elem := range obj.Elements {
+			existing[elem] = true
+		}
+	case *object.Hash:
+		for _, pair := range obj.Pairs {
+			existing[pair.Key] = true
+			existing[pair.Value] = true
+		}
+	}
+}
+
+// trackNew accounts for obj and what is nested in it, unless it is one of
+// the objects that exist already. Counted objects are added to them so
+// objects nested twice are only counted once.
+func (vm *VM) trackNew(obj object.Object, existing map[object.Object]bool) error {
+	if existing[obj] {
+		return nil
+	}
+
+	switch obj := obj.(type) {
+	case *object.String, *object.Closure:
+		existing[obj] = true
+		return vm.track(Value{kind: kindObject, obj: obj})
+
+	case *object.Array:
+		existing[obj] = true
+		if err := vm.track(Value{kind: kindObject, obj: obj}); err != nil {
+			return err
+		}
+		for _, elem := range obj.Elements {
+			if err := vm.trackNew(elem, existing); err != nil {
+				return err
+			}
+		}
+
+	case *object.Hash:
+		existing[obj] = true
+		if err := vm.track(Value{kind: kindObject, obj: obj}); err != nil {
+			return err
+		}
+		for _, pair := range obj.Pairs {
+			if err := vm.trackNew(pair.Key, existing); err != nil {
+				return err
+			}
+			if err := vm.trackNew(pair.Value, existing); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
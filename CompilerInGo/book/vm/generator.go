@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/object"
+	"strings"
+)
+
+// generatorStackSize is the initial size of a generator's value stack, which
+// grows like the VM's own.
+const generatorStackSize = 128
+
+// generator is a call of a generator function suspended in the VM. It has a
+// frame stack and a value stack of its own, which the resuming VM switches to
+// while the generator runs.
+type generator struct {
+	constants []Value
+
+	stack        []Value
+	stackPointer int
+	frames       []*Frame
+	frameIndex   int
+
+	started bool
+}
+
+// callGenerator replaces the closure and its arguments on the stack with a
+// generator that runs the closure.
+func (vm *VM) callGenerator(closure *object.Closure, numArgs int) error {
+	g := &generator{
+		constants:  vm.constants,
+		stack:      make([]Value, max(generatorStackSize, 1+closure.Fn.NumLocals)),
+		frames:     make([]*Frame, min(initialFrames, vm.limits.MaxFrames)),
+		frameIndex: 1,
+	}
+
+	// the same layout as a call, the closure first and its locals after it
+	copy(g.stack, vm.stack[vm.stackPointer-1-numArgs:vm.stackPointer])
+	g.frames[0] = NewFrame(closure, 1)
+	g.stackPointer = 1 + closure.Fn.NumLocals
+
+	vm.stackPointer = vm.stackPointer - 1 - numArgs
+	return vm.push(Value{kind: kindObject, obj: object.NewGenerator(closure.Fn.Name, g)})
+}
+
+// Resume runs the generator on the VM resuming it. Errors stop the resuming
+// program like those of calls made by builtins, listing the calls that were
+// active in the generator.
+func (g *generator) Resume(caller object.Caller, sent object.Object) (object.Object, bool, error) {
+	vm, ok := caller.(*VM)
+	if !ok {
+		return nil, true, fmt.Errorf("generator cannot be resumed in this engine")
+	}
+
+	value, done, err := vm.resume(g, sent)
+	if err != nil {
+		vm.callbackErr = err
+		return value, done, err
+	}
+	// what the generator yields was accounted for when it was created
+	vm.returned = append(vm.returned, value)
+	return value, done, nil
+}
+
+func (vm *VM) resume(g *generator, sent object.Object) (object.Object, bool, error) {
+	constants, stack, stackPointer, frames, frameIndex := vm.constants, vm.stack, vm.stackPointer, vm.frames, vm.frameIndex
+	vm.constants, vm.stack, vm.stackPointer, vm.frames, vm.frameIndex = g.constants, g.stack, g.stackPointer, g.frames, g.frameIndex
+
+	defer func() {
+		// the stacks may have grown while the generator ran
+		g.stack, g.stackPointer, g.frames, g.frameIndex = vm.stack, vm.stackPointer, vm.frames, vm.frameIndex
+		vm.constants, vm.stack, vm.stackPointer, vm.frames, vm.frameIndex = constants, stack, stackPointer, frames, frameIndex
+	}()
+
+	if g.started {
+		// the value of the yield expression the generator stopped at
+		err := vm.push(FromObject(sent))
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	g.started = true
+
+	vm.traced = false
+	err := vm.run(0)
+	if err != nil {
+		return nil, true, vm.traceError(err)
+	}
+
+	if vm.yielded {
+		vm.yielded = false
+		return vm.pop().Object(), false, nil
+	}
+
+	return vm.pop().Object(), true, nil
+}
+
+// traceError adds the calls on the generator's frame stack to an error that
+// does not list them yet.
+func (vm *VM) traceError(err error) error {
+	if vm.traced {
+		vm.traced = false
+		return err
+	}
+	if err == object.ErrCancelled || err == object.ErrBudgetExhausted {
+		return err
+	}
+
+	var calls strings.Builder
+	vm.writeCalls(&calls)
+	return fmt.Errorf("%w%s", err, calls.String())
+}
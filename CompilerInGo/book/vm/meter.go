@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"monkey/object"
+	"sync/atomic"
+)
+
+// meter counts what a VM and the tasks it spawns use together, so running
+// tasks side by side does not multiply the instruction budget or the
+// allocation limit. Tasks run on goroutines of their own, so it is updated
+// atomically.
+type meter struct {
+	budget          atomic.Int64 // maximum number of instructions, 0 for no limit
+	executed        atomic.Int64
+	allocationLimit atomic.Int64 // maximum number of bytes allocated over the run, 0 for no limit
+
+	bytes    atomic.Int64
+	strings  atomic.Int64
+	arrays   atomic.Int64
+	hashes   atomic.Int64
+	closures atomic.Int64
+}
+
+// checkpoint is reached before the first instruction of a run and then at
+// least every object.CancelCheckInterval instructions. It hands the meter the
+// instructions executed since the last one and stops the run once the budget
+// is used up or done is closed. The next checkpoint is no further away than
+// what is left of the budget, so a VM without tasks stops right at its end.
+func (vm *VM) checkpoint(done <-chan struct{}) error {
+	executed := vm.flush()
+
+	next := object.CancelCheckInterval
+	if budget := vm.meter.budget.Load(); budget > 0 {
+		if executed >= budget {
+			return object.ErrBudgetExhausted
+		}
+		next = int(min(int64(next), budget-executed))
+	}
+
+	if done != nil {
+		select {
+		case <-done:
+			return object.ErrCancelled
+		default:
+		}
+	}
+
+	vm.checkAt = vm.executed + next
+	return nil
+}
+
+// flush adds what the VM executed since it last flushed to the meter, and
+// gives the total of the meter.
+func (vm *VM) flush() int64 {
+	total := vm.meter.executed.Add(int64(vm.executed - vm.flushed))
+	vm.flushed = vm.executed
+	return total
+}
@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"context"
+	"monkey/compiler"
+	"monkey/object"
+	"sync"
+)
+
+// pooledStackSize is the largest stack a Pool keeps, VMs that grew theirs
+// further get a new one so a single deep run does not pin its memory.
+const pooledStackSize = StackSize * 32
+
+// Pool hands out VMs that reuse the stacks, frames and globals of earlier
+// runs. Bytecode compiled once can be run by many goroutines at the same time
+// with a VM each. A Pool is safe for concurrent use.
+type Pool struct {
+	vms sync.Pool
+}
+
+func NewPool() *Pool {
+	return &Pool{}
+}
+
+// Get returns a VM that runs bytecode with the default settings.
+func (p *Pool) Get(bytecode *compiler.Bytecode) *VM {
+	vm, ok := p.vms.Get().(*VM)
+	if !ok {
+		return New(bytecode)
+	}
+
+	vm.reset(bytecode)
+	return vm
+}
+
+// Put hands a VM back for reuse. Nothing the VM returned is affected, but
+// the VM itself must not be used afterwards.
+func (p *Pool) Put(vm *VM) {
+	vm.release()
+	p.vms.Put(vm)
+}
+
+// Run runs bytecode on a VM from the pool and returns the last popped stack
+// element.
+func (p *Pool) Run(ctx context.Context, bytecode *compiler.Bytecode) (object.Object, error) {
+	vm := p.Get(bytecode)
+	defer p.Put(vm)
+
+	err := vm.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.LastPoppedStackElem(), nil
+}
+
+// release drops everything the VM refers to from its run so the garbage
+// collector can have it while the VM waits in a pool.
+func (vm *VM) release() {
+	if cap(vm.stack) > pooledStackSize {
+		vm.stack = make([]Value, StackSize)
+	} else {
+		clear(vm.stack[:cap(vm.stack)])
+	}
+	clear(vm.frames[:cap(vm.frames)])
+	clear(vm.constants)
+
+	if vm.sharedGlobals {
+		vm.globals = make([]object.Object, initialGlobals)
+		vm.sharedGlobals = false
+	} else {
+		clear(vm.globals)
+	}
+
+	if vm.group != nil {
+		vm.group.Done()
+	}
+
+	vm.ctx = nil
+	vm.config = object.Config{}
+	vm.group = nil
+	vm.modules = nil
+}
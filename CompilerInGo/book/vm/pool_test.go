@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"monkey/compiler"
+	"monkey/object"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func compileProgram(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.Bytecode()
+}
+
+func TestPoolResetsVMs(t *testing.T) {
+	pool := NewPool()
+	bytecode := compileProgram(t, "let a = [1, 2]; let f = fn(x) { x * 2 }; f(a[1])")
+
+	for i := 0; i < 3; i++ {
+		vm := pool.Get(bytecode)
+		if vm.frameIndex != 1 || vm.stackPointer != 0 || vm.InstructionsExecuted() != 0 {
+			t.Fatalf("pooled vm not reset. frames=%d, sp=%d", vm.frameIndex, vm.stackPointer)
+		}
+		for i, global := range vm.Globals() {
+			if global != nil {
+				t.Fatalf("global %d survived from an earlier run: %s", i, global.Inspect())
+			}
+		}
+
+		vm.SetInstructionBudget(1000)
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, 4, vm.LastPoppedStackElem())
+
+		pool.Put(vm)
+	}
+}
+
+func TestPoolDoesNotClearSharedGlobals(t *testing.T) {
+	globals := make([]object.Object, GlobalsSize)
+	vm := NewWithGlobalStore(compileProgram(t, "let a = 5;"), globals)
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	NewPool().Put(vm)
+	testExpectedObject(t, 5, globals[0])
+}
+
+var concurrentPrograms = []struct {
+	input    string
+	expected interface{}
+}{
+	{"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(12)", 144},
+	{"let add = fn(a) { fn(b) { a + b } }; let addTwo = add(2); addTwo(40)", 42},
+	{`let h = {"one": 1, "two": 2}; h["one"] + h["two"]`, 3},
+	{"reduce(map([1, 2, 3, 4], fn(x) { x * x }), 0, fn(a, b) { a + b })", 30},
+	{"sort_by([5, 3, 9, 1], fn(x) { x })", []int{1, 3, 5, 9}},
+	{`puts("line"); len(gets())`, 5},
+}
+
+// TestConcurrentRuns runs the same bytecode on many goroutines at once, run
+// it with -race to check that runs share nothing mutable.
+func TestConcurrentRuns(t *testing.T) {
+	bytecodes := make([]*compiler.Bytecode, len(concurrentPrograms))
+	for i, program := range concurrentPrograms {
+		bytecodes[i] = compileProgram(t, program.input)
+	}
+
+	pool := NewPool()
+	runs := 2000
+	if testing.Short() {
+		runs = 200
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, runs)
+
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			program := i % len(bytecodes)
+			var vm *VM
+			if i%2 == 0 {
+				vm = pool.Get(bytecodes[program])
+				defer pool.Put(vm)
+			} else {
+				vm = New(bytecodes[program])
+			}
+
+			var out bytes.Buffer
+			vm.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader("input\n"), &out)})
+			err := vm.RunContext(context.Background())
+			if err != nil {
+				errs <- fmt.Errorf("run %d: %s", i, err)
+				return
+			}
+
+			if err := checkObject(concurrentPrograms[program].expected, vm.LastPoppedStackElem()); err != nil {
+				errs <- fmt.Errorf("run %d: %s", i, err)
+			}
+			if strings.Contains(concurrentPrograms[program].input, "puts") && out.String() != "line\n" {
+				errs <- fmt.Errorf("run %d: wrong output %q", i, out.String())
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentPoolRun(t *testing.T) {
+	bytecode := compileProgram(t, "let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100, 0)")
+	pool := NewPool()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				result, err := pool.Run(context.Background(), bytecode)
+				if err != nil {
+					t.Errorf("run error: %s", err)
+					return
+				}
+				if err := testIntegerObject(5050, result); err != nil {
+					t.Errorf("wrong result: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// checkObject is testExpectedObject for goroutines other than the test's.
+func checkObject(expected interface{}, actual object.Object) error {
+	switch expected := expected.(type) {
+	case int:
+		return testIntegerObject(int64(expected), actual)
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok || len(array.Elements) != len(expected) {
+			return fmt.Errorf("expected %v, got %s", expected, actual.Inspect())
+		}
+		for i, elem := range array.Elements {
+			if err := testIntegerObject(int64(expected[i]), elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"monkey/compiler"
+	"monkey/object"
+)
+
+// TaskGroup makes the VM an object.Spawner, the group lasts until the run
+// that made it ends.
+func (vm *VM) TaskGroup() *object.TaskGroup {
+	if vm.group == nil {
+		vm.group = object.NewTaskGroup(vm.ctx)
+	}
+	return vm.group
+}
+
+// Spawn calls fn on a VM of its own on another goroutine, the returned
+// channel receives the result. Compiled functions and constants are shared
+// with the new VM, globals and imported modules are copied as they are when it
+// starts. The task draws on the instruction budget and the allocation limit
+// of this VM. Runtime errors become the result.
+func (vm *VM) Spawn(fn object.Object, args ...object.Object) (*object.Channel, error) {
+	switch fn.(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return nil, fmt.Errorf("cannot spawn %s", fn.Type())
+	}
+
+	group := vm.TaskGroup()
+
+	task := New(&compiler.Bytecode{})
+	task.constants = append(task.constants, vm.constants...)
+	task.globals = append(make([]object.Object, 0, len(vm.globals)), vm.globals...)
+	if vm.modules != nil {
+		task.modules = maps.Clone(vm.modules)
+	}
+	task.SetLimits(vm.limits)
+	task.meter = vm.meter
+	task.config = vm.config
+	task.ctx = group.Context()
+	task.group = group
+
+	return group.Go(func() (result object.Object) {
+		// a panic, like one in a host function, fails the task alone
+		defer func() {
+			if r := recover(); r != nil {
+				result = &object.Error{Message: fmt.Sprintf("panic: %v", r)}
+			}
+		}()
+
+		result, err := task.Call(fn, args...)
+		task.flush()
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		if result == nil {
+			return nullObj
+		}
+		return result
+	}), nil
+}
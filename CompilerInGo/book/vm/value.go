@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"monkey/object"
+)
+
+type valueKind byte
+
+const (
+	kindNull valueKind = iota
+	kindInteger
+	kindBoolean
+	kindObject
+)
+
+// Value is a stack or global slot. Integers, booleans and null live inline so
+// arithmetic and comparisons never allocate; everything else is carried as an
+// object.Object. The zero Value is null.
+type Value struct {
+	kind    valueKind
+	integer int64 // the integer, or 1/0 for booleans
+	obj     object.Object
+}
+
+var NullValue = Value{kind: kindNull}
+
+func IntegerValue(i int64) Value {
+	return Value{kind: kindInteger, integer: i}
+}
+
+func BooleanValue(b bool) Value {
+	if b {
+		return Value{kind: kindBoolean, integer: 1}
+	}
+	return Value{kind: kindBoolean}
+}
+
+// FromObject unboxes integers, booleans and null so they are stored inline.
+func FromObject(obj object.Object) Value {
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return NullValue
+	case *object.Integer:
+		return IntegerValue(obj.Value)
+	case *object.Boolean:
+		return BooleanValue(obj.Value)
+	default:
+		return Value{kind: kindObject, obj: obj}
+	}
+}
+
+// Object boxes the value for code outside the VM, such as builtins, arrays and
+// hashes. Small integers come from the shared object.NewInteger cache.
+func (v Value) Object() object.Object {
+	switch v.kind {
+	case kindInteger:
+		return object.NewInteger(v.integer)
+	case kindBoolean:
+		return nativeBoolToBooleanObject(v.integer == 1)
+	case kindObject:
+		return v.obj
+	default:
+		return nullObj
+	}
+}
+
+func (v Value) Type() object.ObjectType {
+	switch v.kind {
+	case kindInteger:
+		return object.INTEGER_OBJ
+	case kindBoolean:
+		return object.BOOLEAN_OBJ
+	case kindObject:
+		return v.obj.Type()
+	default:
+		return object.NULL_OBJ
+	}
+}
+
+func (v Value) IsTruthy() bool {
+	switch v.kind {
+	case kindBoolean:
+		return v.integer == 1
+	case kindNull:
+		return false
+	default:
+		return true
+	}
+}
+
+// identical is the equality used for non-integer operands of == and !=:
+// booleans and null by value, everything else by identity.
+func (v Value) identical(other Value) bool {
+	if v.kind != other.kind {
+		return false
+	}
+
+	if v.kind == kindObject {
+		return v.obj == other.obj
+	}
+
+	return v.integer == other.integer
+}
+
+func valuesToObjects(values []Value) []object.Object {
+	objects := make([]object.Object, len(values))
+	for i, v := range values {
+		objects[i] = v.Object()
+	}
+	return objects
+}
@@ -1,68 +1,325 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
+	"strings"
 )
 
+// StackSize is the initial size of the stack, which grows on demand up to the
+// VM's Limits. Globals grow as they are set, GlobalsSize is a size for global
+// stores shared between runs that rarely has to grow.
 const StackSize = 2048
 const GlobalsSize uint = 65536
-const MaxFrames = 1024
+const initialFrames = 64
+const initialGlobals = 64
+
+// Limits bounds how far the value stack and the frame stack may grow.
+type Limits struct {
+	MaxStackSize int
+	MaxFrames    int
+}
+
+var DefaultLimits = Limits{MaxStackSize: 1 << 20, MaxFrames: 1 << 16}
+
+// stackTraceDepth is how many of the innermost frames a stack overflow lists
+const stackTraceDepth = 10
 
 var trueObj = &object.Boolean{Value: true}
 var falseObj = &object.Boolean{Value: false}
 var nullObj = &object.Null{}
 
 type VM struct {
-	constants []object.Object
+	constants []Value
 
-	stack        []object.Object
+	stack        []Value
 	stackPointer int // points to next free spot or last popped
 	globals      []object.Object
 
 	frames     []*Frame
 	frameIndex int
-}
 
-func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
-	mainClosure := &object.Closure{Fn: mainFn}
-	mainFrame := NewFrame(mainClosure, 0)
-	frames := make([]*Frame, MaxFrames)
-	frames[0] = mainFrame
+	limits Limits
+
+	meter    *meter // shared with the tasks the VM spawns
+	executed int    // by this VM, the meter has them up to flushed
+	flushed  int
+	checkAt  int // when the next checkpoint is due
 
-	return &VM{
-		constants: bytecode.Constants,
+	ctx         context.Context
+	callbackErr error           // first error from a call made by the running builtin
+	returned    []object.Object // what the calls made by the running builtins gave back
+	yielded     bool            // set by OpYield, which stops the run of the generator
+	traced      bool            // the error being returned lists the calls on the frame stack
+	running     bool            // RunContext is running the program
+	stopped     error           // the stop that ended the program inside a builtin
 
-		stack:        make([]object.Object, StackSize),
-		stackPointer: 0,
+	config  object.Config                               // with the defaults filled in
+	group   *object.TaskGroup                           // made when the program first spawns or makes a channel
+	modules map[*object.CompiledFunction]*object.Module // the modules imported so far, by the function running them
 
-		globals: make([]object.Object, GlobalsSize),
+	sharedGlobals bool // the globals belong to whoever passed them in
+}
 
-		frames:     frames,
-		frameIndex: 1,
+// New creates a VM for one run of bytecode. The bytecode is only read, so
+// VMs on different goroutines can run the same bytecode at once.
+func New(bytecode *compiler.Bytecode) *VM {
+	vm := &VM{
+		stack:   make([]Value, StackSize),
+		globals: make([]object.Object, initialGlobals),
+		frames:  make([]*Frame, initialFrames),
 	}
+	vm.reset(bytecode)
+	return vm
 }
 
 func NewWithGlobalStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
-	vm := New(bytecode)
-	vm.globals = globals
+	vm := &VM{
+		stack:   make([]Value, StackSize),
+		globals: globals,
+		frames:  make([]*Frame, initialFrames),
+
+		sharedGlobals: true,
+	}
+	vm.reset(bytecode)
 	return vm
 }
 
+// reset prepares the VM to run bytecode from the start with the default
+// settings, keeping the stacks it has already allocated.
+func (vm *VM) reset(bytecode *compiler.Bytecode) {
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, Name: "<main>"}
+	vm.frames = vm.frames[:cap(vm.frames)]
+	vm.frames[0] = NewFrame(&object.Closure{Fn: mainFn}, 0)
+	vm.frameIndex = 1
+
+	vm.constants = vm.constants[:0]
+	for _, c := range bytecode.Constants {
+		vm.constants = append(vm.constants, FromObject(c))
+	}
+
+	vm.stack = vm.stack[:cap(vm.stack)]
+	vm.stackPointer = 0
+
+	vm.limits = DefaultLimits
+	vm.meter = &meter{}
+	vm.executed = 0
+	vm.flushed = 0
+	vm.checkAt = 0
+	vm.ctx = context.Background()
+	vm.callbackErr = nil
+	vm.returned = vm.returned[:0]
+	vm.yielded = false
+	vm.traced = false
+	vm.running = false
+	vm.stopped = nil
+	vm.config = object.Config{}.WithDefaults()
+	vm.group = nil
+	vm.modules = nil
+}
+
+// SetLimits bounds the stacks of the VM, a limit left at zero is the one of
+// DefaultLimits.
+func (vm *VM) SetLimits(limits Limits) {
+	if limits.MaxStackSize == 0 {
+		limits.MaxStackSize = DefaultLimits.MaxStackSize
+	}
+	if limits.MaxFrames == 0 {
+		limits.MaxFrames = DefaultLimits.MaxFrames
+	}
+	vm.limits = limits
+
+	if len(vm.stack) > limits.MaxStackSize {
+		vm.stack = vm.stack[:limits.MaxStackSize]
+	}
+	if len(vm.frames) > limits.MaxFrames {
+		vm.frames = vm.frames[:limits.MaxFrames]
+	}
+}
+
+// Globals returns the global store, which is replaced when it has to grow.
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// SetConfig sets the streams, file access, clock and random numbers the
+// builtins called by the program use.
+func (vm *VM) SetConfig(config object.Config) {
+	vm.config = config.WithDefaults()
+}
+
+func (vm *VM) Config() object.Config {
+	return vm.config
+}
+
+func (vm *VM) Streams() *object.Streams {
+	return vm.config.Streams
+}
+
+func (vm *VM) Sandbox() *object.Sandbox {
+	return vm.config.Sandbox
+}
+
+func (vm *VM) Clock() object.Clock {
+	return vm.config.Clock
+}
+
+func (vm *VM) Random() *object.Random {
+	return vm.config.Random
+}
+
+// Context is the context of the run in progress.
+func (vm *VM) Context() context.Context {
+	return vm.ctx
+}
+
 func (vm *VM) LastPoppedStackElem() object.Object {
-	return vm.stack[vm.stackPointer]
+	return vm.stack[vm.stackPointer].Object()
+}
+
+// SetInstructionBudget limits how many instructions the VM and the tasks it
+// spawns execute over all its runs, 0 removes the limit.
+func (vm *VM) SetInstructionBudget(budget int) {
+	vm.meter.budget.Store(int64(budget))
+	vm.checkAt = vm.executed
+}
+
+// InstructionsExecuted counts the instructions of the VM and of the tasks it
+// spawned, as far as they have reached a checkpoint.
+func (vm *VM) InstructionsExecuted() int {
+	return int(vm.meter.executed.Load()) + vm.executed - vm.flushed
 }
 
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext runs until the program ends, ctx is done or the instruction
+// budget runs out. It stops in between instructions with object.ErrCancelled
+// or object.ErrBudgetExhausted, and calling it again resumes the program.
+// A stop inside a call made by a builtin, such as the function passed to map,
+// ends the program instead, as the builtin cannot pick up where it was; later
+// calls return the same error.
+func (vm *VM) RunContext(ctx context.Context) error {
+	if vm.stopped != nil {
+		return vm.stopped
+	}
+
+	vm.ctx = ctx
+	vm.checkAt = vm.executed
+	vm.running = true
+	err := vm.run(0)
+	vm.running = false
+
+	// tasks the program spawned end with it, unless it is to be resumed
+	if vm.group != nil && (err != object.ErrBudgetExhausted || vm.stopped != nil) {
+		vm.group.Done()
+		vm.group = nil
+	}
+
+	return err
+}
+
+// CallClosure calls closure with args and runs it to completion, on top of
+// whatever the VM is in the middle of. Hosts can call it between runs and
+// builtins through Call while one is running. A call stopped by the context
+// or the instruction budget cannot be resumed.
+func (vm *VM) CallClosure(closure *object.Closure, args ...object.Object) (object.Object, error) {
+	stopAt := vm.frameIndex
+	base := vm.stackPointer
+
+	err := vm.push(Value{kind: kindObject, obj: closure})
+	for _, arg := range args {
+		if err != nil {
+			break
+		}
+		err = vm.push(FromObject(arg))
+	}
+	if err == nil {
+		err = vm.callClosure(closure, len(args))
+	}
+	if err == nil {
+		err = vm.run(stopAt)
+	}
+	if err != nil {
+		vm.frameIndex = stopAt
+		vm.stackPointer = base
+		return nil, err
+	}
+
+	return vm.pop().Object(), nil
+}
+
+// Call makes the VM an object.Caller for builtins. An error stops the
+// builtin's caller too, as it would have had the call been made in Monkey.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	var result object.Object
+	var err error
+
+	switch fn := fn.(type) {
+	case *object.Closure:
+		result, err = vm.CallClosure(fn, args...)
+	case *object.Builtin:
+		result, err = vm.applyBuiltin(fn, args)
+	default:
+		err = fmt.Errorf("calling non-closure and non-built-in")
+	}
+
+	if err != nil {
+		vm.callbackErr = err
+		return result, err
+	}
+	vm.returned = append(vm.returned, result)
+	return result, nil
+}
+
+// applyBuiltin calls builtin and accounts for the objects it creates.
+func (vm *VM) applyBuiltin(builtin *object.Builtin, args []object.Object) (object.Object, error) {
+	previous := vm.callbackErr
+	vm.callbackErr = nil
+	mark := len(vm.returned)
+
+	result := builtin.Call(vm, args...)
+	err := vm.callbackErr
+	vm.callbackErr = previous
+	returned := vm.returned[mark:]
+	defer func() {
+		clear(vm.returned[mark:])
+		vm.returned = vm.returned[:mark]
+	}()
+
+	if err != nil {
+		if vm.running && (err == object.ErrBudgetExhausted || err == object.ErrCancelled) {
+			vm.stopped = err
+		}
+		return nil, err
+	}
+	if err := vm.trackBuiltinResult(result, args, returned); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// run executes instructions until the frame stack drops to stopAt frames, or
+// the main function ends when stopAt is 0.
+func (vm *VM) run(stopAt int) error {
+	done := vm.ctx.Done()
 
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
-	for vm.currentFrame().instructionPointer < len(vm.currentFrame().Instructions())-1 {
+	for vm.frameIndex > stopAt && vm.currentFrame().instructionPointer < len(vm.currentFrame().Instructions())-1 {
+		if vm.executed >= vm.checkAt {
+			if err := vm.checkpoint(done); err != nil {
+				return err
+			}
+		}
+		vm.executed++
+
 		vm.currentFrame().instructionPointer++
 
 		ip = vm.currentFrame().instructionPointer
@@ -79,17 +336,17 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpTrue:
-			err := vm.push(trueObj)
+			err := vm.push(BooleanValue(true))
 			if err != nil {
 				return err
 			}
 		case code.OpFalse:
-			err := vm.push(falseObj)
+			err := vm.push(BooleanValue(false))
 			if err != nil {
 				return err
 			}
 		case code.OpNull:
-			err := vm.push(nullObj)
+			err := vm.push(NullValue)
 			if err != nil {
 				return err
 			}
@@ -106,7 +363,7 @@ func (vm *VM) Run() error {
 		case code.OpReturn:
 			frame := vm.popFrame()
 			vm.stackPointer = frame.basePointer - 1
-			err := vm.push(nullObj)
+			err := vm.push(NullValue)
 			if err != nil {
 				return err
 			}
@@ -119,12 +376,23 @@ func (vm *VM) Run() error {
 			pos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().instructionPointer += 2
 			condition := vm.pop()
-			if !isTruthy(condition) {
+			if !condition.IsTruthy() {
+				vm.currentFrame().instructionPointer = pos - 1
+			}
+
+		case code.OpJumpTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().instructionPointer += 2
+			condition := vm.pop()
+			if condition.IsTruthy() {
 				vm.currentFrame().instructionPointer = pos - 1
 			}
 
 		case code.OpAdd, code.OpSub, code.OpDiv, code.OpMul:
-			vm.executeBinaryOperation(op)
+			err := vm.executeBinaryOperation(op)
+			if err != nil {
+				return err
+			}
 
 		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
 			err := vm.executeComparrison(op)
@@ -147,12 +415,12 @@ func (vm *VM) Run() error {
 		case code.OpSetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().instructionPointer += 2
-			vm.globals[globalIndex] = vm.pop()
+			vm.setGlobal(int(globalIndex), vm.pop())
 
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().instructionPointer += 2
-			err := vm.push(vm.globals[globalIndex])
+			err := vm.push(vm.getGlobal(int(globalIndex)))
 			if err != nil {
 				return err
 			}
@@ -160,10 +428,13 @@ func (vm *VM) Run() error {
 		case code.OpArray:
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().instructionPointer += 2
-			array := vm.buildArray(vm.stackPointer-numElements, vm.stackPointer)
+			array, err := vm.buildArray(vm.stackPointer-numElements, vm.stackPointer)
+			if err != nil {
+				return err
+			}
 
 			vm.stackPointer = vm.stackPointer - numElements
-			err := vm.push(array)
+			err = vm.push(array)
 			if err != nil {
 				return err
 			}
@@ -180,6 +451,24 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpImport:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().instructionPointer += 2
+
+			err := vm.executeImport(int(constIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpModule:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().instructionPointer += 2
+
+			err := vm.buildModule(numElements)
+			if err != nil {
+				return err
+			}
+
 		case code.OpIndex:
 			index := vm.pop()
 			left := vm.pop()
@@ -197,6 +486,20 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().instructionPointer += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpYield:
+			// the yielded value stays on the generator's stack for resume
+			vm.yielded = true
+			return nil
+
 		case code.OpSetLocal:
 			localIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().instructionPointer += 1
@@ -219,14 +522,17 @@ func (vm *VM) Run() error {
 			vm.currentFrame().instructionPointer += 1
 
 			builtIn := object.BuiltIns[builtInIndex]
-			vm.push(builtIn.Builtin)
+			err := vm.push(Value{kind: kindObject, obj: builtIn.Builtin})
+			if err != nil {
+				return err
+			}
 
 		case code.OpGetFree:
 			freeIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().instructionPointer += 1
 			currentClosure := vm.currentFrame().closure
 
-			err := vm.push(currentClosure.Free[freeIndex])
+			err := vm.push(FromObject(currentClosure.Free[freeIndex]))
 			if err != nil {
 				return err
 			}
@@ -242,49 +548,230 @@ func (vm *VM) Run() error {
 
 		case code.OpCurrentClosure:
 			closure := vm.currentFrame().closure
-			err := vm.push(closure)
+			err := vm.push(Value{kind: kindObject, obj: closure})
 			if err != nil {
 				return err
 			}
 		case code.OpPop:
 			vm.pop()
+
+		case code.OpGetLocalAddConst, code.OpGetLocalSubConst:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			constIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().instructionPointer += 3
+
+			left := vm.stack[vm.currentFrame().basePointer+int(localIndex)]
+			err := vm.executeLocalConstOperation(op, left, vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetLocalGetLocal:
+			firstIndex := code.ReadUint8(ins[ip+1:])
+			secondIndex := code.ReadUint8(ins[ip+2:])
+			vm.currentFrame().instructionPointer += 2
+
+			basePointer := vm.currentFrame().basePointer
+			err := vm.push(vm.stack[basePointer+int(firstIndex)])
+			if err != nil {
+				return err
+			}
+			err = vm.push(vm.stack[basePointer+int(secondIndex)])
+			if err != nil {
+				return err
+			}
+
+		case code.OpWide:
+			err := vm.executeWide(ins, ip)
+			if err != nil {
+				return err
+			}
+
+		case code.OpJumpNotEqual, code.OpJumpNotGreaterThan:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().instructionPointer += 2
+
+			right := vm.pop()
+			left := vm.pop()
+
+			compareOp := code.OpEqual
+			if op == code.OpJumpNotGreaterThan {
+				compareOp = code.OpGreaterThan
+			}
+
+			result, err := compareValues(compareOp, left, right)
+			if err != nil {
+				return err
+			}
+			if !result {
+				vm.currentFrame().instructionPointer = pos - 1
+			}
 		}
 	}
 
 	return nil
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
-	default:
-		return true
+// executeWide runs the instruction following an OpWide prefix, whose operands
+// are twice as wide as usual.
+func (vm *VM) executeWide(ins code.Instructions, ip int) error {
+	op := code.Opcode(ins[ip+1])
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return err
+	}
+
+	operands, read := code.ReadOperands(code.WideDefinition(def), ins[ip+2:])
+	frame := vm.currentFrame()
+	frame.instructionPointer += 1 + read
+
+	switch op {
+	case code.OpConstant:
+		return vm.push(vm.constants[operands[0]])
+
+	case code.OpGetGlobal:
+		return vm.push(vm.getGlobal(operands[0]))
+
+	case code.OpSetGlobal:
+		vm.setGlobal(operands[0], vm.pop())
+		return nil
+
+	case code.OpGetLocal:
+		return vm.push(vm.stack[frame.basePointer+operands[0]])
+
+	case code.OpSetLocal:
+		vm.stack[frame.basePointer+operands[0]] = vm.pop()
+		return nil
+
+	case code.OpGetBuiltIn:
+		return vm.push(Value{kind: kindObject, obj: object.BuiltIns[operands[0]].Builtin})
+
+	case code.OpGetFree:
+		return vm.push(FromObject(frame.closure.Free[operands[0]]))
+
+	case code.OpArray:
+		array, err := vm.buildArray(vm.stackPointer-operands[0], vm.stackPointer)
+		if err != nil {
+			return err
+		}
+		vm.stackPointer = vm.stackPointer - operands[0]
+		return vm.push(array)
+
+	case code.OpHash:
+		hash, err := vm.buildHash(vm.stackPointer-operands[0], vm.stackPointer)
+		if err != nil {
+			return err
+		}
+		vm.stackPointer = vm.stackPointer - operands[0]
+		return vm.push(hash)
+
+	case code.OpImport:
+		return vm.executeImport(operands[0])
+
+	case code.OpModule:
+		return vm.buildModule(operands[0])
+
+	case code.OpCall:
+		return vm.executeCall(operands[0])
+
+	case code.OpTailCall:
+		return vm.executeTailCall(operands[0])
+
+	case code.OpClosure:
+		return vm.pushClosure(operands[0], operands[1])
+
+	case code.OpJump:
+		frame.instructionPointer = operands[0] - 1
+		return nil
+
+	case code.OpJumpNotTruthy, code.OpJumpTruthy:
+		if vm.pop().IsTruthy() == (op == code.OpJumpTruthy) {
+			frame.instructionPointer = operands[0] - 1
+		}
+		return nil
+
+	case code.OpJumpNotEqual, code.OpJumpNotGreaterThan:
+		right := vm.pop()
+		left := vm.pop()
+
+		compareOp := code.OpEqual
+		if op == code.OpJumpNotGreaterThan {
+			compareOp = code.OpGreaterThan
+		}
+
+		result, err := compareValues(compareOp, left, right)
+		if err != nil {
+			return err
+		}
+		if !result {
+			frame.instructionPointer = operands[0] - 1
+		}
+		return nil
+	}
+
+	return fmt.Errorf("opcode %s has no wide form", def.Name)
+}
+
+// executeImport pushes the module run by the function at constIndex, calling
+// the function if this is the first import of the module in the run.
+func (vm *VM) executeImport(constIndex int) error {
+	fn, ok := vm.constants[constIndex].obj.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a module: %+v", vm.constants[constIndex].obj)
+	}
+
+	if module, ok := vm.modules[fn]; ok {
+		return vm.push(Value{kind: kindObject, obj: module})
+	}
+
+	closure := &object.Closure{Fn: fn}
+	err := vm.push(Value{kind: kindObject, obj: closure})
+	if err != nil {
+		return err
+	}
+	return vm.callClosure(closure, 0)
+}
+
+// buildModule replaces the export names and values on the stack with the
+// module of the running module function.
+func (vm *VM) buildModule(numElements int) error {
+	exports := make(map[string]object.Object, numElements/2)
+	for i := vm.stackPointer - numElements; i < vm.stackPointer; i += 2 {
+		exports[vm.stack[i].obj.(*object.String).Value] = vm.stack[i+1].Object()
 	}
+	vm.stackPointer = vm.stackPointer - numElements
+
+	fn := vm.currentFrame().closure.Fn
+	module := &object.Module{Name: fn.Name, Exports: exports}
+	if vm.modules == nil {
+		vm.modules = map[*object.CompiledFunction]*object.Module{}
+	}
+	vm.modules[fn] = module
+
+	return vm.push(Value{kind: kindObject, obj: module})
 }
 
 func (vm *VM) pushClosure(constIndex, numFree int) error {
-	constant := vm.constants[constIndex]
+	constant := vm.constants[constIndex].obj
 	function, ok := constant.(*object.CompiledFunction)
 	if !ok {
 		return fmt.Errorf("not a function: %+v", constant)
 	}
 
-	free := make([]object.Object, numFree)
-	for i := 0; i < numFree; i++ {
-		free[i] = vm.stack[vm.stackPointer-numFree+i]
-	}
-
+	free := valuesToObjects(vm.stack[vm.stackPointer-numFree : vm.stackPointer])
 	vm.stackPointer = vm.stackPointer - numFree
 
-	closure := &object.Closure{Fn: function, Free: free}
+	closure := Value{kind: kindObject, obj: &object.Closure{Fn: function, Free: free}}
+	err := vm.track(closure)
+	if err != nil {
+		return err
+	}
+
 	return vm.push(closure)
 }
 
 func (vm *VM) executeCall(numArgs int) error {
-	callee := vm.stack[vm.stackPointer-1-numArgs]
+	callee := vm.stack[vm.stackPointer-1-numArgs].obj
 	switch callee := callee.(type) {
 	case *object.Closure:
 		return vm.callClosure(callee, int(numArgs))
@@ -296,28 +783,66 @@ func (vm *VM) executeCall(numArgs int) error {
 	}
 }
 
-func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
-	args := vm.stack[vm.stackPointer-numArgs : vm.stackPointer]
-	result := builtin.Fn(args...)
+// executeTailCall calls a closure in place of the current frame, which is
+// free to go since the caller returns whatever the callee does. Builtins are
+// called normally and the OpReturnValue after the tail call returns the result.
+func (vm *VM) executeTailCall(numArgs int) error {
+	closure, ok := vm.stack[vm.stackPointer-1-numArgs].obj.(*object.Closure)
+	if !ok || vm.frameIndex == 1 || closure.Fn.IsGenerator {
+		return vm.executeCall(numArgs)
+	}
 
-	vm.stackPointer = vm.stackPointer - 1 - numArgs
+	if numArgs != closure.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: expected %d, got %d", closure.Fn.NumParameters, numArgs)
+	}
+
+	frame := vm.currentFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.stackPointer-1-numArgs:vm.stackPointer])
 
-	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(nullObj)
+	err := vm.ensureStack(frame.basePointer + closure.Fn.NumLocals)
+	if err != nil {
+		return err
 	}
 
+	frame.closure = closure
+	frame.instructionPointer = -1
+	vm.stackPointer = frame.basePointer + closure.Fn.NumLocals
+
 	return nil
 }
 
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := valuesToObjects(vm.stack[vm.stackPointer-numArgs : vm.stackPointer])
+
+	result, err := vm.applyBuiltin(builtin, args)
+	if err != nil {
+		return err
+	}
+
+	vm.stackPointer = vm.stackPointer - 1 - numArgs
+
+	return vm.push(FromObject(result))
+}
+
 func (vm *VM) callClosure(closure *object.Closure, numArgs int) error {
 	if numArgs != closure.Fn.NumParameters {
 		return fmt.Errorf("wrong number of arguments: expected %d, got %d", closure.Fn.NumParameters, numArgs)
 	}
 
+	if closure.Fn.IsGenerator {
+		return vm.callGenerator(closure, numArgs)
+	}
+
 	frame := NewFrame(closure, vm.stackPointer-numArgs)
-	vm.pushFrame(frame)
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	err = vm.ensureStack(frame.basePointer + closure.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
 	vm.stackPointer = frame.basePointer + closure.Fn.NumLocals
 
 	return nil
@@ -327,9 +852,20 @@ func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.frameIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.frameIndex >= len(vm.frames) {
+		if vm.frameIndex >= vm.limits.MaxFrames {
+			return vm.stackOverflow()
+		}
+
+		frames := make([]*Frame, min(len(vm.frames)*2, vm.limits.MaxFrames))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
+
 	vm.frames[vm.frameIndex] = f
 	vm.frameIndex++
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -340,90 +876,100 @@ func (vm *VM) popFrame() *Frame {
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
+	if operand.kind != kindInteger {
 		return fmt.Errorf("unable to execute minus operator on type %s", operand.Type())
 	}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(IntegerValue(-operand.integer))
 }
 
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
-	if isTruthy(operand) {
-		return vm.push(falseObj)
-	} else {
-		return vm.push(trueObj)
-	}
+	return vm.push(BooleanValue(!operand.IsTruthy()))
 }
 
 func (vm *VM) executeComparrison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
-		return vm.executeIntegerComparison(op, left, right)
-	}
-
-	switch op {
-	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(left == right))
-	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(left != right))
+	result, err := compareValues(op, left, right)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("unable to do comparrison of types %T and %T", left, right)
+	return vm.push(BooleanValue(result))
 }
 
-func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+func compareValues(op code.Opcode, left, right Value) (bool, error) {
+	if left.kind == kindInteger && right.kind == kindInteger {
+		switch op {
+		case code.OpEqual:
+			return left.integer == right.integer, nil
+		case code.OpNotEqual:
+			return left.integer != right.integer, nil
+		case code.OpGreaterThan:
+			return left.integer > right.integer, nil
+		default:
+			return false, fmt.Errorf("unknown operator on integers: %d", op)
+		}
+	}
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(leftVal == rightVal))
+		return left.identical(right), nil
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(leftVal != rightVal))
-	case code.OpGreaterThan:
-		return vm.push(nativeBoolToBooleanObject(leftVal > rightVal))
-	default:
-		return fmt.Errorf("unknown operator on integers: %d", op)
+		return !left.identical(right), nil
 	}
+
+	return false, fmt.Errorf("unable to do comparison of types %s and %s", left.Type(), right.Type())
 }
 
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	leftType := left.Type()
-	rightType := right.Type()
+	result, err := binaryOperation(op, left, right)
+	if err != nil {
+		return err
+	}
 
-	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
-		return vm.executeIntegerBinaryOperation(op, left, right)
+	if result.kind == kindObject {
+		err = vm.track(result)
+		if err != nil {
+			return err
+		}
 	}
 
+	return vm.push(result)
+}
+
+func binaryOperation(op code.Opcode, left, right Value) (Value, error) {
+	if left.kind == kindInteger && right.kind == kindInteger {
+		return integerBinaryOperation(op, left.integer, right.integer)
+	}
+
+	leftType := left.Type()
+	rightType := right.Type()
+
 	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
-		return vm.executeStringBinaryOperation(op, left, right)
+		return stringBinaryOperation(op, left, right)
 	}
 
-	return fmt.Errorf("unknown operator %d on type %s and %s", op, leftType, rightType)
+	return NullValue, fmt.Errorf("unknown operator %d on type %s and %s", op, leftType, rightType)
 }
 
-func (vm *VM) executeStringBinaryOperation(op code.Opcode, left, right object.Object) error {
+func stringBinaryOperation(op code.Opcode, left, right Value) (Value, error) {
 	if op != code.OpAdd {
-		return fmt.Errorf("unable to do operation %q on strings", op)
+		return NullValue, fmt.Errorf("unable to do operation %q on strings", op)
 	}
 
-	leftValue := left.(*object.String).Value
-	rightValue := right.(*object.String).Value
+	leftValue := left.obj.(*object.String).Value
+	rightValue := right.obj.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	return Value{kind: kindObject, obj: &object.String{Value: leftValue + rightValue}}, nil
 }
 
-func (vm *VM) executeIntegerBinaryOperation(op code.Opcode, left, right object.Object) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
-
+func integerBinaryOperation(op code.Opcode, leftValue, rightValue int64) (Value, error) {
 	var result int64
 	switch op {
 	case code.OpAdd:
@@ -433,94 +979,204 @@ func (vm *VM) executeIntegerBinaryOperation(op code.Opcode, left, right object.O
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return NullValue, fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
 	default:
-		return fmt.Errorf("unable to do operation %d on integers", op)
+		return NullValue, fmt.Errorf("unable to do operation %d on integers", op)
 	}
-	return vm.push(&object.Integer{Value: result})
+	return IntegerValue(result), nil
 }
 
-func (vm *VM) executeIndexExpression(left, index object.Object) error {
+// executeLocalConstOperation runs the arithmetic half of a fused local and
+// constant superinstruction, avoiding the round trip through the stack.
+func (vm *VM) executeLocalConstOperation(op code.Opcode, left, right Value) error {
+	arithmeticOp := code.OpAdd
+	if op == code.OpGetLocalSubConst {
+		arithmeticOp = code.OpSub
+	}
+
+	result, err := binaryOperation(arithmeticOp, left, right)
+	if err != nil {
+		return err
+	}
+
+	if result.kind == kindObject {
+		err = vm.track(result)
+		if err != nil {
+			return err
+		}
+	}
+
+	return vm.push(result)
+}
+
+func (vm *VM) executeIndexExpression(left, index Value) error {
 	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
-		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.ARRAY_OBJ && index.kind == kindInteger:
+		return vm.executeArrayIndex(left.obj.(*object.Array), index.integer)
 	case left.Type() == object.HASH_OBJ:
-		return vm.executeHashIndex(left, index)
+		return vm.executeHashIndex(left.obj.(*object.Hash), index.Object())
+	case left.Type() == object.HOST_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.obj.(*object.HostObject).Get(index.obj.(*object.String).Value)
+		if err != nil {
+			return err
+		}
+		return vm.push(FromObject(value))
+	case left.Type() == object.MODULE_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.obj.(*object.Module).Get(index.obj.(*object.String).Value)
+		if err != nil {
+			return err
+		}
+		return vm.push(FromObject(value))
+	case left.Type() == object.REGEX_OBJ && index.Type() == object.STRING_OBJ:
+		value, err := left.obj.(*object.Regex).Get(index.obj.(*object.String).Value)
+		if err != nil {
+			return err
+		}
+		return vm.push(FromObject(value))
 	default:
 		return fmt.Errorf("unable to execute index on type %s", left.Type())
 	}
 }
 
-func (vm *VM) executeArrayIndex(left, index object.Object) error {
-	arr := left.(*object.Array)
-	i := index.(*object.Integer).Value
+func (vm *VM) executeArrayIndex(arr *object.Array, i int64) error {
 	max := int64(len(arr.Elements) - 1)
 
 	if i < 0 || i > max {
-		return vm.push(nullObj)
+		return vm.push(NullValue)
 	}
 
-	return vm.push(arr.Elements[i])
+	return vm.push(FromObject(arr.Elements[i]))
 }
 
-func (vm *VM) executeHashIndex(left, index object.Object) error {
-	hashObj := left.(*object.Hash)
+func (vm *VM) executeHashIndex(hashObj *object.Hash, index object.Object) error {
 	key, ok := index.(object.Hashable)
 	if !ok {
 		return fmt.Errorf("unable to use type %s for an index", index.Type())
 	}
 	pair, ok := hashObj.Pairs[key.HashKey()]
 	if !ok {
-		return vm.push(nullObj)
+		return vm.push(NullValue)
 	}
 
-	return vm.push(pair.Value)
+	return vm.push(FromObject(pair.Value))
 }
 
-func (vm *VM) push(obj object.Object) error {
-	if vm.stackPointer >= StackSize {
-		return fmt.Errorf("tried to push but stack is full")
+func (vm *VM) push(v Value) error {
+	if vm.stackPointer >= len(vm.stack) {
+		err := vm.ensureStack(vm.stackPointer + 1)
+		if err != nil {
+			return err
+		}
 	}
 
-	vm.stack[vm.stackPointer] = obj
+	vm.stack[vm.stackPointer] = v
 	vm.stackPointer++
 
 	return nil
 }
 
-func (vm *VM) pop() object.Object {
-	o := vm.stack[vm.stackPointer-1]
-	vm.stackPointer--
-	return o
+// ensureStack grows the value stack so it holds at least size values.
+func (vm *VM) ensureStack(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+
+	if size > vm.limits.MaxStackSize {
+		return vm.stackOverflow()
+	}
+
+	newSize := len(vm.stack) * 2
+	for newSize < size {
+		newSize *= 2
+	}
+
+	stack := make([]Value, min(newSize, vm.limits.MaxStackSize))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
 }
 
-func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
-	elements := make([]object.Object, endIndex-startIndex)
+// stackOverflow builds the error for running out of stack, listing the
+// innermost Monkey calls.
+func (vm *VM) stackOverflow() error {
+	var out strings.Builder
+	out.WriteString("stack overflow")
+	vm.writeCalls(&out)
+
+	vm.traced = true
+	return fmt.Errorf("%s", out.String())
+}
 
-	for i := startIndex; i < endIndex; i++ {
-		elements[i-startIndex] = vm.stack[i]
+// writeCalls lists the calls on the frame stack, innermost first.
+func (vm *VM) writeCalls(out *strings.Builder) {
+	for i := vm.frameIndex - 1; i >= 0; i-- {
+		if i < vm.frameIndex-stackTraceDepth && i > 0 {
+			fmt.Fprintf(out, "\n\t... %d more", i)
+			i = 1
+			continue
+		}
+
+		fmt.Fprintf(out, "\n\tat %s", functionName(vm.frames[i]))
+	}
+}
+
+func functionName(frame *Frame) string {
+	if frame.closure.Fn.Name == "" {
+		return "<anonymous>"
 	}
+	return frame.closure.Fn.Name
+}
+
+func (vm *VM) getGlobal(index int) Value {
+	if index >= len(vm.globals) {
+		return NullValue
+	}
+
+	return FromObject(vm.globals[index])
+}
+
+func (vm *VM) setGlobal(index int, v Value) {
+	if index >= len(vm.globals) {
+		globals := make([]object.Object, max(index+1, len(vm.globals)*2))
+		copy(globals, vm.globals)
+		vm.globals = globals
+	}
+
+	vm.globals[index] = v.Object()
+}
+
+func (vm *VM) pop() Value {
+	v := vm.stack[vm.stackPointer-1]
+	vm.stackPointer--
+	return v
+}
 
-	return &object.Array{Elements: elements}
+func (vm *VM) buildArray(startIndex, endIndex int) (Value, error) {
+	elements := valuesToObjects(vm.stack[startIndex:endIndex])
+	array := Value{kind: kindObject, obj: &object.Array{Elements: elements}}
+	return array, vm.track(array)
 }
 
-func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
-	hashedPairs := make(map[object.HashKey]object.HashPair)
+func (vm *VM) buildHash(startIndex, endIndex int) (Value, error) {
+	hashObj := object.NewHash((endIndex - startIndex) / 2)
 
 	for i := startIndex; i < endIndex; i += 2 {
-		key := vm.stack[i]
-		value := vm.stack[i+1]
-		pair := object.HashPair{Key: key, Value: value}
+		key := vm.stack[i].Object()
+		value := vm.stack[i+1].Object()
 
 		haskKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unable to has key %s", key.Type())
+			return NullValue, fmt.Errorf("unable to has key %s", key.Type())
 		}
 
-		hashedPairs[haskKey.HashKey()] = pair
+		hashObj.Set(haskKey, value)
 	}
 
-	return &object.Hash{Pairs: hashedPairs}, nil
+	hash := Value{kind: kindObject, obj: hashObj}
+	return hash, vm.track(hash)
 }
 
 func nativeBoolToBooleanObject(input bool) object.Object {
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"context"
+	"monkey/compiler"
+	"testing"
+)
+
+var benchmarkPrograms = []struct {
+	name  string
+	input string
+}{
+	{"arithmetic", `
+	let sum = fn(n, acc) {
+		if (n == 0) { return acc; }
+		sum(n - 1, acc + n * 2 - 1)
+	};
+	sum(500, 0);
+	`},
+	{"fibonacci", `
+	let fibonacci = fn(x) {
+		if (x == 0) { return 0 }
+		if (x == 1) { return 1 }
+		fibonacci(x - 1) + fibonacci(x - 2)
+	};
+	fibonacci(20);
+	`},
+}
+
+func compileForBenchmark(b *testing.B, input string) *compiler.Bytecode {
+	b.Helper()
+
+	comp := compiler.New()
+	comp.SetOptimizationLevel(compiler.O1)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+func BenchmarkRun(b *testing.B) {
+	for _, bm := range benchmarkPrograms {
+		bytecode := compileForBenchmark(b, bm.input)
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				machine := New(bytecode)
+				err := machine.Run()
+				if err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegerArithmeticDoesNotAllocate(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(a, b) { (a + b) * 1000 - b / 2 > a == true }; f(100000, 300000)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	baseline := testing.AllocsPerRun(100, func() {
+		New(bytecode)
+	})
+	allocs := testing.AllocsPerRun(100, func() {
+		machine := New(bytecode)
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+	})
+
+	// setting the global and calling the closure allocate, the arithmetic must not
+	if allocs-baseline > 4 {
+		t.Errorf("expected arithmetic to run without allocating, got %.0f allocations", allocs-baseline)
+	}
+}
+
+func BenchmarkPool(b *testing.B) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(x) { x + 1 }; f(1)")); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			vm := New(bytecode)
+			if err := vm.Run(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool := NewPool()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := pool.Run(context.Background(), bytecode); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
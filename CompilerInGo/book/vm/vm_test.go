@@ -1,13 +1,20 @@
 package vm
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"monkey/ast"
 	"monkey/compiler"
 	"monkey/lexer"
+	"monkey/module"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func parse(input string) *ast.Program {
@@ -48,10 +55,16 @@ type vmTestCase struct {
 }
 
 func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+	runVmTestsWithLevel(t, tests, compiler.O0)
+}
+
+func runVmTestsWithLevel(t *testing.T, tests []vmTestCase, level compiler.OptimizationLevel) {
 	t.Helper()
 	for _, tt := range tests {
 		program := parse(tt.input)
 		comp := compiler.New()
+		comp.SetOptimizationLevel(level)
 		err := comp.Compile(program)
 
 		if err != nil {
@@ -99,6 +112,11 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testBooleanObjectFailed: %s", err)
 		}
+	case string:
+		str, ok := actual.(*object.String)
+		if !ok || str.Value != expected {
+			t.Errorf("expected string %q, got %T (%+v)", expected, actual, actual)
+		}
 	case []int:
 		array, ok := actual.(*object.Array)
 		if !ok {
@@ -115,6 +133,16 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 				t.Errorf("testIntegerObjectFailed: %s", err)
 			}
 		}
+	case []interface{}:
+		array, ok := actual.(*object.Array)
+		if !ok || len(array.Elements) != len(expected) {
+			t.Errorf("expected an array of %d items, got %T (%+v)", len(expected), actual, actual)
+			return
+		}
+
+		for i, elem := range array.Elements {
+			testExpectedObject(t, expected[i], elem)
+		}
 	case map[object.HashKey]int64:
 		hash, ok := actual.(*object.Hash)
 		if !ok {
@@ -128,15 +156,15 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		for expectedKey, expectedValue := range expected {
 			pair, ok := hash.Pairs[expectedKey]
 			if !ok {
-				t.Errorf("unable to find key %q in hash", expectedKey.Value)
+				t.Errorf("unable to find key %d in hash", expectedKey.Value)
 			}
 
 			err := testIntegerObject(expectedValue, pair.Value)
 			if err != nil {
-				t.Errorf("incorrect value for key %q, expected %d, got %d. Error: %s", expectedValue, expectedValue, pair.Value, err)
+				t.Errorf("incorrect value for key %d, expected %d, got %s. Error: %s", expectedKey.Value, expectedValue, pair.Value.Inspect(), err)
 			}
 		}
-	case object.Null:
+	case object.Null, *object.Null:
 		if actual != nullObj {
 			t.Errorf("expected object to be null, got (%+v)", actual)
 		}
@@ -150,6 +178,9 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if errObj.Message != expected.Message {
 			t.Errorf("incorrect error message. got %q, expected %q", errObj.Message, expected.Message)
 		}
+
+	default:
+		t.Errorf("unsupported expected value %T", expected)
 	}
 }
 
@@ -542,9 +573,8 @@ func TestBuiltInFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{`len(1)`, &object.Error{Message: "argument to `len` not supported, got INTEGER"}},
-		{`len("one", "two")`, &object.Error{Message: "wrong number of argument. got=2, want=1"}},
-		{`puts("hello", "world")`, nullObj},
+		{`len(1)`, object.Error{Message: "argument to `len` not supported, got INTEGER"}},
+		{`len("one", "two")`, object.Error{Message: "wrong number of arguments. got=2, want=1"}},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, nullObj},
 		{`first(1)`, object.Error{Message: "argument to `first` must be an ARRAY, got INTEGER"}},
@@ -552,7 +582,7 @@ func TestBuiltInFunctions(t *testing.T) {
 		{`last([])`, nullObj},
 		{`last(1)`, object.Error{Message: "argument to `last` must be an ARRAY, got INTEGER"}},
 		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`, "argument to `push` must be an ARRAY, got INTEGER"},
+		{`push(1, 1)`, object.Error{Message: "argument to `push` must be an ARRAY, got INTEGER"}},
 	}
 
 	runVmTests(t, tests)
@@ -633,3 +663,1272 @@ func TestRecursiveFunctions(t *testing.T) {
 
 	runVmTests(t, tests)
 }
+
+func TestOptimizedPrograms(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 + 2 * 3", 7},
+		{"-(10 - 4) / 2", -3},
+		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (false) { 10 }", object.Null{}},
+		{"if (false) { 10 } else { }", object.Null{}},
+		{"let x = 4; x * 1 + 0 - 0", 4},
+		{"let x = 4; if (!!(x > 2)) { x } else { 0 }", 4},
+		{"let x = 4; !!x", true},
+		{"let f = fn(x) { if (!x) { 1 } else { 2 } }; f(false) + f(true) * 10", 21},
+		{"let f = fn(x) { if (x) { if (x > 1) { 1 } else { 2 } } else { 3 } }; [f(2), f(1), f(false)]", []int{1, 2, 3}},
+		{"let f = fn() { return 1; 2 }; f()", 1},
+		{"let f = fn() { if (false) { 1 }; 2 }; f()", 2},
+		{`"mon" + "key" == "monkey"`, false},
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x == 0) { return 0 }
+				if (x == 1 + 0) { return 1 }
+				fibonacci(x - 1) + fibonacci(x - 2)
+			}
+			fibonacci(10)
+			`,
+			expected: 55,
+		},
+	}
+
+	runVmTestsWithLevel(t, tests, compiler.O1)
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+// TestOptimizedTypeErrors checks the optimizer keeps the type errors of
+// expressions it could otherwise simplify away.
+func TestOptimizedTypeErrors(t *testing.T) {
+	inputs := []string{
+		`"a" + 0`,
+		`0 + "a"`,
+		`true * 1`,
+		`let x = "a"; 1 * x - 0`,
+	}
+
+	for _, input := range inputs {
+		var errors []string
+		for _, level := range []compiler.OptimizationLevel{compiler.O0, compiler.O1, compiler.O2} {
+			comp := compiler.New()
+			comp.SetOptimizationLevel(level)
+			if err := comp.Compile(parse(input)); err != nil {
+				t.Fatalf("compiler error for %q: %s", input, err)
+			}
+
+			err := New(comp.Bytecode()).Run()
+			if err == nil {
+				t.Fatalf("expected VM error for %q at level %d but resulted in none", input, level)
+			}
+			errors = append(errors, err.Error())
+		}
+
+		if errors[1] != errors[0] || errors[2] != errors[0] {
+			t.Errorf("optimized programs fail differently for %q: %q", input, errors)
+		}
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	inputs := []string{"1 / 0", "let x = 0; 10 / x", "let f = fn(a) { 1 / (a - 1) }; f(1)"}
+
+	for _, input := range inputs {
+		for _, level := range []compiler.OptimizationLevel{compiler.O0, compiler.O1, compiler.O2} {
+			comp := compiler.New()
+			comp.SetOptimizationLevel(level)
+			if err := comp.Compile(parse(input)); err != nil {
+				t.Fatalf("compiler error for %q: %s", input, err)
+			}
+
+			err := New(comp.Bytecode()).Run()
+			if err == nil || err.Error() != "division by zero" {
+				t.Errorf("expected error %q for %q at level %d, got %v", "division by zero", input, level, err)
+			}
+		}
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b) { a + b }; f(1, 2)", 3},
+		{`let f = fn(a, b) { a + b }; f("mon", "key")`, "monkey"},
+		{"let f = fn(a) { a - 1 }; f(10)", 9},
+		{"let f = fn(a) { a + 5 }; f(10)", 15},
+		{"let f = fn(a, b) { if (a == b) { 1 } else { 2 } }; [f(1, 1), f(1, 2), f(true, true)]", []int{1, 2, 1}},
+		{"let f = fn(a, b) { if (a > b) { 1 } else { 2 } }; [f(2, 1), f(1, 2)]", []int{1, 2}},
+	}
+
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+// generatedIdentifiers returns n distinct identifiers, identifiers may not
+// contain digits.
+func generatedIdentifiers(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		name := ""
+		for j := i; j >= 0; j = j/26 - 1 {
+			name = string(rune('a'+j%26)) + name
+		}
+		names[i] = "v" + name
+	}
+	return names
+}
+
+func TestWideOperands(t *testing.T) {
+	names := generatedIdentifiers(300)
+
+	lets := ""
+	args := make([]string, len(names))
+	for i, name := range names {
+		lets += fmt.Sprintf("let %s = %d; ", name, i)
+		args[i] = fmt.Sprint(i + 1)
+	}
+	farBranch := strings.Repeat("true; ", 32768)
+
+	tests := []vmTestCase{
+		{fmt.Sprintf("fn() { %s %s + %s }()", lets, names[0], names[299]), 299},
+		{fmt.Sprintf("fn(%s) { %s + %s }(%s)", strings.Join(names, ", "), names[0], names[299], strings.Join(args, ", ")), 301},
+		{fmt.Sprintf("fn() { %s fn() { %s } }()()", lets, strings.Join(names, " + ")), 44850},
+		{"if (false) { " + farBranch + "1 } else { 7 }", 7},
+		{"if (true) { " + farBranch + "1 } else { 7 }", 1},
+		{"fn(x) { if (x > 1) { " + farBranch + "1 } else { 2 } }(0)", 2},
+		{"fn(x) { if (x == 0) { " + farBranch + "1 } else { 2 } }(0)", 1},
+	}
+
+	for _, level := range []compiler.OptimizationLevel{compiler.O0, compiler.O1, compiler.O2} {
+		runVmTestsWithLevel(t, tests, level)
+	}
+}
+
+func TestStacksGrowOnDemand(t *testing.T) {
+	tests := []vmTestCase{
+		{"let depth = fn(n) { if (n == 0) { 0 } else { 1 + depth(n - 1) } }; depth(5000)", 5000},
+		{"let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(20000)", 200010000},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStackOverflow(t *testing.T) {
+	tests := []struct {
+		input    string
+		limits   Limits
+		level    compiler.OptimizationLevel
+		expected string
+	}{
+		{
+			input:    "let f = fn(n) { f(n + 1) + 1 }; f(0)",
+			limits:   Limits{MaxStackSize: 1 << 20, MaxFrames: 5},
+			expected: "stack overflow\n\tat f\n\tat f\n\tat f\n\tat f\n\tat <main>",
+		},
+		{
+			input:    "let f = fn(n) { fn() { f(n + 1) }() }; f(0)",
+			limits:   Limits{MaxStackSize: 1 << 20, MaxFrames: 5},
+			expected: "stack overflow\n\tat <anonymous>\n\tat f\n\tat <anonymous>\n\tat f\n\tat <main>",
+		},
+		{
+			input:    "let f = fn(n) { f(n + 1) + 1 }; f(0)",
+			limits:   Limits{MaxStackSize: 1 << 20, MaxFrames: 15},
+			expected: "stack overflow\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\tat f\n\t... 4 more\n\tat <main>",
+		},
+		{
+			input:    "let f = fn() { [1, 2, 3, 4, 5, 6, 7, 8, 9, 10] }; f()",
+			limits:   Limits{MaxStackSize: 8, MaxFrames: 5},
+			expected: "stack overflow\n\tat f\n\tat <main>",
+		},
+		{
+			// the tail call to g replaces the frame of f
+			input:    "let g = fn(n) { g(n + 1) + 1 }; let f = fn() { g(0) }; f()",
+			limits:   Limits{MaxStackSize: 1 << 20, MaxFrames: 5},
+			level:    compiler.O1,
+			expected: "stack overflow\n\tat g\n\tat g\n\tat g\n\tat g\n\tat <main>",
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetOptimizationLevel(tt.level)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(tt.limits)
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("expected error %q got %q", tt.expected, err.Error())
+		}
+	}
+}
+
+func TestPartialLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		limits   Limits
+		expected interface{}
+	}{
+		{"let f = fn(n) { f(n + 1) + 1 }; f(0)", Limits{MaxFrames: 3}, "stack overflow\n\tat f\n\tat f\n\tat <main>"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + 1 } }; f(100)", Limits{MaxFrames: 200}, 100},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + 1 } }; f(100)", Limits{MaxStackSize: 1024}, 100},
+		{"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]", Limits{MaxStackSize: 8}, "stack overflow\n\tat <main>"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(tt.limits)
+		err = vm.Run()
+
+		if expected, ok := tt.expected.(string); ok {
+			if err == nil || err.Error() != expected {
+				t.Errorf("expected error %q, got %v", expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestDefaultStackOverflow(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(n) { f(n + 1) + 1 }; f(0)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil || !strings.HasPrefix(err.Error(), "stack overflow\n\tat f") {
+		t.Fatalf("expected a stack overflow, got %v", err)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(1000000, 0)", 500000500000},
+		{"let loop = fn(n) { if (n == 0) { return 0; } return loop(n - 1); }; loop(1000000)", 0},
+		{
+			input: `
+			let isEven = fn(n, isOdd) { if (n == 0) { true } else { isOdd(n - 1, isEven) } };
+			let isOdd = fn(n, isEven) { if (n == 0) { false } else { isEven(n - 1, isOdd) } };
+			isEven(100001, isOdd)
+			`,
+			expected: false,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x, steps) { if (x == 0) { steps } else { countDown(x - 1, steps + 1) } };
+				countDown(300000, 0);
+			};
+			wrapper();
+			`,
+			expected: 300000,
+		},
+		{"let f = fn(a) { if (a > 1) { len([1, a]) } else { first([a]) } }; f(2) + f(1)", 3},
+		{"let add = fn(a, b, c) { a + b + c }; let f = fn(x) { add(x, x, x) }; f(2) * 2", 12},
+	}
+
+	// O0 compiles the calls as written, so deep loops overflow
+	for _, level := range []compiler.OptimizationLevel{compiler.O1, compiler.O2} {
+		runVmTestsWithLevel(t, tests, level)
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn() { f() }; f()"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetInstructionBudget(10000)
+	err = vm.Run()
+	if err != object.ErrBudgetExhausted {
+		t.Fatalf("expected %q, got %v", object.ErrBudgetExhausted, err)
+	}
+	if vm.InstructionsExecuted() != 10000 {
+		t.Errorf("expected 10000 instructions executed, got %d", vm.InstructionsExecuted())
+	}
+}
+
+func TestResumeAfterBudgetExhausted(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(1000, 0)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetInstructionBudget(500)
+	err = vm.Run()
+	if err != object.ErrBudgetExhausted {
+		t.Fatalf("expected %q, got %v", object.ErrBudgetExhausted, err)
+	}
+
+	vm.SetInstructionBudget(0)
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	err = testIntegerObject(500500, vm.LastPoppedStackElem())
+	if err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+}
+
+func TestBudgetStopInsideCallbackEndsProgram(t *testing.T) {
+	for _, level := range []compiler.OptimizationLevel{compiler.O0, compiler.O1, compiler.O2} {
+		comp := compiler.New()
+		comp.SetOptimizationLevel(level)
+		err := comp.Compile(parse("map([1, 2, 3], fn(x) { x * 2 })"))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ended := 0
+		for budget := 1; budget < 50; budget++ {
+			vm := New(comp.Bytecode())
+			vm.SetInstructionBudget(budget)
+			err = vm.Run()
+			if err == nil {
+				break
+			}
+			if err != object.ErrBudgetExhausted {
+				t.Fatalf("O%d, budget %d: expected %q, got %v", level, budget, object.ErrBudgetExhausted, err)
+			}
+
+			vm.SetInstructionBudget(0)
+			err = vm.Run()
+			if err == object.ErrBudgetExhausted {
+				// map cannot go on from inside its callback, so the run is over
+				ended++
+				continue
+			}
+			if err != nil {
+				t.Fatalf("O%d, budget %d: vm error on resume: %s", level, budget, err)
+			}
+			testExpectedObject(t, []int{2, 4, 6}, vm.LastPoppedStackElem())
+		}
+
+		if ended == 0 {
+			t.Errorf("O%d: no budget stopped the run inside the callback", level)
+		}
+	}
+}
+
+func TestRunContextCancellation(t *testing.T) {
+	// at O1 the tail call keeps the program from overflowing before it is cancelled
+	comp := compiler.New()
+	comp.SetOptimizationLevel(compiler.O1)
+	err := comp.Compile(parse("let f = fn() { f() }; f()"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	vm := New(comp.Bytecode())
+	err = vm.RunContext(cancelled)
+	if err != object.ErrCancelled {
+		t.Fatalf("expected %q, got %v", object.ErrCancelled, err)
+	}
+	if vm.InstructionsExecuted() != 0 {
+		t.Errorf("expected nothing to run, got %d instructions", vm.InstructionsExecuted())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = vm.RunContext(ctx)
+	if err != object.ErrCancelled {
+		t.Fatalf("expected %q, got %v", object.ErrCancelled, err)
+	}
+}
+
+func TestAllocationStats(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let a = [1, 2, 3]; let s = "a" + "b"; let f = fn(x) { fn() { x } }; f(1); first([a]); {1: 2}`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := AllocationStats{
+		Bytes:    (24 + 3*16) + (24 + 16) + (16 + 2) + 32 + (32 + 16) + (48 + 48),
+		Strings:  1,
+		Arrays:   2,
+		Hashes:   1,
+		Closures: 2,
+	}
+	if vm.AllocationStats() != expected {
+		t.Errorf("expected allocations %+v, got %+v", expected, vm.AllocationStats())
+	}
+}
+
+func TestBuiltinAllocationStats(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected AllocationStats
+	}{
+		{
+			`strings.split("a,b,c", ",")`,
+			AllocationStats{Bytes: (24 + 3*16) + 3*(16+1), Strings: 3, Arrays: 1},
+		},
+		{
+			`json_parse(json_stringify({"a": [1, "x"]}))`,
+			AllocationStats{Bytes: ((24 + 2*16) + (48 + 48)) + (16 + 13) + ((48 + 48) + (16 + 1) + (24 + 2*16) + (16 + 1)), Strings: 3, Arrays: 2, Hashes: 2},
+		},
+		{
+			// the arrays the function gives back are only counted once
+			"map([1, 2], fn(x) { [x] })",
+			AllocationStats{Bytes: (24 + 2*16) + 32 + 2*(24+16) + (24 + 2*16), Arrays: 4, Closures: 1},
+		},
+		{
+			// so are the elements rest keeps
+			`rest(["a" + "b", "c"])`,
+			AllocationStats{Bytes: (16 + 2) + (24 + 2*16) + (24 + 16), Strings: 1, Arrays: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if vm.AllocationStats() != tt.expected {
+			t.Errorf("%s: expected allocations %+v, got %+v", tt.input, tt.expected, vm.AllocationStats())
+		}
+	}
+}
+
+func TestAllocationLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		limit    int
+		expected string
+	}{
+		{
+			input:    `let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } }; double("ab", 40)`,
+			limit:    1 << 20,
+			expected: "allocation limit of 1048576 bytes exceeded",
+		},
+		{
+			input:    "let grow = fn(arr, n) { if (n == 0) { arr } else { grow(push(arr, n), n - 1) } }; grow([], 100000)",
+			limit:    1 << 20,
+			expected: "allocation limit of 1048576 bytes exceeded",
+		},
+		{
+			input:    "let f = fn(n) { if (n == 0) { 0 } else { fn() { n }; f(n - 1) } }; f(1000)",
+			limit:    1000,
+			expected: "allocation limit of 1000 bytes exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetAllocationLimit(tt.limit)
+		err = vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+		if vm.AllocationStats().Bytes <= tt.limit {
+			t.Errorf("expected allocations over the limit to be recorded, got %d bytes", vm.AllocationStats().Bytes)
+		}
+	}
+}
+
+func TestAllocationLimitCountsGarbage(t *testing.T) {
+	// each string is dropped before the next is made, so little is live at
+	// once, but the limit is on what the run allocates in total
+	input := `let s = "ab"; let loop = fn(n) { if (n > 0) { s + s; loop(n - 1) } }; loop(1000)`
+
+	comp := compiler.New()
+	comp.SetOptimizationLevel(compiler.O1)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	unlimited := New(comp.Bytecode())
+	err = unlimited.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	allocated := unlimited.AllocationStats().Bytes
+	if allocated < 1000*(stringSize+4) {
+		t.Fatalf("expected the dropped strings to be counted, got %d bytes", allocated)
+	}
+
+	limited := New(comp.Bytecode())
+	limited.SetAllocationLimit(allocated / 2)
+	err = limited.Run()
+	expected := fmt.Sprintf("allocation limit of %d bytes exceeded", allocated/2)
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{"map([1, 2, 3], fn(x) { x * 2 })", []int{2, 4, 6}},
+		{"map([], fn(x) { x })", []int{}},
+		{"filter([1, 2, 3, 4], fn(x) { x > 2 })", []int{3, 4}},
+		{"reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })", 10},
+		{"reduce([], 7, fn(acc, x) { acc + x })", 7},
+		{"sort_by([3, 1, 2], fn(x) { x })", []int{1, 2, 3}},
+		{"sort_by([1, 2, 3, 4], fn(x) { 0 - x })", []int{4, 3, 2, 1}},
+		{"each([1, 2], fn(x) { x })", object.Null{}},
+		{"map([[1], [2, 3]], len)", []int{1, 2}},
+		{"let offset = 10; map([1, 2], fn(x) { x + offset })", []int{11, 12}},
+		{"map([1, 2], fn(x) { reduce([x, x], 0, fn(a, b) { a + b }) })", []int{2, 4}},
+		{"let f = fn(xs) { map(xs, fn(x) { x + 1 }) }; f([1, 2])", []int{2, 3}},
+		{"map(1, fn(x) { x })", object.Error{Message: "argument to `map` must be an ARRAY or GENERATOR, got INTEGER"}},
+		{"map([1], 1)", object.Error{Message: "last argument to `map` must be a function, got INTEGER"}},
+		{`sort_by([1, 2], fn(x) { if (x == 1) { 1 } else { "b" } })`, object.Error{Message: "keys for `sort_by` must all have the same type, got INTEGER and STRING"}},
+	}
+
+	runVmTests(t, tests)
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+func TestCallbackErrorsStopTheProgram(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"map([1, 2], fn(x) { x + true })", "unknown operator 1 on type INTEGER and BOOLEAN"},
+		{"map([1, 2], fn(x, y) { x })", "wrong number of arguments: expected 2, got 1"},
+		{"let f = fn(n) { map([n], f) }; f(1)", "stack overflow"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(Limits{MaxStackSize: 4096, MaxFrames: 64})
+		err = vm.Run()
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestCallClosure(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let base = 10; let add = fn(x, y) { x + y + base };"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	closure, ok := vm.Globals()[1].(*object.Closure)
+	if !ok {
+		t.Fatalf("expected a closure, got %T", vm.Globals()[1])
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := vm.CallClosure(closure, object.NewInteger(1), object.NewInteger(int64(i)))
+		if err != nil {
+			t.Fatalf("call error: %s", err)
+		}
+		if err := testIntegerObject(int64(11+i), result); err != nil {
+			t.Errorf("wrong result: %s", err)
+		}
+	}
+
+	_, err = vm.CallClosure(closure, object.NewInteger(1))
+	if err == nil {
+		t.Fatalf("expected wrong number of arguments error")
+	}
+
+	result, err := vm.CallClosure(closure, object.NewInteger(2), object.NewInteger(3))
+	if err != nil {
+		t.Fatalf("call error after a failed call: %s", err)
+	}
+	if err := testIntegerObject(15, result); err != nil {
+		t.Errorf("wrong result: %s", err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	tests := []struct {
+		input          string
+		stdin          string
+		expectedOutput string
+		expected       interface{}
+	}{
+		{`puts("hello", "world")`, "", "hello\nworld\n", object.Null{}},
+		{`puts([1, 2], {"a": true})`, "", "[1, 2]\n{a: true}\n", object.Null{}},
+		{`let name = gets(); puts("hi " + name); len(name)`, "monkey\n", "hi monkey\n", 6},
+		{`len(read_line() + read_line() + gets())`, "a\r\nb\nc", "", 3},
+		{`gets()`, "", "", object.Null{}},
+		{`each([1, 2], puts)`, "", "1\n2\n", object.Null{}},
+		{`gets(1)`, "", "", object.Error{Message: "wrong number of arguments. got=1, want=0"}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(comp.Bytecode())
+		vm.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(tt.stdin), &out)})
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != tt.expectedOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expectedOutput, out.String())
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestStreamsArePerVM(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`puts(gets())`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	var first, second bytes.Buffer
+	firstVM := New(bytecode)
+	firstVM.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader("one"), &first)})
+	secondVM := New(bytecode)
+	secondVM.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader("two"), &second)})
+
+	if err := firstVM.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if err := secondVM.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if first.String() != "one\n" || second.String() != "two\n" {
+		t.Errorf("output mixed up between vms. got=%q and %q", first.String(), second.String())
+	}
+}
+
+func TestSpawnAndChannels(t *testing.T) {
+	tests := []vmTestCase{
+		{"let ch = channel(); spawn(fn() { send(ch, 42) }); recv(ch)", 42},
+		{"recv(spawn(fn(a, b) { a + b }, 1, 2))", 3},
+		{"let x = 5; let f = fn() { x * 2 }; recv(spawn(f))", 10},
+		{"recv(spawn(len, [1, 2, 3]))", 3},
+		{"let ch = channel(2); send(ch, 1); send(ch, 2); channels.close(ch); recv(ch) + recv(ch)", 3},
+		{"let ch = channel(1); send(ch, 1); channels.close(ch); recv(ch); recv(ch)", object.Null{}},
+		{`
+			let results = channel();
+			let worker = fn(n) { send(results, n * n) };
+			each([1, 2, 3, 4], fn(n) { spawn(worker, n) });
+			reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + recv(results) })
+			`, 30},
+		{`
+			let jobs = channel();
+			let done = channel();
+			let consume = fn(total) { let job = recv(jobs); if (!job) { send(done, total) } else { consume(total + job) } };
+			spawn(consume, 0);
+			each([1, 2, 3], fn(n) { send(jobs, n) });
+			channels.close(jobs);
+			recv(done)
+			`, 6},
+		{"let a = channel(); let b = channel(1); send(b, 7); select([a, b])", []int{1, 7}},
+		{"let a = channel(1); let r = select([[a, 5]]); r[0] + recv(a)", 5},
+		{"let a = channel(); spawn(fn() { send(a, 3) }); select([channel(), a])", []int{1, 3}},
+		{"let ch = channel(); spawn(fn() { recv(ch) }); 1", 1},
+		{"let ch = channel(); recv(ch)", object.Error{Message: "deadlock: all tasks are blocked on channels"}},
+		{"let ch = channel(); spawn(fn() { recv(ch) }); recv(ch)", object.Error{Message: "deadlock: all tasks are blocked on channels"}},
+		{"let ch = channel(); spawn(fn() { send(ch, 1) }); recv(ch); recv(ch)", object.Error{Message: "deadlock: all tasks are blocked on channels"}},
+		{"let ch = channel(1); channels.close(ch); send(ch, 1)", object.Error{Message: "send on closed channel"}},
+		{"let ch = channel(); channels.close(ch); channels.close(ch)", object.Error{Message: "close of closed channel"}},
+		{"channels.close([])", object.Error{Message: "argument to `channels.close` must be a CHANNEL, got ARRAY"}},
+		{"recv(spawn(fn() { 1 + true }))", object.Error{Message: "unknown operator 1 on type INTEGER and BOOLEAN"}},
+		{"spawn(1)", object.Error{Message: "cannot spawn INTEGER"}},
+		{"channel(-1)", object.Error{Message: "capacity for `channel` must be a non-negative INTEGER, got -1"}},
+		{"select([1])", object.Error{Message: "case 0 of `select` must be a CHANNEL or [CHANNEL, value], got 1"}},
+	}
+
+	runVmTests(t, tests)
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+func TestSpawnedTasksEndWithTheProgram(t *testing.T) {
+	bytecode := compileProgram(t, "let loop = fn() { loop() }; spawn(loop); let ch = channel(); spawn(fn() { recv(ch) }); 1")
+
+	vm := New(bytecode)
+	err := vm.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 1, vm.LastPoppedStackElem())
+}
+
+func TestSpawnedTasksShareLimits(t *testing.T) {
+	double := `let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } }; `
+	tests := []struct {
+		input           string
+		budget          int
+		allocationLimit int
+		expected        string
+	}{
+		{"let loop = fn() { loop() }; recv(spawn(loop))", 100000, 0, "budget exhausted"},
+		// either allocation fits the limit, both do not
+		{double + `double("ab", 17); recv(spawn(double, "ab", 17))`, 0, 1 << 20, "allocation limit of 1048576 bytes exceeded"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		vm.SetInstructionBudget(tt.budget)
+		vm.SetAllocationLimit(tt.allocationLimit)
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, object.Error{Message: tt.expected}, vm.LastPoppedStackElem())
+		if tt.budget > 0 && vm.InstructionsExecuted() < tt.budget {
+			t.Errorf("expected the instructions of the task to be counted, got %d", vm.InstructionsExecuted())
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []vmTestCase{
+		{"let count = fn() { yield 1; yield 2; }; let gen = count(); generators.next(gen) + generators.next(gen)", 3},
+		{"let count = fn() { yield 1; yield 2; }; let gen = count(); generators.next(gen); generators.next(gen); generators.next(gen); generators.next(gen)", object.Null{}},
+		{"let gen = fn() { yield 1; 3 }(); generators.next(gen); generators.next(gen)", 3},
+		{"let gen = fn(a, b) { yield a + b; }(1, 2); generators.next(gen)", 3},
+		{"let gen = fn() { let x = 10; yield x; yield x + 1 }(); generators.next(gen) + generators.next(gen)", 21},
+		{"let gen = fn() { let x = yield 1; x }(); generators.next(gen); generators.next(gen)", object.Null{}},
+		{"let gen = fn() { yield }(); generators.next(gen)", object.Null{}},
+		{"let calls = channel(1); let gen = fn() { send(calls, 1); yield 1 }(); channels.close(calls); recv(calls)", object.Null{}},
+		{`
+			let take = fn(gen, n) { if (n == 0) { [] } else { let v = generators.next(gen); push(take(gen, n - 1), v) } };
+			let nums = fn() { yield 1; yield 2; yield 3; yield 4 }();
+			take(nums, 2)
+			`, []int{2, 1}},
+		{`
+			let range = fn(from, to) { if (from < to) { yield from; generators.delegate(range(from + 1, to)) } };
+			map(range(0, 5), fn(x) { x * x })
+			`, []int{0, 1, 4, 9, 16}},
+		{`
+			let naturals = fn(n) { yield n; generators.delegate(naturals(n + 1)) };
+			let gen = naturals(1);
+			let skip = fn(n) { if (n > 0) { generators.next(gen); skip(n - 1) } };
+			skip(5000);
+			generators.next(gen)
+			`, 5001},
+		{"let nums = fn() { yield 1; yield 2; yield 3 }; map(nums(), fn(x) { x * 2 })", []int{2, 4, 6}},
+		{"let nums = fn() { yield 1; yield 2; yield 3 }; filter(nums(), fn(x) { x > 1 })", []int{2, 3}},
+		{"let nums = fn() { yield 1; yield 2; yield 3 }; reduce(nums(), 0, fn(acc, x) { acc + x })", 6},
+		{"let nums = fn() { yield 3; yield 1; yield 2 }; sort_by(nums(), fn(x) { x })", []int{1, 2, 3}},
+		{"let total = channel(3); let nums = fn() { yield 1; yield 2 }; each(nums(), fn(x) { send(total, x) }); recv(total) + recv(total)", 3},
+		{`
+			let nested = fn() { let inner = fn() { yield 1; yield 2 }(); yield generators.next(inner) * 10; yield generators.next(inner) * 10 };
+			map(nested(), fn(x) { x })
+			`, []int{10, 20}},
+		{"let gen = fn() { yield generators.next(gen) }(); generators.next(gen)", object.Error{Message: "generator is already running"}},
+		{"generators.next(1)", object.Error{Message: "argument to `generators.next` must be a GENERATOR, got INTEGER"}},
+		{"let inner = fn() { yield 1 }; let outer = fn() { yield 0; inner() }(); generators.next(outer); status(generators.next(outer))", "suspended"},
+		{"let inner = fn() { yield 1 }; let outer = fn() { yield 0; inner() }(); generators.next(outer); generators.next(generators.next(outer))", 1},
+		{"let inner = fn() { yield 1 }; let outer = fn() { yield 0; generators.delegate(inner()) }(); generators.next(outer); generators.next(outer)", 1},
+		{"generators.delegate(1)", object.Error{Message: "argument to `generators.delegate` must be a GENERATOR, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+func TestGeneratorErrorsStopTheProgram(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let gen = fn() { yield 1 + true }(); generators.next(gen)", "unknown operator 1 on type INTEGER and BOOLEAN\n\tat <anonymous>"},
+		{
+			`
+			let fail = fn() { 1 + true };
+			let inner = fn() { yield fail() };
+			let outer = fn() { let gen = inner(); yield generators.next(gen) };
+			generators.next(outer())
+			`,
+			"unknown operator 1 on type INTEGER and BOOLEAN\n\tat fail\n\tat inner\n\tat outer",
+		},
+		{"let gen = fn(a) { yield a }(); generators.next(gen)", "wrong number of arguments: expected 1, got 0"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		err := vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestCoroutines(t *testing.T) {
+	tests := []vmTestCase{
+		{"let co = coroutine(fn(x) { let y = yield x + 1; y * 2 }); resume(co, 1)", 2},
+		{"let co = coroutine(fn(x) { let y = yield x + 1; y * 2 }); resume(co, 1); resume(co, 10)", 20},
+		{"let co = coroutine(fn() { yield 1 }); resume(co); resume(co); resume(co)", object.Error{Message: "cannot resume dead coroutine"}},
+		{"let co = coroutine(fn() { yield 1 }); resume(co); resume(co)", object.Null{}},
+		{"let co = coroutine(fn(a, b) { a + b }); resume(co, 1, 2)", 3},
+		{"let co = coroutine(len); resume(co, [1, 2])", 2},
+		{`
+			let co = coroutine(fn() { let x = yield 1; let y = yield x + 1; yield x + y });
+			[resume(co), resume(co, 10), resume(co, 100)]
+			`, []int{1, 11, 110}},
+		{`
+			let counter = fn(n) { let step = yield n; generators.delegate(counter(n + step)) };
+			let co = coroutine(counter);
+			resume(co, 0); resume(co, 5); resume(co, 5)
+			`, 10},
+		{"let co = coroutine(fn() { yield 1 }); status(co)", "suspended"},
+		{"let co = coroutine(fn() { yield status(co) }); resume(co)", "running"},
+		{"let co = coroutine(fn() { 1 }); resume(co); status(co)", "dead"},
+		{"let co = coroutine(fn() { yield resume(co) }); resume(co)", object.Error{Message: "cannot resume running coroutine"}},
+		{"let gen = fn() { yield 1 }(); generators.next(gen); status(gen)", "suspended"},
+		{"coroutine(1)", object.Error{Message: "argument to `coroutine` must be a function, got INTEGER"}},
+		{"resume(1)", object.Error{Message: "first argument to `resume` must be a COROUTINE, got INTEGER"}},
+		{"status(1)", object.Error{Message: "argument to `status` must be a COROUTINE or GENERATOR, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+	runVmTestsWithLevel(t, tests, compiler.O2)
+}
+
+func TestCoroutineErrorsSurfaceAtResume(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`
+			let check = fn(x) { if (x > 1) { x + true } else { x } };
+			let worker = fn() { let x = yield 1; yield check(x) };
+			let co = coroutine(worker);
+			resume(co);
+			resume(co, 2)
+			`,
+			"unknown operator 1 on type INTEGER and BOOLEAN\n\tat check\n\tat worker",
+		},
+		{"let co = coroutine(fn(a) { yield a }); resume(co)", "wrong number of arguments: expected 1, got 0"},
+		{
+			"let deep = fn(n) { deep(n + 1) + 1 }; let co = coroutine(fn() { yield deep(0) }); resume(co)",
+			"stack overflow\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\tat deep\n\t... 53 more\n\tat <anonymous>",
+		},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		vm.SetLimits(Limits{MaxStackSize: 4096, MaxFrames: 64})
+		err := vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestBudgetStopInsideCoroutineEndsProgram(t *testing.T) {
+	bytecode := compileProgram(t, `
+	let count = fn(n) { if (n > 0) { count(n - 1) } else { 0 } };
+	let co = coroutine(fn() { yield count(50) });
+	resume(co)
+	`)
+
+	vm := New(bytecode)
+	vm.SetInstructionBudget(100)
+	err := vm.Run()
+	if err != object.ErrBudgetExhausted {
+		t.Fatalf("expected %q, got %v", object.ErrBudgetExhausted, err)
+	}
+
+	// the stop came inside resume, which cannot go on from there
+	vm.SetInstructionBudget(0)
+	err = vm.Run()
+	if err != object.ErrBudgetExhausted {
+		t.Fatalf("expected %q on resume, got %v", object.ErrBudgetExhausted, err)
+	}
+}
+
+// writeModules writes the module files, given by path relative to the
+// directory it returns.
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(source), 0o644)
+		}
+		if err != nil {
+			t.Fatalf("writing module %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+var moduleFiles = map[string]string{
+	"lib/counter.monkey": `puts("loading counter"); let step = 1; export let inc = fn(x) { x + step }; export let name = "counter";`,
+	"lib/twice.monkey":   `let counter = import "./counter"; export let twice = fn(x) { counter.inc(counter.inc(x)) };`,
+	"a.monkey":           `let b = import "b"; export let x = 1;`,
+	"b.monkey":           `let a = import "a"; export let y = 2;`,
+	"broken.monkey":      `return 1;`,
+	"vendor/util.monkey": `export let answer = 42;`,
+}
+
+func TestModules(t *testing.T) {
+	dir := writeModules(t, moduleFiles)
+
+	tests := []struct {
+		input          string
+		expected       interface{}
+		expectedOutput string
+	}{
+		{
+			`let c = import "lib/counter"; let t = import "lib/twice"; let step = 10; [c.inc(1), t.twice(1), c.name, step]`,
+			[]interface{}{2, 3, "counter", 10},
+			"loading counter\n",
+		},
+		{`let m = fn() { import "lib/counter" }; m() == m()`, true, "loading counter\n"},
+		{`(import "util").answer`, 42, ""},
+		{`let u = import "./vendor/util.monkey"; u.answer`, 42, ""},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetModuleLoader(module.NewResolver(filepath.Join(dir, "vendor")))
+		comp.SetFile(filepath.Join(dir, "main.monkey"))
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(comp.Bytecode())
+		vm.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(""), &out)})
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != tt.expectedOutput {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expectedOutput, out.String())
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	dir := writeModules(t, moduleFiles)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	compileErrors := []struct {
+		input    string
+		expected string
+	}{
+		{`import "a"`, fmt.Sprintf("import cycle: %s -> %s -> %s", path("a.monkey"), path("b.monkey"), path("a.monkey"))},
+		{`import "broken"`, "return outside of a function in module " + path("broken.monkey")},
+		{`import "missing"`, `module "missing" not found`},
+	}
+
+	for _, tt := range compileErrors {
+		comp := compiler.New()
+		comp.SetFile(path("main.monkey"))
+		err := comp.Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected compiler error %q, got %v", tt.expected, err)
+		}
+	}
+
+	comp := compiler.New()
+	comp.SetFile(path("main.monkey"))
+	err := comp.Compile(parse(`let c = import "lib/counter"; c.missing`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	vm.SetConfig(object.Config{Streams: object.NewStreams(strings.NewReader(""), &bytes.Buffer{})})
+	err = vm.Run()
+	expected := "module " + path("lib/counter.monkey") + " has no export missing"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestStandardLibrary(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`math.abs(-3)`, "3"},
+		{`math.abs(3)`, "3"},
+		{`math.min(3, -1, 2)`, "-1"},
+		{`math.max(3, -1, 2)`, "3"},
+		{`math.pow(2, 10)`, "1024"},
+		{`math.pow(-3, 3)`, "-27"},
+		{`math.pow(5, 0)`, "1"},
+		{`math.pow(2, -1)`, "ERROR: negative exponent to `math.pow`: -1"},
+		{`math.pow(2, 64)`, "ERROR: integer overflow in `math.pow`"},
+		{`math.min()`, "ERROR: wrong number of arguments. got=0, want at least 1"},
+		{`math.max(1, "2")`, "ERROR: argument 1 to `math.max` must be an INTEGER, got STRING"},
+		{`math.abs("x")`, "ERROR: argument to `math.abs` must be an INTEGER, got STRING"},
+		{`strings.split("a,b,,c", ",")`, "[a, b, , c]"},
+		{`len(strings.split("abc", ""))`, "3"},
+		{`strings.join(["a", "b", "c"], "-")`, "a-b-c"},
+		{`strings.join([], "-")`, ""},
+		{`strings.join(["a", 1], "-")`, "ERROR: element 1 of the array passed to `strings.join` must be a STRING, got INTEGER"},
+		{`strings.trim("  hi  ")`, "hi"},
+		{`strings.replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`strings.contains("monkey", "key")`, "true"},
+		{`strings.contains("monkey", "ape")`, "false"},
+		{`strings.upper("Monkey")`, "MONKEY"},
+		{`strings.lower("Monkey")`, "monkey"},
+		{`strings.index_of("monkey", "key")`, "3"},
+		{`strings.index_of("monkey", "ape")`, "-1"},
+		{`strings.split("a")`, "ERROR: wrong number of arguments. got=1, want=2"},
+		{`strings.upper(1)`, "ERROR: argument to `strings.upper` must be a STRING, got INTEGER"},
+		{`arrays.slice([1, 2, 3, 4], 1, 3)`, "[2, 3]"},
+		{`arrays.slice([1, 2, 3, 4], 2)`, "[3, 4]"},
+		{`arrays.slice([1, 2, 3, 4], -2)`, "[3, 4]"},
+		{`arrays.slice([1, 2, 3, 4], 3, 1)`, "[]"},
+		{`arrays.slice([1, 2], 0, 10)`, "[1, 2]"},
+		{`arrays.slice([1, 2], "0")`, "ERROR: argument 1 to `arrays.slice` must be an INTEGER, got STRING"},
+		{`arrays.concat([1], [], [2, 3])`, "[1, 2, 3]"},
+		{`arrays.concat([1], 2)`, "ERROR: argument 1 to `arrays.concat` must be an ARRAY, got INTEGER"},
+		{`let a = [1, 2, 3]; [arrays.reverse(a), a]`, "[[3, 2, 1], [1, 2, 3]]"},
+		{`arrays.contains([1, "two", [3]], "two")`, "true"},
+		{`arrays.contains([1, "two", [3]], [3])`, "true"},
+		{`arrays.contains([1, 2], 3)`, "false"},
+		{`arrays.contains(1, 1)`, "ERROR: argument to `arrays.contains` must be an ARRAY, got INTEGER"},
+		{`hashes.keys({"b": 1, "a": 2, 3: 3, true: 4})`, "[3, a, b, true]"},
+		{`hashes.values({"b": 1, "a": 2})`, "[2, 1]"},
+		{`hashes.has({"a": 1}, "a")`, "true"},
+		{`hashes.has({"a": 1}, "b")`, "false"},
+		{`hashes.has({"a": 1}, [1])`, "ERROR: unusable as hash key: ARRAY"},
+		{`let h = {"a": 1, "b": 2}; [hashes.keys(hashes.delete(h, "a")), hashes.keys(h)]`, "[[b], [a, b]]"},
+		{`let h = hashes.merge({"a": 1, "b": 2}, {"b": 3}, {}); [hashes.keys(h), hashes.values(h)]`, "[[a, b], [1, 3]]"},
+		{`hashes.merge({}, [])`, "ERROR: argument 1 to `hashes.merge` must be a HASH, got ARRAY"},
+		{`hashes.keys([])`, "ERROR: argument to `hashes.keys` must be a HASH, got ARRAY"},
+		{`let strings = 1; strings`, "1"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	vm := New(compileProgram(t, "math.missing"))
+	err := vm.Run()
+	if err == nil || err.Error() != "module math has no export missing" {
+		t.Errorf("expected an error for a missing function, got %v", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let v = json_parse(json_stringify({"b": [1, 2], "a": if (false) { 1 }})); [v["b"][1], v["a"], hashes.keys(v)]`, "[2, null, [a, b]]"},
+		{`json_stringify(json_parse("[1.5, -2, {}, [true]]"))`, `[1.5,-2,{},[true]]`},
+		{`json_stringify({"id": 1, "tags": ["x"]}, 1)`, "{\n \"id\": 1,\n \"tags\": [\n  \"x\"\n ]\n}"},
+		{`json_parse("[1,")`, "ERROR: invalid JSON at line 1, column 4: unexpected end of input"},
+		{`json_stringify({"f": fn() { 1 }})`, "ERROR: cannot serialize CLOSURE at $.f as JSON"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestFileBuiltins(t *testing.T) {
+	sandbox, err := object.NewSandbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`write_file("a.txt", "one"); append_file("a.txt", " two"); read_file("a.txt")`, "one two"},
+		{`[exists("a.txt"), exists("b.txt"), list_dir()]`, "[true, false, [a.txt]]"},
+		{`files.remove("a.txt"); list_dir(".")`, "[]"},
+		{`read_file("../a.txt")`, "ERROR: path ../a.txt is outside of the sandbox"},
+		{`read_file("a.txt")`, "ERROR: unable to read a.txt: no such file or directory"},
+		{`write_file("a.txt", 1)`, "ERROR: argument 1 to `write_file` must be a STRING, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		vm.SetConfig(object.Config{Sandbox: sandbox})
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	for _, name := range []string{"read_file", "files.remove"} {
+		vm := New(compileProgram(t, name+`("a.txt")`))
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		expected := "ERROR: `" + name + "` is not allowed, file access is disabled"
+		if got := vm.LastPoppedStackElem().Inspect(); got != expected {
+			t.Errorf("wrong result without a sandbox. want=%q, got=%q", expected, got)
+		}
+	}
+}
+
+func TestRegex(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`regex("a+").match("baab")`, "true"},
+		{`let re = regex("[0-9]+"); [re.match("abc"), re.find("a12b345"), re.find("abc")]`, "[false, 12, null]"},
+		{`regex("[0-9]+").find_all("a1b22c333")`, "[1, 22, 333]"},
+		{`regex("[0-9]+").find_all("a1b22c333", 2)`, "[1, 22]"},
+		{`regex("(?P<key>[a-z]+)=([0-9]+)").replace("a=1, b=2", "${2}:${key}")`, "1:a, 2:b"},
+		{`regex(" *, *").split("a , b,c")`, "[a, b, c]"},
+		{`regex("(?P<user>[a-z]+)@([a-z]+)(!)?").captures("mail: bob@example")`, "{0: bob@example, 1: bob, 2: example, 3: null, user: bob}"},
+		{`let all = regex("([a-z])([0-9])").captures_all("a1 b2"); [all[0][1], all[1][2]]`, "[a, 2]"},
+		{`regex("x").captures("abc")`, "null"},
+		{`[regex("a+"), regex("a+").pattern]`, "[/a+/, a+]"},
+		{`regex("(a")`, "ERROR: invalid pattern for `regex`: missing closing ): `(a`"},
+		{`regex("a").split(1)`, "ERROR: argument to `regex.split` must be a STRING, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestTimeAndRandom(t *testing.T) {
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`now()`, "1709208000000"},
+		{`let t = now(); sleep(1500); now() - t`, "1500"},
+		{`format_time(now())`, "2024-02-29T12:00:00Z"},
+		{`format_time(0, "2006-01-02 15:04")`, "1970-01-01 00:00"},
+		{`parse_time("2024-02-29T12:00:00Z") == now()`, "true"},
+		{`parse_time("2024-02-29", "2006-01-02")`, "1709164800000"},
+		{`parse_time("soon")`, "ERROR: unable to parse time soon: parsing time \"soon\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"soon\" as \"2006\""},
+		{`sleep(-1)`, "ERROR: argument to `sleep` must not be negative, got -1"},
+		{`let r = random_int(1, 6); [r > 0, r < 7]`, "[true, true]"},
+		{`random_int(2, 1)`, "ERROR: empty range for `random_int`: 2 > 1"},
+		{`let s = shuffle([1, 2, 3, 4]); [len(s), arrays.contains(s, 1), arrays.contains(s, 4)]`, "[4, true, true]"},
+		{`shuffle(1)`, "ERROR: argument to `shuffle` must be an ARRAY, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		vm := New(compileProgram(t, tt.input))
+		vm.SetConfig(object.Config{Clock: object.NewFixedClock(start)})
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		if got := vm.LastPoppedStackElem().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	input := `[random_int(1, 1000), random_int(1, 1000), shuffle([1, 2, 3, 4, 5, 6])]`
+	results := make([]string, 2)
+	for i := range results {
+		vm := New(compileProgram(t, input))
+		vm.SetConfig(object.Config{Random: object.NewRandom(7)})
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		results[i] = vm.LastPoppedStackElem().Inspect()
+	}
+	if results[0] != results[1] {
+		t.Errorf("same seed gave different results: %s and %s", results[0], results[1])
+	}
+}
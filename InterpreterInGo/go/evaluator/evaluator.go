@@ -6,6 +6,21 @@ import (
 	"monkey/object"
 )
 
+// DefaultMaxCallDepth bounds how deeply Monkey functions may recurse in runs
+// that do not set Execution.MaxCallDepth, calls in tail position do not count
+// towards it.
+const DefaultMaxCallDepth = 10000
+
+// EvalExecution evaluates node like Eval, with the limits of the run taken
+// from execution, like its MaxCallDepth.
+func EvalExecution(node ast.Node, env *object.Environment, execution *object.Execution) object.Object {
+	previous := env.Execution()
+	env.SetExecution(execution)
+	defer env.SetExecution(previous)
+
+	return Eval(node, env)
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 
@@ -63,7 +78,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return evalFunction(function, args)
+		return evalFunction(function, args, env)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.Array:
@@ -168,35 +183,112 @@ func evalArrayIndex(arr, idx object.Object) object.Object {
 	return array.Items[index.Value]
 }
 
-func evalFunction(function object.Object, params []object.Object) object.Object {
-	switch fn := function.(type) {
-	case *object.FunctionValue:
-		extendedEnv := createExtendedEnvironment(fn, params)
-		evaluated := Eval(fn.Body, extendedEnv)
-		if rv, ok := evaluated.(*object.ReturnValue); ok {
-			return rv.Value
+// evalFunction trampolines: a call the function body ends with comes back
+// as an object.TailCall and is made here, so it neither grows the Go stack
+// nor counts towards the maximum call depth.
+func evalFunction(function object.Object, params []object.Object, caller *object.Environment) object.Object {
+	if maxDepth := maxCallDepth(caller); caller.CallDepth() >= maxDepth {
+		return newError("maximum call depth of %d exceeded", maxDepth)
+	}
+
+	for {
+		switch fn := function.(type) {
+		case *object.FunctionValue:
+			extendedEnv := createExtendedEnvironment(fn, params, caller)
+			evaluated := evalTailBlock(fn.Body, extendedEnv, true)
+
+			tailCall, ok := evaluated.(*object.TailCall)
+			if !ok {
+				if rv, ok := evaluated.(*object.ReturnValue); ok {
+					return rv.Value
+				}
+				return evaluated
+			}
+			function, params = tailCall.Function, tailCall.Arguments
+
+		case *object.BuiltIn:
+			return fn.Fn(params...)
+
+		default:
+			return newError("Object is not a function!!!!")
 		}
-		return evaluated
+	}
+}
 
-	case *object.BuiltIn:
-		return fn.Fn(params...)
+func maxCallDepth(env *object.Environment) int {
+	if execution := env.Execution(); execution != nil && execution.MaxCallDepth > 0 {
+		return execution.MaxCallDepth
 	}
+	return DefaultMaxCallDepth
+}
 
-	f, ok := function.(*object.FunctionValue)
-	if !ok {
-		return newError("Object is not a function!!!!")
+// evalTailBlock evaluates a function body or one of the if branches in it.
+// Calls made by return statements, and the call a tail block ends with, are
+// handed back as an object.TailCall instead of being made.
+func evalTailBlock(block *ast.BlockStatement, env *object.Environment, tail bool) object.Object {
+	var result object.Object
+
+	for i, s := range block.Statements {
+		switch s := s.(type) {
+		case *ast.ReturnStatement:
+			result = evalTailExpression(s.ReturnValue, env, true)
+			if result != nil && result.Type() != object.TAIL_CALL_OBJECT && result.Type() != object.ERROR_VALUE_OBJECT {
+				result = &object.ReturnValue{Value: result}
+			}
+		case *ast.ExpressionStatement:
+			result = evalTailExpression(s.Expression, env, tail && i == len(block.Statements)-1)
+		default:
+			result = Eval(s, env)
+		}
+
+		if result != nil {
+			rt := result.Type()
+			if rt == object.RETURN_VALUE_OBJECT || rt == object.ERROR_VALUE_OBJECT || rt == object.TAIL_CALL_OBJECT {
+				return result
+			}
+		}
 	}
 
-	extendedEnv := createExtendedEnvironment(f, params)
-	evaluated := Eval(f.Body, extendedEnv)
-	if rv, ok := evaluated.(*object.ReturnValue); ok {
-		return rv.Value
+	return result
+}
+
+func evalTailExpression(node ast.Expression, env *object.Environment, tail bool) object.Object {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		if !tail {
+			return Eval(node, env)
+		}
+
+		function := Eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		return &object.TailCall{Function: function, Arguments: args}
+
+	case *ast.IfExpression:
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if isTruthy(condition) {
+			return evalTailBlock(node.Consequence, env, tail)
+		} else if node.Alternative != nil {
+			return evalTailBlock(node.Alternative, env, tail)
+		} else {
+			return object.NULL
+		}
+
+	default:
+		return Eval(node, env)
 	}
-	return evaluated
 }
 
-func createExtendedEnvironment(function *object.FunctionValue, params []object.Object) *object.Environment {
-	env := object.NewEnclosedEnvironment(function.Env)
+func createExtendedEnvironment(function *object.FunctionValue, params []object.Object, caller *object.Environment) *object.Environment {
+	env := object.NewCallEnvironment(function.Env, caller)
 	for idx, p := range function.Parameters {
 		env.Set(p.Value, params[idx])
 	}
@@ -294,6 +386,9 @@ func processIntegerInfixExpresion(left *object.Integer, operand string, right *o
 	case "+":
 		return &object.Integer{Value: leftValue + rightValue}
 	case "/":
+		if rightValue == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftValue / rightValue}
 	case "*":
 		return &object.Integer{Value: leftValue * rightValue}
@@ -261,6 +261,7 @@ func TestErrorHandling(t *testing.T) {
 		{"true + false", "unknown operator: BOOLEAN + BOOLEAN"},
 		{"if(10 > 2) {if(10 > 2){return true + true} else {1}}", "unknown operator: BOOLEAN + BOOLEAN"},
 		{"foobar", "identifier not found: 'foobar'"},
+		{"1 / 0", "division by zero"},
 	}
 
 	for _, tt := range tests {
@@ -387,3 +388,65 @@ func testEval(s string) object.Object {
 
 	return Eval(program, env)
 }
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let loop = fn(n, acc) { if (n < 1) { acc } else { loop(n - 1, acc + n) } }; loop(200000, 0)", 20000100000},
+		{"let loop = fn(n) { if (n < 1) { return 0; } return loop(n - 1); }; loop(200000)", 0},
+		{"let loop = fn(n) { if (n > 0) { return loop(n - 1); } 7 }; loop(100000)", 7},
+		{"let f = fn(a) { len(a) }; f(\"four\")", 4},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testIntegerObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	depth := "let depth = fn(n) { if (n < 1) { 0 } else { 1 + depth(n - 1) } }; "
+	tests := []struct {
+		input                string
+		maxDepth             int
+		expected             int64
+		expectedErrorMessage string
+	}{
+		{depth + "depth(5000)", 0, 5000, ""},
+		{depth + "depth(49)", 50, 49, ""},
+		{depth + "depth(50)", 50, 0, "maximum call depth of 50 exceeded"},
+		{"let make = fn() { " + depth + "depth }; make()(50)", 50, 0, "maximum call depth of 50 exceeded"},
+		{"let f = fn(n) { 1 + f(n + 1) }; f(0)", 0, 0, "maximum call depth of 10000 exceeded"},
+	}
+
+	for _, tt := range tests {
+		env := object.NewEnvironment()
+		execution := &object.Execution{MaxCallDepth: tt.maxDepth}
+		evaluated := EvalExecution(parser.New(lexer.New(tt.input)).ParseProgram(), env, execution)
+
+		if tt.expectedErrorMessage == "" {
+			testIntegerObject(t, evaluated, tt.expected)
+			continue
+		}
+
+		errorObj, ok := evaluated.(*object.ErrorValue)
+		if !ok {
+			t.Fatalf("Expected errorMessage %s, found %T", tt.expectedErrorMessage, evaluated)
+		}
+
+		if errorObj.Message != tt.expectedErrorMessage {
+			t.Fatalf("Incorrct error message, expected: %s, found: %s", tt.expectedErrorMessage, errorObj.Message)
+		}
+	}
+
+	// the limit belongs to the run, later runs in the same environment do
+	// not keep it
+	env := object.NewEnvironment()
+	limited := EvalExecution(parser.New(lexer.New(depth+"depth(50)")).ParseProgram(), env, &object.Execution{MaxCallDepth: 50})
+	if _, ok := limited.(*object.ErrorValue); !ok {
+		t.Fatalf("Expected the limited run to fail, found %s", limited.Inspect())
+	}
+	testIntegerObject(t, Eval(parser.New(lexer.New("depth(50)")).ParseProgram(), env), 50)
+}
@@ -1,13 +1,25 @@
 package object
 
 type Environment struct {
-	outer *Environment
-	store map[string]Object
+	outer     *Environment
+	store     map[string]Object
+	callDepth int
+	execution *Execution
 }
 
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.execution = outer.execution
+	return env
+}
+
+// NewCallEnvironment encloses outer for a function called from the caller
+// environment, one call deeper than it.
+func NewCallEnvironment(outer *Environment, caller *Environment) *Environment {
+	env := NewEnclosedEnvironment(outer)
+	env.callDepth = caller.callDepth + 1
+	env.execution = caller.execution
 	return env
 }
 
@@ -24,6 +36,21 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// CallDepth is the number of function calls active in this environment.
+func (e *Environment) CallDepth() int {
+	return e.callDepth
+}
+
+// Execution is the run evaluating in this environment, nil outside of
+// evaluator.EvalExecution.
+func (e *Environment) Execution() *Execution {
+	return e.execution
+}
+
+func (e *Environment) SetExecution(execution *Execution) {
+	e.execution = execution
+}
+
 func (e *Environment) Set(name string, object Object) {
 	e.store[name] = object
 }
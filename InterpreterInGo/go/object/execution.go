@@ -0,0 +1,7 @@
+package object
+
+// Execution is the configuration of one evaluator run, shared by the
+// environments of all calls made during the run.
+type Execution struct {
+	MaxCallDepth int // maximum depth of nested calls, 0 for the evaluator's default
+}
@@ -69,6 +69,16 @@ type ReturnValue struct {
 func (rv *ReturnValue) Inspect() string  { return fmt.Sprintf("%v", rv.Value.Inspect()) }
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJECT }
 
+// TailCall stands in for the result of a call a function ends with, the
+// evaluator makes the call once the calling function has returned.
+type TailCall struct {
+	Function  Object
+	Arguments []Object
+}
+
+func (tc *TailCall) Inspect() string  { return "tail call to " + tc.Function.Inspect() }
+func (tc *TailCall) Type() ObjectType { return TAIL_CALL_OBJECT }
+
 type ErrorValue struct {
 	Message string
 }
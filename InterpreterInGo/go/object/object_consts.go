@@ -5,6 +5,7 @@ const (
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJECT   = "RETURN_VALUE"
+	TAIL_CALL_OBJECT      = "TAIL_CALL"
 	ERROR_VALUE_OBJECT    = "ERROR_VALUE"
 	FUNCTION_VALUE_OBJECT = "FUNCTION"
 	STRING_OBJECT         = "STRING_OBJECT"